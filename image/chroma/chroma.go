@@ -228,6 +228,10 @@ func ParseRGBA(s string) (color.RGBA, error) {
 		return HSV2RGB(h), nil
 	}
 
+	if c, ok := x11Color(s); ok {
+		return c, nil
+	}
+
 	return color.RGBA{}, fmt.Errorf("failed to parse color %q, unknown format", s)
 }
 
@@ -291,3 +295,19 @@ func AlphaBlendRGBA(a, b color.RGBA) color.RGBA {
 		255,
 	}
 }
+
+// SRGB2Linear inverts the sRGB transfer curve for a value in [0, 1]
+func SRGB2Linear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// Linear2SRGB applies the sRGB transfer curve to a value in [0, 1]
+func Linear2SRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
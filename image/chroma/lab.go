@@ -0,0 +1,111 @@
+package chroma
+
+import (
+	"image/color"
+	"math"
+
+	"github.com/qeedquan/go-media/math/f64"
+)
+
+// Lab is the CIE L*a*b* color of an sRGB color under D65,
+// L is in [0, 100] and euclidean distances approximate how
+// different two colors look
+type Lab struct {
+	L, A, B float64
+}
+
+var LabModel = color.ModelFunc(labModel)
+
+// D65 white point
+const (
+	labXn = 0.95047
+	labYn = 1.0
+	labZn = 1.08883
+)
+
+func labModel(c color.Color) color.Color {
+	if _, ok := c.(Lab); ok {
+		return c
+	}
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return RGB2LAB(color.RGBA{n.R, n.G, n.B, 0xff})
+}
+
+func (c Lab) RGBA() (r, g, b, a uint32) {
+	return LAB2RGB(c).RGBA()
+}
+
+// RGB2LAB converts the color channels of c, alpha is ignored
+func RGB2LAB(c color.RGBA) Lab {
+	return VEC32LAB(f64.Vec3{float64(c.R) / 255, float64(c.G) / 255, float64(c.B) / 255})
+}
+
+// VEC32LAB converts an sRGB color with channels in [0, 1]
+func VEC32LAB(c f64.Vec3) Lab {
+	r := SRGB2Linear(c.X)
+	g := SRGB2Linear(c.Y)
+	b := SRGB2Linear(c.Z)
+
+	x := (0.4124564*r + 0.3575761*g + 0.1804375*b) / labXn
+	y := (0.2126729*r + 0.7151522*g + 0.0721750*b) / labYn
+	z := (0.0193339*r + 0.1191920*g + 0.9503041*b) / labZn
+
+	fx, fy, fz := labf(x), labf(y), labf(z)
+	return Lab{
+		116*fy - 16,
+		500 * (fx - fy),
+		200 * (fy - fz),
+	}
+}
+
+func LAB2RGB(c Lab) color.RGBA {
+	v := LAB2VEC3(c)
+	return color.RGBA{
+		uint8(f64.Clamp(v.X*255+.5, 0, 255)),
+		uint8(f64.Clamp(v.Y*255+.5, 0, 255)),
+		uint8(f64.Clamp(v.Z*255+.5, 0, 255)),
+		0xff,
+	}
+}
+
+// LAB2VEC3 returns the sRGB color with channels in [0, 1],
+// colors outside of the sRGB gamut are clamped
+func LAB2VEC3(c Lab) f64.Vec3 {
+	fy := (c.L + 16) / 116
+	fx := fy + c.A/500
+	fz := fy - c.B/200
+	x := labfinv(fx) * labXn
+	y := labfinv(fy) * labYn
+	z := labfinv(fz) * labZn
+
+	r := 3.2404542*x - 1.5371385*y - 0.4985314*z
+	g := -0.9692660*x + 1.8760108*y + 0.0415560*z
+	b := 0.0556434*x - 0.2040259*y + 1.0572252*z
+	return f64.Vec3{
+		Linear2SRGB(f64.Clamp(r, 0, 1)),
+		Linear2SRGB(f64.Clamp(g, 0, 1)),
+		Linear2SRGB(f64.Clamp(b, 0, 1)),
+	}
+}
+
+// DeltaE is the CIE76 color difference
+func (c Lab) DeltaE(d Lab) float64 {
+	l, a, b := c.L-d.L, c.A-d.A, c.B-d.B
+	return math.Sqrt(l*l + a*a + b*b)
+}
+
+func labf(t float64) float64 {
+	const d = 6.0 / 29
+	if t > d*d*d {
+		return math.Cbrt(t)
+	}
+	return t/(3*d*d) + 4.0/29
+}
+
+func labfinv(t float64) float64 {
+	const d = 6.0 / 29
+	if t > d {
+		return t * t * t
+	}
+	return 3 * d * d * (t - 4.0/29)
+}
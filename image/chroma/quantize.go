@@ -0,0 +1,429 @@
+package chroma
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+
+	"github.com/qeedquan/go-media/math/f64"
+	"github.com/qeedquan/go-media/math/mt19937"
+)
+
+// The quantizers implement draw.Quantizer so they can be used for gif
+// encoding, they append up to cap(p)-len(p) colors to the palette and
+// nothing if there is no room left, one of them is transparent when
+// the image has pixels with less than half alpha
+
+type MedianCutQuantizer struct{}
+
+type OctreeQuantizer struct{}
+
+type KMeansQuantizer struct {
+	// Seed is used for the mt19937 generator picking the initial centers
+	Seed uint64
+
+	// Iterations is the maximum number of refinements, zero is 16
+	Iterations int
+
+	// Lab clusters the colors by their distance in the Lab color space
+	Lab bool
+}
+
+// colorBin is a cell of the color histogram with the
+// sum of the colors falling into it
+type colorBin struct {
+	sum [3]float64
+	n   float64
+}
+
+func (b *colorBin) mean() [3]float64 {
+	return [3]float64{b.sum[0] / b.n, b.sum[1] / b.n, b.sum[2] / b.n}
+}
+
+// histogram counts the opaque colors of the image
+// in cells of 5 bits per channel
+func histogram(m image.Image) (bins []colorBin, transparent bool) {
+	cells := make([]colorBin, 1<<15)
+	add := func(r, g, b, a uint8) {
+		if a < 0x80 {
+			transparent = true
+			return
+		}
+		c := &cells[int(r>>3)<<10|int(g>>3)<<5|int(b>>3)]
+		c.sum[0] += float64(r)
+		c.sum[1] += float64(g)
+		c.sum[2] += float64(b)
+		c.n++
+	}
+
+	rect := m.Bounds()
+	switch m := m.(type) {
+	case *image.NRGBA:
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			p := m.Pix[m.PixOffset(rect.Min.X, y):]
+			for x := 0; x < rect.Dx(); x++ {
+				add(p[x*4], p[x*4+1], p[x*4+2], p[x*4+3])
+			}
+		}
+	default:
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+				add(c.R, c.G, c.B, c.A)
+			}
+		}
+	}
+
+	for i := range cells {
+		if cells[i].n > 0 {
+			bins = append(bins, cells[i])
+		}
+	}
+	return
+}
+
+// prepare builds the histogram and reserves the transparent color,
+// it returns the number of colors left for the quantizer and no
+// bins when there is no room left so nothing more is appended
+func prepare(p color.Palette, m image.Image) (color.Palette, []colorBin, int) {
+	n := cap(p) - len(p)
+	if n <= 0 {
+		return p, nil, 0
+	}
+	bins, transparent := histogram(m)
+	if transparent {
+		p = append(p, color.RGBA{})
+		n--
+	}
+	if n == 0 {
+		bins = nil
+	}
+	return p, bins, n
+}
+
+func appendColors(p color.Palette, colors [][3]float64) color.Palette {
+	for _, c := range colors {
+		p = append(p, color.RGBA{
+			uint8(math.Min(c[0]+.5, 255)),
+			uint8(math.Min(c[1]+.5, 255)),
+			uint8(math.Min(c[2]+.5, 255)),
+			0xff,
+		})
+	}
+	return p
+}
+
+// all returns the colors of the histogram if they fit the palette
+func all(bins []colorBin, n int) ([][3]float64, bool) {
+	if len(bins) > n {
+		return nil, false
+	}
+	var colors [][3]float64
+	for i := range bins {
+		colors = append(colors, bins[i].mean())
+	}
+	return colors, true
+}
+
+// Quantize splits the box of colors with the largest squared error
+// along its widest axis at the median until there are enough boxes
+func (MedianCutQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	p, bins, n := prepare(p, m)
+	if colors, ok := all(bins, n); ok {
+		return appendColors(p, colors)
+	}
+
+	type box struct {
+		bins []colorBin
+		err  float64
+		axis int
+	}
+	measure := func(bins []colorBin) box {
+		var sum, sq [3]float64
+		var total float64
+		for i := range bins {
+			b := &bins[i]
+			for j := range sum {
+				sum[j] += b.sum[j]
+				v := b.sum[j] / b.n
+				sq[j] += v * v * b.n
+			}
+			total += b.n
+		}
+		bx := box{bins: bins}
+		best := -1.0
+		for j := range sum {
+			v := sq[j] - sum[j]*sum[j]/total
+			bx.err += v
+			if v > best {
+				best, bx.axis = v, j
+			}
+		}
+		return bx
+	}
+
+	boxes := []box{measure(bins)}
+	for len(boxes) < n {
+		k := -1
+		for i := range boxes {
+			if len(boxes[i].bins) > 1 && (k < 0 || boxes[i].err > boxes[k].err) {
+				k = i
+			}
+		}
+		if k < 0 {
+			break
+		}
+
+		bx := boxes[k]
+		axis := bx.axis
+		sort.Slice(bx.bins, func(i, j int) bool {
+			return bx.bins[i].sum[axis]/bx.bins[i].n < bx.bins[j].sum[axis]/bx.bins[j].n
+		})
+		var total, acc float64
+		for i := range bx.bins {
+			total += bx.bins[i].n
+		}
+		cut := 1
+		for i := range bx.bins[:len(bx.bins)-1] {
+			acc += bx.bins[i].n
+			cut = i + 1
+			if acc >= total/2 {
+				break
+			}
+		}
+		boxes[k] = measure(bx.bins[:cut])
+		boxes = append(boxes, measure(bx.bins[cut:]))
+	}
+
+	colors := make([][3]float64, len(boxes))
+	for i, bx := range boxes {
+		var c colorBin
+		for _, b := range bx.bins {
+			for j := range c.sum {
+				c.sum[j] += b.sum[j]
+			}
+			c.n += b.n
+		}
+		colors[i] = c.mean()
+	}
+	return appendColors(p, colors)
+}
+
+type octNode struct {
+	child [8]*octNode
+	colorBin
+	leaf bool
+}
+
+// Quantize builds an octree of the colors and merges the
+// least used nodes from the deepest level up until the
+// leaves fit the palette
+func (OctreeQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	p, bins, n := prepare(p, m)
+	if colors, ok := all(bins, n); ok {
+		return appendColors(p, colors)
+	}
+
+	// the histogram has 5 bits per channel so the tree is 5 levels deep
+	const depth = 5
+	var levels [depth][]*octNode
+	root := &octNode{}
+	leaves := 0
+	for _, b := range bins {
+		c := b.mean()
+		node := root
+		for l := 0; l < depth; l++ {
+			shift := uint(7 - l)
+			i := int(uint8(c[0])>>shift&1)<<2 | int(uint8(c[1])>>shift&1)<<1 | int(uint8(c[2])>>shift&1)
+			if node.child[i] == nil {
+				node.child[i] = &octNode{leaf: l == depth-1}
+				if l < depth-1 {
+					levels[l+1] = append(levels[l+1], node.child[i])
+				} else {
+					leaves++
+				}
+			}
+			node = node.child[i]
+		}
+		for j := range node.sum {
+			node.sum[j] += b.sum[j]
+		}
+		node.n += b.n
+	}
+
+	// sums of the subtrees decide which nodes are merged first
+	var total func(node *octNode) colorBin
+	total = func(node *octNode) colorBin {
+		if node.leaf {
+			return node.colorBin
+		}
+		var c colorBin
+		for _, ch := range node.child {
+			if ch != nil {
+				t := total(ch)
+				for j := range c.sum {
+					c.sum[j] += t.sum[j]
+				}
+				c.n += t.n
+			}
+		}
+		node.colorBin = c
+		return c
+	}
+	total(root)
+	levels[0] = []*octNode{root}
+
+	for l := depth - 1; l >= 0 && leaves > n; l-- {
+		nodes := levels[l]
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].n < nodes[j].n })
+		for _, node := range nodes {
+			if leaves <= n {
+				break
+			}
+			merged := 0
+			for i, ch := range node.child {
+				if ch != nil {
+					merged++
+					node.child[i] = nil
+				}
+			}
+			node.leaf = true
+			leaves -= merged - 1
+		}
+	}
+
+	var colors [][3]float64
+	var walk func(node *octNode)
+	walk = func(node *octNode) {
+		if node.leaf {
+			colors = append(colors, node.mean())
+			return
+		}
+		for _, ch := range node.child {
+			if ch != nil {
+				walk(ch)
+			}
+		}
+	}
+	walk(root)
+	return appendColors(p, colors)
+}
+
+// Quantize clusters the colors with k-means weighted by how often they
+// appear, the centers are seeded with k-means++
+func (q KMeansQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	p, bins, n := prepare(p, m)
+	if colors, ok := all(bins, n); ok {
+		return appendColors(p, colors)
+	}
+	iterations := q.Iterations
+	if iterations <= 0 {
+		iterations = 16
+	}
+
+	// points are in the space the distances are measured in
+	points := make([][3]float64, len(bins))
+	for i := range bins {
+		c := bins[i].mean()
+		if q.Lab {
+			l := VEC32LAB(f64.Vec3{c[0] / 255, c[1] / 255, c[2] / 255})
+			c = [3]float64{l.L, l.A, l.B}
+		}
+		points[i] = c
+	}
+
+	rng := mt19937.New64()
+	rng.Seed(q.Seed)
+	centers := make([][3]float64, 0, n)
+	dist := make([]float64, len(points))
+	for i := range dist {
+		dist[i] = math.MaxFloat64
+	}
+	pick := func() int {
+		var sum float64
+		for i := range dist {
+			sum += dist[i] * bins[i].n
+		}
+		t := rng.Float64() * sum
+		for i := range dist {
+			t -= dist[i] * bins[i].n
+			if t < 0 {
+				return i
+			}
+		}
+		return len(dist) - 1
+	}
+
+	first := int(rng.Float64() * float64(len(points)))
+	centers = append(centers, points[first])
+	for len(centers) < n {
+		c := centers[len(centers)-1]
+		for i := range points {
+			dist[i] = math.Min(dist[i], distance(points[i], c))
+		}
+		centers = append(centers, points[pick()])
+	}
+
+	assign := make([]int, len(points))
+	for i := range assign {
+		assign[i] = -1
+	}
+	sums := make([]colorBin, n)
+	for it := 0; it < iterations; it++ {
+		changed := false
+		for i := range points {
+			best, bd := 0, math.MaxFloat64
+			for j := range centers {
+				if d := distance(points[i], centers[j]); d < bd {
+					best, bd = j, d
+				}
+			}
+			if assign[i] != best {
+				assign[i] = best
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+
+		for j := range sums {
+			sums[j] = colorBin{}
+		}
+		for i, j := range assign {
+			for k := range sums[j].sum {
+				sums[j].sum[k] += points[i][k] * bins[i].n
+			}
+			sums[j].n += bins[i].n
+		}
+		for j := range centers {
+			if sums[j].n > 0 {
+				centers[j] = sums[j].mean()
+			}
+		}
+	}
+
+	// the palette colors are the means of the rgb colors of each cluster
+	for j := range sums {
+		sums[j] = colorBin{}
+	}
+	for i, j := range assign {
+		for k := range sums[j].sum {
+			sums[j].sum[k] += bins[i].sum[k]
+		}
+		sums[j].n += bins[i].n
+	}
+	var colors [][3]float64
+	for j := range sums {
+		if sums[j].n > 0 {
+			colors = append(colors, sums[j].mean())
+		}
+	}
+	return appendColors(p, colors)
+}
+
+func distance(a, b [3]float64) float64 {
+	x, y, z := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return x*x + y*y + z*z
+}
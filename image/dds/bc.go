@@ -0,0 +1,322 @@
+package dds
+
+import (
+	"encoding/binary"
+	"image/color"
+	"math"
+)
+
+// block is a 4x4 group of pixels in row order
+type block [16]color.NRGBA
+
+func unpack565(v uint16) color.NRGBA {
+	r := uint8(v >> 11 & 0x1f)
+	g := uint8(v >> 5 & 0x3f)
+	b := uint8(v & 0x1f)
+	return color.NRGBA{r<<3 | r>>2, g<<2 | g>>4, b<<3 | b>>2, 0xff}
+}
+
+func pack565(c [3]float64) uint16 {
+	q := func(v float64, max float64) uint16 {
+		return uint16(math.Max(0, math.Min(max, math.Floor(v/255*max+.5))))
+	}
+	return q(c[0], 31)<<11 | q(c[1], 63)<<5 | q(c[2], 31)
+}
+
+func mix(a, b color.NRGBA, wa, wb, d int) color.NRGBA {
+	return color.NRGBA{
+		uint8((int(a.R)*wa + int(b.R)*wb) / d),
+		uint8((int(a.G)*wa + int(b.G)*wb) / d),
+		uint8((int(a.B)*wa + int(b.B)*wb) / d),
+		0xff,
+	}
+}
+
+// colorPalette builds the four colors of a color block, when
+// alpha is allowed c0 <= c1 selects three colors and transparency
+func colorPalette(c0, c1 uint16, alpha bool) [4]color.NRGBA {
+	a, b := unpack565(c0), unpack565(c1)
+	if c0 > c1 || !alpha {
+		return [4]color.NRGBA{a, b, mix(a, b, 2, 1, 3), mix(a, b, 1, 2, 3)}
+	}
+	return [4]color.NRGBA{a, b, mix(a, b, 1, 1, 2), {}}
+}
+
+func decodeColor(b []byte, blk *block, alpha bool) {
+	c0 := binary.LittleEndian.Uint16(b)
+	c1 := binary.LittleEndian.Uint16(b[2:])
+	p := colorPalette(c0, c1, alpha)
+	idx := binary.LittleEndian.Uint32(b[4:])
+	for i := range blk {
+		blk[i] = p[idx>>(2*uint(i))&3]
+	}
+}
+
+// alphaPalette builds the eight values of an interpolated alpha block
+func alphaPalette(a0, a1 uint8) [8]uint8 {
+	var p [8]uint8
+	p[0], p[1] = a0, a1
+	if a0 > a1 {
+		for i := 1; i < 7; i++ {
+			p[i+1] = uint8((int(a0)*(7-i) + int(a1)*i) / 7)
+		}
+	} else {
+		for i := 1; i < 5; i++ {
+			p[i+1] = uint8((int(a0)*(5-i) + int(a1)*i) / 5)
+		}
+		p[6], p[7] = 0, 255
+	}
+	return p
+}
+
+// decodeAlpha decodes an interpolated block into v, signed blocks
+// store two's complement endpoints which are shifted to [0, 255]
+func decodeAlpha(b []byte, v *[16]uint8, signed bool) {
+	a0, a1 := b[0], b[1]
+	if signed {
+		a0, a1 = snorm(a0), snorm(a1)
+	}
+	p := alphaPalette(a0, a1)
+	var idx uint64
+	for i := 7; i >= 2; i-- {
+		idx = idx<<8 | uint64(b[i])
+	}
+	for i := range v {
+		v[i] = p[idx>>(3*uint(i))&7]
+	}
+}
+
+func snorm(v uint8) uint8 {
+	s := int(int8(v))
+	if s < -127 {
+		s = -127
+	}
+	return uint8((s + 127) * 255 / 254)
+}
+
+func decodeBC1(b []byte, blk *block) {
+	decodeColor(b, blk, true)
+}
+
+func decodeBC2(b []byte, blk *block) {
+	decodeColor(b[8:], blk, false)
+	for i := range blk {
+		a := b[i/2] >> (4 * uint(i%2)) & 0xf
+		blk[i].A = a<<4 | a
+	}
+}
+
+func decodeBC3(b []byte, blk *block) {
+	decodeColor(b[8:], blk, false)
+	var a [16]uint8
+	decodeAlpha(b, &a, false)
+	for i := range blk {
+		blk[i].A = a[i]
+	}
+}
+
+func decodeBC4(b []byte, blk *block, signed bool) {
+	var r [16]uint8
+	decodeAlpha(b, &r, signed)
+	for i := range blk {
+		blk[i] = color.NRGBA{r[i], r[i], r[i], 0xff}
+	}
+}
+
+func decodeBC5(b []byte, blk *block, signed bool) {
+	var r, g [16]uint8
+	decodeAlpha(b, &r, signed)
+	decodeAlpha(b[8:], &g, signed)
+	for i := range blk {
+		blk[i] = color.NRGBA{r[i], g[i], 0, 0xff}
+	}
+}
+
+// encodeColor compresses the colors of the block along their principal
+// axis, when alpha is allowed transparent pixels use the three color mode
+func encodeColor(b []byte, blk *block, alpha bool) {
+	var (
+		mean [3]float64
+		n    float64
+	)
+	transparent := false
+	for _, c := range blk {
+		if alpha && c.A < 128 {
+			transparent = true
+			continue
+		}
+		mean[0] += float64(c.R)
+		mean[1] += float64(c.G)
+		mean[2] += float64(c.B)
+		n++
+	}
+	if n == 0 {
+		binary.LittleEndian.PutUint16(b, 0)
+		binary.LittleEndian.PutUint16(b[2:], 0)
+		binary.LittleEndian.PutUint32(b[4:], 0xffffffff)
+		return
+	}
+	for i := range mean {
+		mean[i] /= n
+	}
+
+	// covariance matrix of the opaque pixels
+	var cov [6]float64
+	for _, c := range blk {
+		if alpha && c.A < 128 {
+			continue
+		}
+		r := float64(c.R) - mean[0]
+		g := float64(c.G) - mean[1]
+		b := float64(c.B) - mean[2]
+		cov[0] += r * r
+		cov[1] += r * g
+		cov[2] += r * b
+		cov[3] += g * g
+		cov[4] += g * b
+		cov[5] += b * b
+	}
+
+	// power iteration for the principal axis
+	axis := [3]float64{1, 1, 1}
+	for k := 0; k < 8; k++ {
+		x := [3]float64{
+			cov[0]*axis[0] + cov[1]*axis[1] + cov[2]*axis[2],
+			cov[1]*axis[0] + cov[3]*axis[1] + cov[4]*axis[2],
+			cov[2]*axis[0] + cov[4]*axis[1] + cov[5]*axis[2],
+		}
+		l := math.Max(math.Abs(x[0]), math.Max(math.Abs(x[1]), math.Abs(x[2])))
+		if l == 0 {
+			break
+		}
+		axis = [3]float64{x[0] / l, x[1] / l, x[2] / l}
+	}
+
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, c := range blk {
+		if alpha && c.A < 128 {
+			continue
+		}
+		t := (float64(c.R)-mean[0])*axis[0] + (float64(c.G)-mean[1])*axis[1] + (float64(c.B)-mean[2])*axis[2]
+		lo = math.Min(lo, t)
+		hi = math.Max(hi, t)
+	}
+	var e0, e1 [3]float64
+	for i := range mean {
+		e0[i] = mean[i] + axis[i]*hi
+		e1[i] = mean[i] + axis[i]*lo
+	}
+
+	c0, c1 := pack565(e0), pack565(e1)
+	if transparent {
+		if c0 > c1 {
+			c0, c1 = c1, c0
+		}
+	} else {
+		if c0 < c1 {
+			c0, c1 = c1, c0
+		}
+	}
+	p := colorPalette(c0, c1, alpha)
+	colors := 4
+	if c0 <= c1 && alpha {
+		colors = 3
+	}
+
+	var idx uint32
+	for i, c := range blk {
+		best := 3
+		if !(alpha && c.A < 128) {
+			bestd := math.MaxInt32
+			for j := 0; j < colors; j++ {
+				dr := int(c.R) - int(p[j].R)
+				dg := int(c.G) - int(p[j].G)
+				db := int(c.B) - int(p[j].B)
+				if d := dr*dr + dg*dg + db*db; d < bestd {
+					best, bestd = j, d
+				}
+			}
+		}
+		idx |= uint32(best) << (2 * uint(i))
+	}
+
+	binary.LittleEndian.PutUint16(b, c0)
+	binary.LittleEndian.PutUint16(b[2:], c1)
+	binary.LittleEndian.PutUint32(b[4:], idx)
+}
+
+// encodeAlpha compresses single channel values using the eight value mode
+func encodeAlpha(b []byte, v *[16]uint8) {
+	a0, a1 := v[0], v[0]
+	for _, x := range v {
+		if x > a0 {
+			a0 = x
+		}
+		if x < a1 {
+			a1 = x
+		}
+	}
+
+	p := alphaPalette(a0, a1)
+	var idx uint64
+	for i, x := range v {
+		best, bestd := 0, 256
+		for j := range p {
+			d := int(x) - int(p[j])
+			if d < 0 {
+				d = -d
+			}
+			if d < bestd {
+				best, bestd = j, d
+			}
+		}
+		idx |= uint64(best) << (3 * uint(i))
+	}
+
+	b[0], b[1] = a0, a1
+	for i := 2; i < 8; i++ {
+		b[i] = uint8(idx)
+		idx >>= 8
+	}
+}
+
+func encodeBC1(b []byte, blk *block) {
+	encodeColor(b, blk, true)
+}
+
+func encodeBC2(b []byte, blk *block) {
+	for i := range b[:8] {
+		b[i] = 0
+	}
+	for i, c := range blk {
+		a := (uint(c.A)*15 + 127) / 255
+		b[i/2] |= uint8(a) << (4 * uint(i%2))
+	}
+	encodeColor(b[8:], blk, false)
+}
+
+func encodeBC3(b []byte, blk *block) {
+	var a [16]uint8
+	for i := range blk {
+		a[i] = blk[i].A
+	}
+	encodeAlpha(b, &a)
+	encodeColor(b[8:], blk, false)
+}
+
+func encodeBC4(b []byte, blk *block) {
+	var r [16]uint8
+	for i, c := range blk {
+		r[i] = c.R
+	}
+	encodeAlpha(b, &r)
+}
+
+func encodeBC5(b []byte, blk *block) {
+	var r, g [16]uint8
+	for i, c := range blk {
+		r[i], g[i] = c.R, c.G
+	}
+	encodeAlpha(b, &r)
+	encodeAlpha(b[8:], &g)
+}
@@ -0,0 +1,508 @@
+package dds
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math/bits"
+)
+
+const ddsHeader = "DDS "
+
+// surface formats
+const (
+	FORMAT_RGBA = iota
+	FORMAT_BC1
+	FORMAT_BC2
+	FORMAT_BC3
+	FORMAT_BC4
+	FORMAT_BC5
+	FORMAT_BC4_SNORM
+	FORMAT_BC5_SNORM
+)
+
+// header flags
+const (
+	ddsdCaps        = 0x1
+	ddsdHeight      = 0x2
+	ddsdWidth       = 0x4
+	ddsdPitch       = 0x8
+	ddsdPixelFormat = 0x1000
+	ddsdMipMapCount = 0x20000
+	ddsdLinearSize  = 0x80000
+)
+
+// pixel format flags
+const (
+	ddpfAlphaPixels = 0x1
+	ddpfAlpha       = 0x2
+	ddpfFourCC      = 0x4
+	ddpfRGB         = 0x40
+	ddpfLuminance   = 0x20000
+)
+
+// caps flags
+const (
+	ddscapsComplex = 0x8
+	ddscapsTexture = 0x1000
+	ddscapsMipMap  = 0x400000
+
+	ddscaps2Cubemap = 0x200
+	ddscaps2Faces   = 0xfc00
+	ddscaps2Volume  = 0x200000
+)
+
+// dxgi formats
+const (
+	dxgiR10G10B10A2     = 24
+	dxgiR8G8B8A8        = 28
+	dxgiR8G8B8A8SRGB    = 29
+	dxgiR8G8            = 49
+	dxgiR8              = 61
+	dxgiA8              = 65
+	dxgiBC1             = 71
+	dxgiBC1SRGB         = 72
+	dxgiBC2             = 74
+	dxgiBC2SRGB         = 75
+	dxgiBC3             = 77
+	dxgiBC3SRGB         = 78
+	dxgiBC4             = 80
+	dxgiBC4SNORM        = 81
+	dxgiBC5             = 83
+	dxgiBC5SNORM        = 84
+	dxgiB5G6R5          = 85
+	dxgiB5G5R5A1        = 86
+	dxgiB8G8R8A8        = 87
+	dxgiB8G8R8X8        = 88
+	dxgiB8G8R8A8SRGB    = 91
+	dxgiB8G8R8X8SRGB    = 93
+	dxgiB4G4R4A4        = 115
+	dxgiTexture2D       = 3
+	dxgiTexture3D       = 4
+	dxgiMiscTextureCube = 0x4
+)
+
+type pixelFormat struct {
+	Size        uint32
+	Flags       uint32
+	FourCC      [4]byte
+	RGBBitCount uint32
+	Masks       [4]uint32
+}
+
+type header struct {
+	Magic             [4]byte
+	Size              uint32
+	Flags             uint32
+	Height            uint32
+	Width             uint32
+	PitchOrLinearSize uint32
+	Depth             uint32
+	MipMapCount       uint32
+	Reserved1         [11]uint32
+	PixelFormat       pixelFormat
+	Caps              [4]uint32
+	Reserved2         uint32
+}
+
+type headerDX10 struct {
+	Format            uint32
+	ResourceDimension uint32
+	MiscFlag          uint32
+	ArraySize         uint32
+	MiscFlags2        uint32
+}
+
+// File is a texture with all of its surfaces
+type File struct {
+	Format  int
+	Cubemap bool
+
+	// DX10 is set if the file uses the extended header,
+	// arrays are always written with it
+	DX10 bool
+
+	// Images holds the surfaces indexed by slice then mip level, cube
+	// maps store one slice per face in +X, -X, +Y, -Y, +Z, -Z order
+	Images [][]image.Image
+}
+
+type decoder struct {
+	r      io.Reader
+	h      header
+	format int
+	dx10   bool
+	cube   bool
+	slices int
+	mips   int
+
+	// layout of uncompressed pixels
+	bpp       int
+	masks     [4]uint32
+	luminance bool
+	alpha     bool
+}
+
+func Decode(r io.Reader) (image.Image, error) {
+	d := &decoder{r: r}
+	err := d.decodeHeader()
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeSurface(int(d.h.Width), int(d.h.Height))
+}
+
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	d := &decoder{r: r}
+	err := d.decodeHeader()
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{
+		ColorModel: d.colorModel(),
+		Width:      int(d.h.Width),
+		Height:     int(d.h.Height),
+	}, nil
+}
+
+func DecodeFile(r io.Reader) (*File, error) {
+	d := &decoder{r: r}
+	err := d.decodeHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{
+		Format:  d.format,
+		Cubemap: d.cube,
+		DX10:    d.dx10,
+		Images:  make([][]image.Image, d.slices),
+	}
+	for i := range f.Images {
+		for l := 0; l < d.mips; l++ {
+			m, err := d.decodeSurface(mipSize(int(d.h.Width), l), mipSize(int(d.h.Height), l))
+			if err != nil {
+				return nil, err
+			}
+			f.Images[i] = append(f.Images[i], m)
+		}
+	}
+	return f, nil
+}
+
+func mipSize(n, level int) int {
+	n >>= uint(level)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+func (d *decoder) decodeHeader() error {
+	h := &d.h
+	err := binary.Read(d.r, binary.LittleEndian, h)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if string(h.Magic[:]) != ddsHeader || h.Size != 124 {
+		return errors.New("dds: invalid header")
+	}
+	if h.Width < 1 || h.Height < 1 || h.Width > 1<<16 || h.Height > 1<<16 {
+		return fmt.Errorf("dds: invalid dimension %dx%d", h.Width, h.Height)
+	}
+	if h.Caps[1]&ddscaps2Volume != 0 {
+		return errors.New("dds: volume textures are not supported")
+	}
+
+	d.mips, d.slices = 1, 1
+	if h.Flags&ddsdMipMapCount != 0 && h.MipMapCount > 1 {
+		d.mips = int(h.MipMapCount)
+		if max := bits.Len32(h.Width | h.Height); d.mips > max {
+			return fmt.Errorf("dds: invalid mipmap count %d", d.mips)
+		}
+	}
+	if h.Caps[1]&ddscaps2Cubemap != 0 {
+		d.cube = true
+		d.slices = bits.OnesCount32(h.Caps[1] & ddscaps2Faces)
+	}
+
+	pf := &h.PixelFormat
+	switch {
+	case pf.Flags&ddpfFourCC != 0:
+		switch string(pf.FourCC[:]) {
+		case "DXT1":
+			d.format = FORMAT_BC1
+		case "DXT2", "DXT3":
+			d.format = FORMAT_BC2
+		case "DXT4", "DXT5":
+			d.format = FORMAT_BC3
+		case "ATI1", "BC4U":
+			d.format = FORMAT_BC4
+		case "BC4S":
+			d.format = FORMAT_BC4_SNORM
+		case "ATI2", "BC5U":
+			d.format = FORMAT_BC5
+		case "BC5S":
+			d.format = FORMAT_BC5_SNORM
+		case "DX10":
+			return d.decodeDX10()
+		default:
+			return fmt.Errorf("dds: unsupported fourcc %q", pf.FourCC[:])
+		}
+
+	case pf.Flags&(ddpfRGB|ddpfLuminance|ddpfAlpha) != 0:
+		d.format = FORMAT_RGBA
+		d.bpp = int(pf.RGBBitCount)
+		d.masks = pf.Masks
+		d.luminance = pf.Flags&ddpfLuminance != 0
+		d.alpha = pf.Flags&(ddpfRGB|ddpfLuminance) == 0
+		if pf.Flags&(ddpfAlphaPixels|ddpfAlpha) == 0 {
+			d.masks[3] = 0
+		}
+		switch d.bpp {
+		case 8, 16, 24, 32:
+		default:
+			return fmt.Errorf("dds: unsupported bit count %d", d.bpp)
+		}
+
+	default:
+		return errors.New("dds: unsupported pixel format")
+	}
+	return nil
+}
+
+func (d *decoder) decodeDX10() error {
+	var x headerDX10
+	err := binary.Read(d.r, binary.LittleEndian, &x)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if x.ResourceDimension == dxgiTexture3D {
+		return errors.New("dds: volume textures are not supported")
+	}
+
+	d.dx10 = true
+	d.slices = int(x.ArraySize)
+	if d.slices < 1 {
+		d.slices = 1
+	}
+	if x.MiscFlag&dxgiMiscTextureCube != 0 {
+		d.cube = true
+		d.slices *= 6
+	}
+	if d.slices > 1<<16 {
+		return fmt.Errorf("dds: invalid array size %d", x.ArraySize)
+	}
+
+	d.format = FORMAT_RGBA
+	switch x.Format {
+	case dxgiBC1, dxgiBC1SRGB:
+		d.format = FORMAT_BC1
+	case dxgiBC2, dxgiBC2SRGB:
+		d.format = FORMAT_BC2
+	case dxgiBC3, dxgiBC3SRGB:
+		d.format = FORMAT_BC3
+	case dxgiBC4:
+		d.format = FORMAT_BC4
+	case dxgiBC4SNORM:
+		d.format = FORMAT_BC4_SNORM
+	case dxgiBC5:
+		d.format = FORMAT_BC5
+	case dxgiBC5SNORM:
+		d.format = FORMAT_BC5_SNORM
+	case dxgiR8G8B8A8, dxgiR8G8B8A8SRGB:
+		d.bpp, d.masks = 32, [4]uint32{0xff, 0xff00, 0xff0000, 0xff000000}
+	case dxgiB8G8R8A8, dxgiB8G8R8A8SRGB:
+		d.bpp, d.masks = 32, [4]uint32{0xff0000, 0xff00, 0xff, 0xff000000}
+	case dxgiB8G8R8X8, dxgiB8G8R8X8SRGB:
+		d.bpp, d.masks = 32, [4]uint32{0xff0000, 0xff00, 0xff, 0}
+	case dxgiR10G10B10A2:
+		d.bpp, d.masks = 32, [4]uint32{0x3ff, 0xffc00, 0x3ff00000, 0xc0000000}
+	case dxgiR8G8:
+		d.bpp, d.masks = 16, [4]uint32{0xff, 0xff00, 0, 0}
+	case dxgiR8:
+		d.bpp, d.masks, d.luminance = 8, [4]uint32{0xff, 0, 0, 0}, true
+	case dxgiA8:
+		d.bpp, d.masks, d.alpha = 8, [4]uint32{0, 0, 0, 0xff}, true
+	case dxgiB5G6R5:
+		d.bpp, d.masks = 16, [4]uint32{0xf800, 0x7e0, 0x1f, 0}
+	case dxgiB5G5R5A1:
+		d.bpp, d.masks = 16, [4]uint32{0x7c00, 0x3e0, 0x1f, 0x8000}
+	case dxgiB4G4R4A4:
+		d.bpp, d.masks = 16, [4]uint32{0xf00, 0xf0, 0xf, 0xf000}
+	default:
+		return fmt.Errorf("dds: unsupported dxgi format %d", x.Format)
+	}
+	return nil
+}
+
+func (d *decoder) colorModel() color.Model {
+	switch {
+	case d.format == FORMAT_BC4 || d.format == FORMAT_BC4_SNORM:
+		return color.GrayModel
+	case d.format != FORMAT_RGBA:
+		return color.NRGBAModel
+	case d.alpha:
+		return color.AlphaModel
+	case d.luminance && d.masks[3] == 0:
+		return color.GrayModel
+	}
+	return color.NRGBAModel
+}
+
+func blockSize(format int) int {
+	switch format {
+	case FORMAT_BC1, FORMAT_BC4, FORMAT_BC4_SNORM:
+		return 8
+	}
+	return 16
+}
+
+// surfaceSize is the number of bytes used by a surface
+func (d *decoder) surfaceSize(w, h int) int {
+	if d.format == FORMAT_RGBA {
+		return w * h * d.bpp / 8
+	}
+	return (w + 3) / 4 * ((h + 3) / 4) * blockSize(d.format)
+}
+
+func (d *decoder) decodeSurface(w, h int) (image.Image, error) {
+	n := d.surfaceSize(w, h)
+	b, err := ioutil.ReadAll(io.LimitReader(d.r, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != n {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	r := image.Rect(0, 0, w, h)
+	if d.format == FORMAT_RGBA {
+		return d.decodePixels(b, r), nil
+	}
+
+	var (
+		blk  block
+		m    *image.NRGBA
+		g    *image.Gray
+		size = blockSize(d.format)
+	)
+	if d.format == FORMAT_BC4 || d.format == FORMAT_BC4_SNORM {
+		g = image.NewGray(r)
+	} else {
+		m = image.NewNRGBA(r)
+	}
+
+	for by := 0; by < h; by += 4 {
+		for bx := 0; bx < w; bx += 4 {
+			switch d.format {
+			case FORMAT_BC1:
+				decodeBC1(b, &blk)
+			case FORMAT_BC2:
+				decodeBC2(b, &blk)
+			case FORMAT_BC3:
+				decodeBC3(b, &blk)
+			case FORMAT_BC4, FORMAT_BC4_SNORM:
+				decodeBC4(b, &blk, d.format == FORMAT_BC4_SNORM)
+			case FORMAT_BC5, FORMAT_BC5_SNORM:
+				decodeBC5(b, &blk, d.format == FORMAT_BC5_SNORM)
+			}
+			b = b[size:]
+
+			for y := 0; y < 4 && by+y < h; y++ {
+				for x := 0; x < 4 && bx+x < w; x++ {
+					c := blk[y*4+x]
+					if g != nil {
+						g.Pix[(by+y)*g.Stride+bx+x] = c.R
+					} else {
+						m.SetNRGBA(bx+x, by+y, c)
+					}
+				}
+			}
+		}
+	}
+	if g != nil {
+		return g, nil
+	}
+	return m, nil
+}
+
+// decodePixels decodes uncompressed pixels described by channel masks
+func (d *decoder) decodePixels(b []byte, r image.Rectangle) image.Image {
+	n := d.bpp / 8
+	w, h := r.Dx(), r.Dy()
+
+	switch d.colorModel() {
+	case color.AlphaModel:
+		a := image.NewAlpha(r)
+		for i := range a.Pix {
+			a.Pix[i] = bitfield(d.pixel(b, i, n), d.masks[3])
+		}
+		return a
+	case color.GrayModel:
+		g := image.NewGray(r)
+		for i := range g.Pix {
+			g.Pix[i] = bitfield(d.pixel(b, i, n), d.masks[0])
+		}
+		return g
+	}
+
+	m := image.NewNRGBA(r)
+	for i := 0; i < w*h; i++ {
+		v := d.pixel(b, i, n)
+		c := m.Pix[i*4 : i*4+4]
+		c[0] = bitfield(v, d.masks[0])
+		c[1] = bitfield(v, d.masks[1])
+		c[2] = bitfield(v, d.masks[2])
+		c[3] = 0xff
+		if d.masks[3] != 0 {
+			c[3] = bitfield(v, d.masks[3])
+		}
+		if d.luminance {
+			c[1], c[2] = c[0], c[0]
+		}
+	}
+	return m
+}
+
+func (d *decoder) pixel(b []byte, i, n int) uint32 {
+	var v uint32
+	for k := n - 1; k >= 0; k-- {
+		v = v<<8 | uint32(b[i*n+k])
+	}
+	return v
+}
+
+// bitfield extracts the channel selected by the mask scaled to 8 bits
+func bitfield(v, mask uint32) uint8 {
+	if mask == 0 {
+		return 0
+	}
+	s := uint(bits.TrailingZeros32(mask))
+	n := uint(bits.OnesCount32(mask))
+	x := (v & mask) >> s
+	if n >= 8 {
+		return uint8(x >> (n - 8))
+	}
+
+	// replicate the bits to fill the byte
+	x <<= 8 - n
+	for k := n; k < 8; k *= 2 {
+		x |= x >> k
+	}
+	return uint8(x)
+}
+
+func init() {
+	image.RegisterFormat("dds", ddsHeader, Decode, DecodeConfig)
+}
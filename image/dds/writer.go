@@ -0,0 +1,242 @@
+package dds
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+type Options struct {
+	Format int
+	DX10   bool
+}
+
+type encoder struct {
+	w      *bufio.Writer
+	f      *File
+	format int
+	dx10   bool
+	buf    []byte
+}
+
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	if o == nil {
+		o = &Options{}
+	}
+	return EncodeFile(w, &File{
+		Format: o.Format,
+		DX10:   o.DX10,
+		Images: [][]image.Image{{m}},
+	})
+}
+
+// EncodeFile writes all the surfaces of the file, every slice must have
+// the same number of mip levels with each level half the size of the last
+func EncodeFile(w io.Writer, f *File) error {
+	e := &encoder{
+		w:      bufio.NewWriter(w),
+		f:      f,
+		format: f.Format,
+		dx10:   f.DX10,
+	}
+	switch e.format {
+	case FORMAT_RGBA, FORMAT_BC1, FORMAT_BC2, FORMAT_BC3, FORMAT_BC4, FORMAT_BC5:
+	default:
+		return fmt.Errorf("dds: unsupported encoding format %d", e.format)
+	}
+
+	err := e.check()
+	if err != nil {
+		return err
+	}
+
+	e.writeHeader()
+	for _, s := range f.Images {
+		for _, m := range s {
+			e.writeSurface(m)
+		}
+	}
+
+	err = e.w.Flush()
+	if err != nil {
+		return fmt.Errorf("dds: %v", err)
+	}
+	return nil
+}
+
+func (e *encoder) check() error {
+	f := e.f
+	if len(f.Images) == 0 || len(f.Images[0]) == 0 {
+		return errors.New("dds: no images to encode")
+	}
+
+	faces := 1
+	if f.Cubemap {
+		faces = 6
+	}
+	if len(f.Images)%faces != 0 {
+		return fmt.Errorf("dds: cube map has %d faces", len(f.Images))
+	}
+	if len(f.Images) > faces {
+		e.dx10 = true
+	}
+
+	r := f.Images[0][0].Bounds()
+	if r.Dx() < 1 || r.Dy() < 1 || r.Dx() > 1<<16 || r.Dy() > 1<<16 {
+		return fmt.Errorf("dds: invalid dimension %dx%d", r.Dx(), r.Dy())
+	}
+	for i, s := range f.Images {
+		if len(s) != len(f.Images[0]) {
+			return fmt.Errorf("dds: slice %d has %d mip levels, expected %d", i, len(s), len(f.Images[0]))
+		}
+		for l, m := range s {
+			b := m.Bounds()
+			if b.Dx() != mipSize(r.Dx(), l) || b.Dy() != mipSize(r.Dy(), l) {
+				return fmt.Errorf("dds: slice %d level %d has invalid dimension %dx%d", i, l, b.Dx(), b.Dy())
+			}
+		}
+	}
+	return nil
+}
+
+func (e *encoder) writeHeader() {
+	f := e.f
+	r := f.Images[0][0].Bounds()
+	mips := len(f.Images[0])
+
+	h := header{
+		Size:   124,
+		Flags:  ddsdCaps | ddsdHeight | ddsdWidth | ddsdPixelFormat,
+		Height: uint32(r.Dy()),
+		Width:  uint32(r.Dx()),
+	}
+	copy(h.Magic[:], ddsHeader)
+	h.Caps[0] = ddscapsTexture
+	if mips > 1 {
+		h.Flags |= ddsdMipMapCount
+		h.MipMapCount = uint32(mips)
+		h.Caps[0] |= ddscapsComplex | ddscapsMipMap
+	}
+	if f.Cubemap {
+		h.Caps[0] |= ddscapsComplex
+		h.Caps[1] = ddscaps2Cubemap | ddscaps2Faces
+	}
+
+	if e.format == FORMAT_RGBA {
+		h.Flags |= ddsdPitch
+		h.PitchOrLinearSize = uint32(r.Dx() * 4)
+	} else {
+		h.Flags |= ddsdLinearSize
+		h.PitchOrLinearSize = uint32((r.Dx() + 3) / 4 * ((r.Dy() + 3) / 4) * blockSize(e.format))
+	}
+
+	pf := &h.PixelFormat
+	pf.Size = 32
+	if e.dx10 {
+		pf.Flags = ddpfFourCC
+		copy(pf.FourCC[:], "DX10")
+	} else if e.format == FORMAT_RGBA {
+		pf.Flags = ddpfRGB | ddpfAlphaPixels
+		pf.RGBBitCount = 32
+		pf.Masks = [4]uint32{0xff0000, 0xff00, 0xff, 0xff000000}
+	} else {
+		pf.Flags = ddpfFourCC
+		fourcc := map[int]string{
+			FORMAT_BC1: "DXT1",
+			FORMAT_BC2: "DXT3",
+			FORMAT_BC3: "DXT5",
+			FORMAT_BC4: "ATI1",
+			FORMAT_BC5: "ATI2",
+		}
+		copy(pf.FourCC[:], fourcc[e.format])
+	}
+	binary.Write(e.w, binary.LittleEndian, &h)
+
+	if e.dx10 {
+		x := headerDX10{
+			ResourceDimension: dxgiTexture2D,
+			ArraySize:         uint32(len(f.Images)),
+		}
+		if f.Cubemap {
+			x.MiscFlag = dxgiMiscTextureCube
+			x.ArraySize /= 6
+		}
+		x.Format = map[int]uint32{
+			FORMAT_RGBA: dxgiB8G8R8A8,
+			FORMAT_BC1:  dxgiBC1,
+			FORMAT_BC2:  dxgiBC2,
+			FORMAT_BC3:  dxgiBC3,
+			FORMAT_BC4:  dxgiBC4,
+			FORMAT_BC5:  dxgiBC5,
+		}[e.format]
+		binary.Write(e.w, binary.LittleEndian, &x)
+	}
+}
+
+func (e *encoder) writeSurface(m image.Image) {
+	r := m.Bounds()
+	if e.format == FORMAT_RGBA {
+		b := e.grow(r.Dx() * 4)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				c := nrgbaAt(m, x, y)
+				i := (x - r.Min.X) * 4
+				b[i], b[i+1], b[i+2], b[i+3] = c.B, c.G, c.R, c.A
+			}
+			e.w.Write(b)
+		}
+		return
+	}
+
+	var blk block
+	b := e.grow(blockSize(e.format))
+	for by := r.Min.Y; by < r.Max.Y; by += 4 {
+		for bx := r.Min.X; bx < r.Max.X; bx += 4 {
+			// edge blocks repeat the last row and column
+			for y := 0; y < 4; y++ {
+				for x := 0; x < 4; x++ {
+					px, py := bx+x, by+y
+					if px >= r.Max.X {
+						px = r.Max.X - 1
+					}
+					if py >= r.Max.Y {
+						py = r.Max.Y - 1
+					}
+					blk[y*4+x] = nrgbaAt(m, px, py)
+				}
+			}
+
+			switch e.format {
+			case FORMAT_BC1:
+				encodeBC1(b, &blk)
+			case FORMAT_BC2:
+				encodeBC2(b, &blk)
+			case FORMAT_BC3:
+				encodeBC3(b, &blk)
+			case FORMAT_BC4:
+				encodeBC4(b, &blk)
+			case FORMAT_BC5:
+				encodeBC5(b, &blk)
+			}
+			e.w.Write(b)
+		}
+	}
+}
+
+func (e *encoder) grow(n int) []byte {
+	if cap(e.buf) < n {
+		e.buf = make([]byte, n)
+	}
+	return e.buf[:n]
+}
+
+func nrgbaAt(m image.Image, x, y int) color.NRGBA {
+	if n, ok := m.(*image.NRGBA); ok {
+		return n.NRGBAAt(x, y)
+	}
+	return color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+}
@@ -0,0 +1,192 @@
+package filter
+
+import (
+	"image"
+	"math"
+
+	"github.com/qeedquan/go-media/image/internal/parallel"
+)
+
+// BoxBlur averages every pixel with its neighbors within radius, the
+// sums are updated as the window slides so the cost does not depend
+// on the radius
+func BoxBlur(m image.Image, radius int, o *Options) image.Image {
+	o = options(o)
+	p := load(m)
+	p.boxBlur([]int{radius}, o)
+	return p.store(m)
+}
+
+// GaussianBlur blurs the image with a gaussian of the standard deviation
+// sigma, large sigmas are approximated with three box blurs
+func GaussianBlur(m image.Image, sigma float64, o *Options) image.Image {
+	o = options(o)
+	p := load(m)
+	p.gaussianBlur(sigma, o)
+	return p.store(m)
+}
+
+// UnsharpMask sharpens the image by adding amount times the difference
+// from its gaussian blur, differences up to threshold are left alone so
+// noise is not amplified, the threshold is a fraction of full intensity
+// and the alpha of color images is kept as is
+func UnsharpMask(m image.Image, sigma, amount, threshold float64, o *Options) image.Image {
+	o = options(o)
+	p := load(m)
+	b := load(m)
+	b.gaussianBlur(sigma, o)
+
+	t := float32(threshold) * one(m)
+	n := len(p.c)
+	if n == 4 {
+		n = 3
+	}
+	for i := 0; i < n; i++ {
+		c, bc := p.c[i], b.c[i]
+		for j, v := range c {
+			d := v - bc[j]
+			if d > t || d < -t {
+				c[j] = v + float32(amount)*d
+			}
+		}
+	}
+	return p.store(m)
+}
+
+func (p *planes) gaussianBlur(sigma float64, o *Options) {
+	if sigma <= 0 {
+		return
+	}
+	if sigma <= 3 {
+		k := GaussianKernel(sigma)
+		p.convolve(k, k, o)
+		return
+	}
+
+	// the passes are run on a canvas padded by their combined radius
+	// so the borders match a single convolution of the image
+	radii := boxesForGauss(sigma, 3)
+	pad := 0
+	for _, r := range radii {
+		pad += r
+	}
+	q := p.pad(pad, o.Border)
+	q.boxBlur(radii, o)
+	for i, c := range q.c {
+		for y := 0; y < p.h; y++ {
+			copy(p.c[i][y*p.w:(y+1)*p.w], c[(y+pad)*q.w+pad:])
+		}
+	}
+}
+
+// pad returns the planes extended by n pixels on every side
+func (p *planes) pad(n, border int) *planes {
+	q := newPlanes(p.w+2*n, p.h+2*n, len(p.c))
+	for i, c := range q.c {
+		for y := 0; y < q.h; y++ {
+			sy, oky := edge(y-n, p.h, border)
+			for x := 0; x < q.w; x++ {
+				sx, okx := edge(x-n, p.w, border)
+				if oky && okx {
+					c[y*q.w+x] = p.c[i][sy*p.w+sx]
+				}
+			}
+		}
+	}
+	return q
+}
+
+// boxesForGauss returns the radii of n box blurs with a
+// combined variance close to that of the gaussian
+func boxesForGauss(sigma float64, n int) []int {
+	ideal := math.Sqrt(12*sigma*sigma/float64(n) + 1)
+	wl := int(ideal)
+	if wl%2 == 0 {
+		wl--
+	}
+	wu := wl + 2
+
+	fl := float64(wl)
+	mIdeal := (12*sigma*sigma - float64(n)*fl*fl - 4*float64(n)*fl - 3*float64(n)) / (-4*fl - 4)
+	k := int(math.Floor(mIdeal + .5))
+
+	radii := make([]int, n)
+	for i := range radii {
+		if i < k {
+			radii[i] = (wl - 1) / 2
+		} else {
+			radii[i] = (wu - 1) / 2
+		}
+	}
+	return radii
+}
+
+func (p *planes) boxBlur(radii []int, o *Options) {
+	for _, c := range p.c {
+		tmp := make([]float32, len(c))
+		for _, r := range radii {
+			if r <= 0 {
+				continue
+			}
+			boxRows(tmp, c, p.w, p.h, r, o)
+			boxCols(c, tmp, p.w, p.h, r, o)
+		}
+	}
+}
+
+func boxRows(dst, src []float32, w, h, r int, o *Options) {
+	scale := 1 / float64(2*r+1)
+	parallel.For(h, o.Workers, func(lo, hi int) {
+		row := make([]float32, w+2*r+1)
+		for y := lo; y < hi; y++ {
+			s := src[y*w : y*w+w]
+			for x := range row {
+				row[x] = 0
+				if i, ok := edge(x-r, w, o.Border); ok {
+					row[x] = s[i]
+				}
+			}
+
+			var sum float64
+			for _, v := range row[:2*r+1] {
+				sum += float64(v)
+			}
+			d := dst[y*w : y*w+w]
+			for x := range d {
+				d[x] = float32(sum * scale)
+				sum += float64(row[x+2*r+1]) - float64(row[x])
+			}
+		}
+	})
+}
+
+// boxCols splits the columns between the workers and slides
+// a window down every column of the range at once
+func boxCols(dst, src []float32, w, h, r int, o *Options) {
+	scale := 1 / float64(2*r+1)
+	parallel.For(w, o.Workers, func(lo, hi int) {
+		sum := make([]float64, hi-lo)
+		add := func(y int, k float64) {
+			sy, ok := edge(y, h, o.Border)
+			if !ok {
+				return
+			}
+			s := src[sy*w+lo : sy*w+hi]
+			for x, v := range s {
+				sum[x] += k * float64(v)
+			}
+		}
+
+		for y := -r; y <= r; y++ {
+			add(y, 1)
+		}
+		for y := 0; y < h; y++ {
+			d := dst[y*w+lo : y*w+hi]
+			for x, v := range sum {
+				d[x] = float32(v * scale)
+			}
+			add(y+r+1, 1)
+			add(y-r, -1)
+		}
+	})
+}
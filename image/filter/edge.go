@@ -0,0 +1,47 @@
+package filter
+
+import (
+	"image"
+	"math"
+)
+
+// Sobel returns the gradient magnitude of every channel found with the
+// sobel operator, a step of full intensity gives a magnitude of full
+// intensity and color images are returned opaque
+func Sobel(m image.Image, o *Options) image.Image {
+	return gradient(m, []float64{1. / 4, 2. / 4, 1. / 4}, o)
+}
+
+// Scharr is like Sobel with the scharr operator,
+// it is closer to rotation invariant
+func Scharr(m image.Image, o *Options) image.Image {
+	return gradient(m, []float64{3. / 16, 10. / 16, 3. / 16}, o)
+}
+
+func gradient(m image.Image, smooth []float64, o *Options) image.Image {
+	o = options(o)
+	p := load(m)
+	diff := []float64{-1, 0, 1}
+
+	n := len(p.c)
+	if n == 4 {
+		n = 3
+		for i := range p.c[3] {
+			p.c[3][i] = one(m)
+		}
+	}
+
+	tmp := make([]float32, p.w*p.h)
+	gx := make([]float32, p.w*p.h)
+	gy := make([]float32, p.w*p.h)
+	for _, c := range p.c[:n] {
+		convolveRows(tmp, c, p.w, p.h, diff, o)
+		convolveCols(gx, tmp, p.w, p.h, smooth, o)
+		convolveRows(tmp, c, p.w, p.h, smooth, o)
+		convolveCols(gy, tmp, p.w, p.h, diff, o)
+		for i := range c {
+			c[i] = float32(math.Hypot(float64(gx[i]), float64(gy[i])))
+		}
+	}
+	return p.store(m)
+}
@@ -0,0 +1,299 @@
+package filter
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/qeedquan/go-media/image/floatimage"
+	"github.com/qeedquan/go-media/image/internal/parallel"
+	"github.com/qeedquan/go-media/image/resampler"
+)
+
+type Options struct {
+	// Border is one of the resampler.BOUNDARY_* constants for how
+	// pixels past the edges are sampled, the zero value is
+	// resampler.BOUNDARY_WRAP and resampler.BOUNDARY_TRANSPARENT
+	// makes them transparent black, nil options clamp
+	Border int
+
+	// Workers is the number of goroutines used, zero uses GOMAXPROCS
+	Workers int
+}
+
+// planes holds the channels of an image as floats, *image.Gray has one
+// channel and the color images have four with premultiplied alpha
+type planes struct {
+	w, h int
+	c    [][]float32
+}
+
+func newPlanes(w, h, nc int) *planes {
+	p := &planes{w: w, h: h, c: make([][]float32, nc)}
+	for i := range p.c {
+		p.c[i] = make([]float32, w*h)
+	}
+	return p
+}
+
+// load reads the image into planes, the 8 bit images keep their
+// range of [0, 255] and images other than *image.Gray and
+// *floatimage.RGBA are read as *image.RGBA
+func load(m image.Image) *planes {
+	r := m.Bounds()
+	w, h := r.Dx(), r.Dy()
+	switch m := m.(type) {
+	case *image.Gray:
+		p := newPlanes(w, h, 1)
+		for y := 0; y < h; y++ {
+			s := m.Pix[y*m.Stride:]
+			d := p.c[0][y*w:]
+			for x := 0; x < w; x++ {
+				d[x] = float32(s[x])
+			}
+		}
+		return p
+
+	case *floatimage.RGBA:
+		p := newPlanes(w, h, 4)
+		for y := 0; y < h; y++ {
+			s := m.Pix[y*m.Stride:]
+			for x := 0; x < w; x++ {
+				a := s[x*4+3]
+				p.c[0][y*w+x] = s[x*4] * a
+				p.c[1][y*w+x] = s[x*4+1] * a
+				p.c[2][y*w+x] = s[x*4+2] * a
+				p.c[3][y*w+x] = a
+			}
+		}
+		return p
+	}
+
+	n, ok := m.(*image.RGBA)
+	if !ok {
+		n = image.NewRGBA(r)
+		draw.Draw(n, r, m, r.Min, draw.Src)
+	}
+	p := newPlanes(w, h, 4)
+	for y := 0; y < h; y++ {
+		s := n.Pix[y*n.Stride:]
+		for x := 0; x < w; x++ {
+			for i := range p.c {
+				p.c[i][y*w+x] = float32(s[x*4+i])
+			}
+		}
+	}
+	return p
+}
+
+// store writes the planes to an image of the same type as m,
+// 8 bit colors are clamped to their alpha
+func (p *planes) store(m image.Image) image.Image {
+	r := m.Bounds()
+	w, h := p.w, p.h
+	switch m.(type) {
+	case *image.Gray:
+		n := image.NewGray(r)
+		for y := 0; y < h; y++ {
+			d := n.Pix[y*n.Stride:]
+			for x := 0; x < w; x++ {
+				d[x] = clamp8(p.c[0][y*w+x], 255)
+			}
+		}
+		return n
+
+	case *floatimage.RGBA:
+		n := floatimage.NewRGBA(r)
+		for y := 0; y < h; y++ {
+			d := n.Pix[y*n.Stride:]
+			for x := 0; x < w; x++ {
+				a := p.c[3][y*w+x]
+				if a <= 0 {
+					continue
+				}
+				d[x*4] = p.c[0][y*w+x] / a
+				d[x*4+1] = p.c[1][y*w+x] / a
+				d[x*4+2] = p.c[2][y*w+x] / a
+				d[x*4+3] = a
+			}
+		}
+		return n
+	}
+
+	n := image.NewRGBA(r)
+	for y := 0; y < h; y++ {
+		d := n.Pix[y*n.Stride:]
+		for x := 0; x < w; x++ {
+			a := clamp8(p.c[3][y*w+x], 255)
+			d[x*4] = clamp8(p.c[0][y*w+x], a)
+			d[x*4+1] = clamp8(p.c[1][y*w+x], a)
+			d[x*4+2] = clamp8(p.c[2][y*w+x], a)
+			d[x*4+3] = a
+		}
+	}
+	return n
+}
+
+func clamp8(v float32, max uint8) uint8 {
+	if v <= 0 || v != v {
+		return 0
+	}
+	if v >= float32(max) {
+		return max
+	}
+	return uint8(v + .5)
+}
+
+// one is the value of full intensity for the channels of the planes
+func one(m image.Image) float32 {
+	if _, ok := m.(*floatimage.RGBA); ok {
+		return 1
+	}
+	return 255
+}
+
+func options(o *Options) *Options {
+	if o == nil {
+		return &Options{Border: resampler.BOUNDARY_CLAMP}
+	}
+	return o
+}
+
+// edge maps a coordinate past the edges back into [0, n),
+// it returns false for resampler.BOUNDARY_TRANSPARENT
+func edge(x, n, border int) (int, bool) {
+	if x >= 0 && x < n {
+		return x, true
+	}
+	switch border {
+	case resampler.BOUNDARY_TRANSPARENT:
+		return 0, false
+	case resampler.BOUNDARY_WRAP:
+		x %= n
+		if x < 0 {
+			x += n
+		}
+	case resampler.BOUNDARY_REFLECT:
+		x %= 2 * n
+		if x < 0 {
+			x += 2 * n
+		}
+		if x >= n {
+			x = 2*n - 1 - x
+		}
+	default:
+		if x < 0 {
+			x = 0
+		} else {
+			x = n - 1
+		}
+	}
+	return x, true
+}
+
+// Kernel samples a resampler filter at integer offsets with the filter
+// stretched by scale, the kernel is normalized to a sum of one
+func Kernel(f resampler.Filter, scale float64) []float64 {
+	r := int(math.Ceil(f.Support*scale - 1e-9))
+	if r < 0 {
+		r = 0
+	}
+	k := make([]float64, 2*r+1)
+	for i := range k {
+		k[i] = f.Sample(float64(i-r) / scale)
+	}
+	return normalize(k)
+}
+
+// GaussianKernel returns a kernel of radius 3*sigma
+func GaussianKernel(sigma float64) []float64 {
+	r := int(math.Ceil(3 * sigma))
+	k := make([]float64, 2*r+1)
+	for i := range k {
+		x := float64(i - r)
+		k[i] = math.Exp(-x * x / (2 * sigma * sigma))
+	}
+	return normalize(k)
+}
+
+func normalize(k []float64) []float64 {
+	var s float64
+	for _, v := range k {
+		s += v
+	}
+	if s != 0 {
+		for i := range k {
+			k[i] /= s
+		}
+	}
+	return k
+}
+
+// Convolve filters the image with the kernel kx along the rows and ky
+// along the columns, the kernels have odd lengths and are centered,
+// the result has the type of m for *image.Gray and *floatimage.RGBA
+// and is an *image.RGBA otherwise
+func Convolve(m image.Image, kx, ky []float64, o *Options) image.Image {
+	o = options(o)
+	p := load(m)
+	p.convolve(kx, ky, o)
+	return p.store(m)
+}
+
+func (p *planes) convolve(kx, ky []float64, o *Options) {
+	for _, c := range p.c {
+		tmp := make([]float32, len(c))
+		convolveRows(tmp, c, p.w, p.h, kx, o)
+		convolveCols(c, tmp, p.w, p.h, ky, o)
+	}
+}
+
+func convolveRows(dst, src []float32, w, h int, k []float64, o *Options) {
+	r := len(k) / 2
+	parallel.For(h, o.Workers, func(lo, hi int) {
+		row := make([]float32, w+2*r)
+		for y := lo; y < hi; y++ {
+			s := src[y*w : y*w+w]
+			for x := range row {
+				row[x] = 0
+				if i, ok := edge(x-r, w, o.Border); ok {
+					row[x] = s[i]
+				}
+			}
+			d := dst[y*w : y*w+w]
+			for x := range d {
+				var v float64
+				for i, kv := range k {
+					v += kv * float64(row[x+i])
+				}
+				d[x] = float32(v)
+			}
+		}
+	})
+}
+
+func convolveCols(dst, src []float32, w, h int, k []float64, o *Options) {
+	r := len(k) / 2
+	parallel.For(h, o.Workers, func(lo, hi int) {
+		acc := make([]float64, w)
+		for y := lo; y < hi; y++ {
+			for x := range acc {
+				acc[x] = 0
+			}
+			for i, kv := range k {
+				sy, ok := edge(y+i-r, h, o.Border)
+				if !ok || kv == 0 {
+					continue
+				}
+				s := src[sy*w : sy*w+w]
+				for x, v := range s {
+					acc[x] += kv * float64(v)
+				}
+			}
+			d := dst[y*w : y*w+w]
+			for x, v := range acc {
+				d[x] = float32(v)
+			}
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package filter
+
+import (
+	"image"
+
+	"github.com/qeedquan/go-media/image/internal/parallel"
+)
+
+// Dilate replaces every pixel with the maximum of each channel in the
+// square of the radius around it, dilating the alpha of a sprite and
+// subtracting the original gives an outline
+func Dilate(m image.Image, radius int, o *Options) image.Image {
+	return morph(m, radius, o, func(a, b float32) bool { return a > b })
+}
+
+// Erode replaces every pixel with the minimum of each
+// channel in the square of the radius around it
+func Erode(m image.Image, radius int, o *Options) image.Image {
+	return morph(m, radius, o, func(a, b float32) bool { return a < b })
+}
+
+// morph applies the square window as a row and a column pass,
+// samples past the edges are zero for resampler.BOUNDARY_TRANSPARENT
+func morph(m image.Image, radius int, o *Options, better func(a, b float32) bool) image.Image {
+	o = options(o)
+	p := load(m)
+	if radius <= 0 {
+		return p.store(m)
+	}
+
+	w, h := p.w, p.h
+	for _, c := range p.c {
+		tmp := make([]float32, len(c))
+		parallel.For(h, o.Workers, func(lo, hi int) {
+			for y := lo; y < hi; y++ {
+				s := c[y*w : y*w+w]
+				for x := 0; x < w; x++ {
+					var v float32
+					for i := -radius; i <= radius; i++ {
+						var u float32
+						if sx, ok := edge(x+i, w, o.Border); ok {
+							u = s[sx]
+						}
+						if i == -radius || better(u, v) {
+							v = u
+						}
+					}
+					tmp[y*w+x] = v
+				}
+			}
+		})
+		parallel.For(h, o.Workers, func(lo, hi int) {
+			for y := lo; y < hi; y++ {
+				d := c[y*w : y*w+w]
+				for i := -radius; i <= radius; i++ {
+					sy, ok := edge(y+i, h, o.Border)
+					for x := range d {
+						var u float32
+						if ok {
+							u = tmp[sy*w+x]
+						}
+						if i == -radius || better(u, d[x]) {
+							d[x] = u
+						}
+					}
+				}
+			}
+		})
+	}
+	return p.store(m)
+}
+
+// Median replaces every pixel with the median of each
+// channel in the square of the radius around it
+func Median(m image.Image, radius int, o *Options) image.Image {
+	o = options(o)
+	p := load(m)
+	if radius <= 0 {
+		return p.store(m)
+	}
+
+	w, h := p.w, p.h
+	for _, c := range p.c {
+		src := append([]float32(nil), c...)
+		parallel.For(h, o.Workers, func(lo, hi int) {
+			win := make([]float32, 0, (2*radius+1)*(2*radius+1))
+			for y := lo; y < hi; y++ {
+				for x := 0; x < w; x++ {
+					win = win[:0]
+					for j := -radius; j <= radius; j++ {
+						sy, oky := edge(y+j, h, o.Border)
+						for i := -radius; i <= radius; i++ {
+							sx, okx := edge(x+i, w, o.Border)
+							if oky && okx {
+								win = append(win, src[sy*w+sx])
+							} else {
+								win = append(win, 0)
+							}
+						}
+					}
+					c[y*w+x] = selectNth(win, len(win)/2)
+				}
+			}
+		})
+	}
+	return p.store(m)
+}
+
+// selectNth returns the nth smallest value, the slice is reordered
+func selectNth(v []float32, n int) float32 {
+	lo, hi := 0, len(v)-1
+	for lo < hi {
+		pivot := v[(lo+hi)/2]
+		i, j := lo, hi
+		for i <= j {
+			for v[i] < pivot {
+				i++
+			}
+			for v[j] > pivot {
+				j--
+			}
+			if i <= j {
+				v[i], v[j] = v[j], v[i]
+				i++
+				j--
+			}
+		}
+		switch {
+		case n <= j:
+			hi = j
+		case n >= i:
+			lo = i
+		default:
+			return v[n]
+		}
+	}
+	return v[n]
+}
@@ -0,0 +1,215 @@
+package floatimage
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/qeedquan/go-media/image/chroma"
+)
+
+var (
+	// FloatModel converts colors to linear light Color values
+	FloatModel = color.ModelFunc(floatModel)
+)
+
+// Color is a linear light color with straight alpha,
+// the color channels are not limited to [0, 1]
+type Color struct {
+	R, G, B, A float32
+}
+
+// RGBA returns the color clamped to [0, 1] and
+// encoded with the sRGB transfer curve
+func (c Color) RGBA() (r, g, b, a uint32) {
+	a = uint32(clamp(c.A)*0xffff + .5)
+	r = uint32(LinearToSRGB(clamp(c.R))*float32(a) + .5)
+	g = uint32(LinearToSRGB(clamp(c.G))*float32(a) + .5)
+	b = uint32(LinearToSRGB(clamp(c.B))*float32(a) + .5)
+	return
+}
+
+func floatModel(c color.Color) color.Color {
+	if _, ok := c.(Color); ok {
+		return c
+	}
+
+	r, g, b, a := c.RGBA()
+	if a == 0 {
+		return Color{}
+	}
+
+	fa := float32(a)
+	return Color{
+		SRGBToLinear(float32(r) / fa),
+		SRGBToLinear(float32(g) / fa),
+		SRGBToLinear(float32(b) / fa),
+		fa / 0xffff,
+	}
+}
+
+// RGBA is an in-memory high dynamic range image, samples are
+// stored in linear light with straight alpha; At returns
+// tone-mapped color.NRGBA64 values so the color model is
+// color.NRGBA64Model and the raw values are available through FloatAt
+type RGBA struct {
+	// Pix holds the image's pixels, in R, G, B, A order
+	Pix    []float32
+	Stride int
+	Rect   image.Rectangle
+
+	// Exposure is in stops and is applied before the gamma curve,
+	// a Gamma of zero uses the sRGB transfer curve
+	Exposure float32
+	Gamma    float32
+}
+
+func NewRGBA(r image.Rectangle) *RGBA {
+	w, h := r.Dx(), r.Dy()
+	return &RGBA{
+		Pix:    make([]float32, 4*w*h),
+		Stride: 4 * w,
+		Rect:   r,
+	}
+}
+
+func (p *RGBA) ColorModel() color.Model { return color.NRGBA64Model }
+
+func (p *RGBA) Bounds() image.Rectangle { return p.Rect }
+
+func (p *RGBA) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return color.NRGBA64{}
+	}
+	i := p.PixOffset(x, y)
+	s := p.Pix[i : i+4 : i+4]
+	return color.NRGBA64{
+		p.ToneMap(s[0]),
+		p.ToneMap(s[1]),
+		p.ToneMap(s[2]),
+		uint16(clamp(s[3])*0xffff + .5),
+	}
+}
+
+func (p *RGBA) FloatAt(x, y int) Color {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return Color{}
+	}
+	i := p.PixOffset(x, y)
+	s := p.Pix[i : i+4 : i+4]
+	return Color{s[0], s[1], s[2], s[3]}
+}
+
+func (p *RGBA) PixOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.Stride + (x-p.Rect.Min.X)*4
+}
+
+// Set stores the color converted with FloatModel, it is not the
+// inverse of At since that applies the exposure and gamma
+func (p *RGBA) Set(x, y int, c color.Color) {
+	p.SetFloat(x, y, FloatModel.Convert(c).(Color))
+}
+
+func (p *RGBA) SetFloat(x, y int, c Color) {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return
+	}
+	i := p.PixOffset(x, y)
+	s := p.Pix[i : i+4 : i+4]
+	s[0], s[1], s[2], s[3] = c.R, c.G, c.B, c.A
+}
+
+// ToneMap maps a linear value into a 16 bit display value
+// using the exposure and gamma of the image
+func (p *RGBA) ToneMap(v float32) uint16 {
+	if p.Exposure != 0 {
+		v *= float32(math.Exp2(float64(p.Exposure)))
+	}
+	v = clamp(v)
+	if p.Gamma == 0 {
+		v = LinearToSRGB(v)
+	} else if p.Gamma != 1 {
+		v = float32(math.Pow(float64(v), 1/float64(p.Gamma)))
+	}
+	return uint16(v*0xffff + .5)
+}
+
+// AverageLuminance returns the geometric mean of the luminance,
+// it is the usual measure of the brightness of a scene
+func (p *RGBA) AverageLuminance() float32 {
+	var (
+		sum float64
+		n   int
+	)
+	r := p.Rect
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		i := p.PixOffset(r.Min.X, y)
+		for x := 0; x < r.Dx(); x++ {
+			s := p.Pix[i+x*4 : i+x*4+3]
+			l := 0.2126*float64(s[0]) + 0.7152*float64(s[1]) + 0.0722*float64(s[2])
+			sum += math.Log(1e-4 + math.Max(l, 0))
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return float32(math.Exp(sum / float64(n)))
+}
+
+// AutoExposure sets the exposure so the average luminance
+// maps to key, 0.18 is the traditional middle gray
+func (p *RGBA) AutoExposure(key float32) {
+	l := p.AverageLuminance()
+	if l > 0 {
+		p.Exposure = float32(math.Log2(float64(key / l)))
+	}
+}
+
+func (p *RGBA) SubImage(r image.Rectangle) image.Image {
+	r = r.Intersect(p.Rect)
+	if r.Empty() {
+		return &RGBA{Exposure: p.Exposure, Gamma: p.Gamma}
+	}
+	i := p.PixOffset(r.Min.X, r.Min.Y)
+	return &RGBA{
+		Pix:      p.Pix[i:],
+		Stride:   p.Stride,
+		Rect:     r,
+		Exposure: p.Exposure,
+		Gamma:    p.Gamma,
+	}
+}
+
+func (p *RGBA) Opaque() bool {
+	r := p.Rect
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		i := p.PixOffset(r.Min.X, y)
+		for x := 0; x < r.Dx(); x++ {
+			if p.Pix[i+x*4+3] < 1 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// LinearToSRGB is chroma.Linear2SRGB for float32 values
+func LinearToSRGB(v float32) float32 {
+	return float32(chroma.Linear2SRGB(float64(v)))
+}
+
+// SRGBToLinear is chroma.SRGB2Linear for float32 values
+func SRGBToLinear(v float32) float32 {
+	return float32(chroma.SRGB2Linear(float64(v)))
+}
+
+func clamp(v float32) float32 {
+	if v < 0 || v != v {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
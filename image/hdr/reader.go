@@ -0,0 +1,353 @@
+package hdr
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/qeedquan/go-media/image/floatimage"
+)
+
+const (
+	FORMAT_RGBE = "32-bit_rle_rgbe"
+	FORMAT_XYZE = "32-bit_rle_xyze"
+)
+
+// the decoded image takes 16 bytes per pixel, this bounds
+// the allocation made from the header before any pixel is read
+const maxPixels = 400000000
+
+// Header holds the variables of the information header,
+// the exposure and gamma are informative only and are
+// not applied to the pixels when decoding
+type Header struct {
+	Format   string
+	Exposure float64
+	Gamma    float64
+	Width    int
+	Height   int
+
+	// Orientation is the resolution string, the standard
+	// orientation of top to bottom scanlines is "-Y +X"
+	Orientation string
+}
+
+type decoder struct {
+	r *bufio.Reader
+	Header
+	axes [2]string
+	row  []byte
+}
+
+func Decode(r io.Reader) (image.Image, error) {
+	d := &decoder{r: bufio.NewReader(r)}
+	err := d.decodeHeader()
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeImage()
+}
+
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	h, err := DecodeHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{
+		ColorModel: color.NRGBA64Model,
+		Width:      h.Width,
+		Height:     h.Height,
+	}, nil
+}
+
+func DecodeHeader(r io.Reader) (*Header, error) {
+	d := &decoder{r: bufio.NewReader(r)}
+	err := d.decodeHeader()
+	if err != nil {
+		return nil, err
+	}
+	return &d.Header, nil
+}
+
+func (d *decoder) decodeHeader() error {
+	line, err := d.line()
+	if err != nil {
+		return err
+	}
+	if line != "#?RADIANCE" && line != "#?RGBE" {
+		return errors.New("hdr: invalid signature")
+	}
+
+	d.Format = FORMAT_RGBE
+	d.Exposure = 1
+	d.Gamma = 1
+	for {
+		line, err = d.line()
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// multiple exposures multiply together
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			continue
+		}
+		key, value := line[:i], strings.TrimSpace(line[i+1:])
+		switch key {
+		case "FORMAT":
+			d.Format = value
+		case "EXPOSURE":
+			v, err := strconv.ParseFloat(value, 64)
+			if err == nil {
+				d.Exposure *= v
+			}
+		case "GAMMA":
+			v, err := strconv.ParseFloat(value, 64)
+			if err == nil {
+				d.Gamma = v
+			}
+		}
+	}
+	if d.Format != FORMAT_RGBE && d.Format != FORMAT_XYZE {
+		return fmt.Errorf("hdr: unsupported format %q", d.Format)
+	}
+
+	line, err = d.line()
+	if err != nil {
+		return err
+	}
+	return d.decodeResolution(line)
+}
+
+func (d *decoder) decodeResolution(line string) error {
+	f := strings.Fields(line)
+	if len(f) != 4 {
+		return fmt.Errorf("hdr: invalid resolution string %q", line)
+	}
+
+	var size [2]int
+	for i := range d.axes {
+		axis := f[i*2]
+		if len(axis) != 2 || (axis[0] != '-' && axis[0] != '+') || (axis[1] != 'X' && axis[1] != 'Y') {
+			return fmt.Errorf("hdr: invalid resolution string %q", line)
+		}
+		n, err := strconv.Atoi(f[i*2+1])
+		if err != nil || n < 1 || n > 1<<16 {
+			return fmt.Errorf("hdr: invalid resolution string %q", line)
+		}
+		d.axes[i], size[i] = axis, n
+	}
+	if d.axes[0][1] == d.axes[1][1] {
+		return fmt.Errorf("hdr: invalid resolution string %q", line)
+	}
+	if size[0]*size[1] > maxPixels {
+		return fmt.Errorf("hdr: image too large %dx%d", size[1], size[0])
+	}
+
+	d.Orientation = d.axes[0] + " " + d.axes[1]
+	if d.axes[0][1] == 'Y' {
+		d.Height, d.Width = size[0], size[1]
+	} else {
+		d.Width, d.Height = size[0], size[1]
+	}
+	return nil
+}
+
+func (d *decoder) line() (string, error) {
+	line, err := d.r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("hdr: %v", errUnexpectedEOF(err))
+	}
+	if len(line) > 1024 {
+		return "", errors.New("hdr: header line too long")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (d *decoder) decodeImage() (image.Image, error) {
+	m := floatimage.NewRGBA(image.Rect(0, 0, d.Width, d.Height))
+
+	// scanlines run along the second axis of the resolution string
+	lines, n := d.Height, d.Width
+	if d.axes[0][1] == 'X' {
+		lines, n = d.Width, d.Height
+	}
+	d.row = make([]byte, n*4)
+
+	for i := 0; i < lines; i++ {
+		err := d.decodeScanline(d.row)
+		if err != nil {
+			return nil, fmt.Errorf("hdr: %v", err)
+		}
+
+		for j := 0; j < n; j++ {
+			x, y := d.position(i, j)
+			p := d.row[j*4:]
+			c := rgbe(p[0], p[1], p[2], p[3])
+			if d.Format == FORMAT_XYZE {
+				c = xyz(c)
+			}
+			m.SetFloat(x, y, c)
+		}
+	}
+	return m, nil
+}
+
+// position maps the pixel j of scanline i to the image
+func (d *decoder) position(i, j int) (x, y int) {
+	a, b := d.axes[0], d.axes[1]
+	if a[1] == 'X' {
+		i, j = j, i
+		a, b = b, a
+	}
+	y, x = i, j
+	if a[0] == '+' {
+		y = d.Height - 1 - y
+	}
+	if b[0] == '-' {
+		x = d.Width - 1 - x
+	}
+	return
+}
+
+func (d *decoder) decodeScanline(b []byte) error {
+	n := len(b) / 4
+	if n < 8 || n > 0x7fff {
+		return d.decodeOldScanline(b)
+	}
+
+	p, err := d.r.Peek(4)
+	if err != nil {
+		return errUnexpectedEOF(err)
+	}
+	if p[0] != 2 || p[1] != 2 || p[2]&0x80 != 0 {
+		return d.decodeOldScanline(b)
+	}
+	if int(p[2])<<8|int(p[3]) != n {
+		return errors.New("scanline width mismatch")
+	}
+	d.r.Discard(4)
+
+	// each component is run length encoded separately
+	for c := 0; c < 4; c++ {
+		for i := 0; i < n; {
+			k, err := d.r.ReadByte()
+			if err != nil {
+				return errUnexpectedEOF(err)
+			}
+
+			if k > 128 {
+				k -= 128
+				if i+int(k) > n {
+					return errors.New("run overflows scanline")
+				}
+				v, err := d.r.ReadByte()
+				if err != nil {
+					return errUnexpectedEOF(err)
+				}
+				for ; k > 0; k-- {
+					b[i*4+c] = v
+					i++
+				}
+			} else {
+				if k == 0 || i+int(k) > n {
+					return errors.New("invalid run in scanline")
+				}
+				for ; k > 0; k-- {
+					v, err := d.r.ReadByte()
+					if err != nil {
+						return errUnexpectedEOF(err)
+					}
+					b[i*4+c] = v
+					i++
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// decodeOldScanline reads flat pixels where a pixel of 1, 1, 1
+// repeats the last pixel, consecutive repeats scale the count by 256
+func (d *decoder) decodeOldScanline(b []byte) error {
+	shift := uint(0)
+	for i := 0; i < len(b); {
+		var p [4]byte
+		_, err := io.ReadFull(d.r, p[:])
+		if err != nil {
+			return errUnexpectedEOF(err)
+		}
+
+		if p[0] == 1 && p[1] == 1 && p[2] == 1 {
+			if i == 0 {
+				return errors.New("repeat at start of scanline")
+			}
+			k := int(p[3]) << shift
+			if i+k*4 > len(b) {
+				return errors.New("run overflows scanline")
+			}
+			for ; k > 0; k-- {
+				copy(b[i:i+4], b[i-4:i])
+				i += 4
+			}
+			shift += 8
+			continue
+		}
+
+		copy(b[i:], p[:])
+		i += 4
+		shift = 0
+	}
+	return nil
+}
+
+func rgbe(r, g, b, e uint8) floatimage.Color {
+	if e == 0 {
+		return floatimage.Color{A: 1}
+	}
+	f := float32(math.Ldexp(1, int(e)-(128+8)))
+	return floatimage.Color{
+		(float32(r) + .5) * f,
+		(float32(g) + .5) * f,
+		(float32(b) + .5) * f,
+		1,
+	}
+}
+
+// xyz converts from CIE XYZ to linear sRGB primaries
+func xyz(c floatimage.Color) floatimage.Color {
+	x, y, z := c.R, c.G, c.B
+	return floatimage.Color{
+		3.2404542*x - 1.5371385*y - 0.4985314*z,
+		-0.9692660*x + 1.8760108*y + 0.0415560*z,
+		0.0556434*x - 0.2040259*y + 1.0572252*z,
+		1,
+	}
+}
+
+func errUnexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func init() {
+	image.RegisterFormat("hdr", "#?RADIANCE", Decode, DecodeConfig)
+	image.RegisterFormat("hdr", "#?RGBE", Decode, DecodeConfig)
+}
@@ -0,0 +1,143 @@
+package hdr
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"math"
+
+	"github.com/qeedquan/go-media/image/floatimage"
+)
+
+type Options struct {
+	// Flat writes the scanlines without run length encoding
+	Flat bool
+
+	// Exposure is recorded in the header when it is not zero or one
+	Exposure float64
+}
+
+type encoder struct {
+	w   *bufio.Writer
+	o   *Options
+	row []byte
+}
+
+// Encode writes the image in RGBE, images that are not
+// a *floatimage.RGBA are converted to linear light first
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	if o == nil {
+		o = &Options{}
+	}
+
+	r := m.Bounds()
+	if r.Dx() < 1 || r.Dy() < 1 {
+		return fmt.Errorf("hdr: invalid dimension %dx%d", r.Dx(), r.Dy())
+	}
+
+	e := &encoder{
+		w:   bufio.NewWriter(w),
+		o:   o,
+		row: make([]byte, r.Dx()*4),
+	}
+	fmt.Fprintf(e.w, "#?RADIANCE\nFORMAT=%s\n", FORMAT_RGBE)
+	if o.Exposure != 0 && o.Exposure != 1 {
+		fmt.Fprintf(e.w, "EXPOSURE=%g\n", o.Exposure)
+	}
+	fmt.Fprintf(e.w, "\n-Y %d +X %d\n", r.Dy(), r.Dx())
+
+	f, _ := m.(*floatimage.RGBA)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			var c floatimage.Color
+			if f != nil {
+				c = f.FloatAt(x, y)
+			} else {
+				c = floatimage.FloatModel.Convert(m.At(x, y)).(floatimage.Color)
+			}
+			i := (x - r.Min.X) * 4
+			e.row[i], e.row[i+1], e.row[i+2], e.row[i+3] = toRGBE(c)
+		}
+		e.writeScanline()
+	}
+
+	err := e.w.Flush()
+	if err != nil {
+		return fmt.Errorf("hdr: %v", err)
+	}
+	return nil
+}
+
+func (e *encoder) writeScanline() {
+	b := e.row
+	n := len(b) / 4
+	if e.o.Flat || n < 8 || n > 0x7fff {
+		e.w.Write(b)
+		return
+	}
+
+	e.w.Write([]byte{2, 2, uint8(n >> 8), uint8(n)})
+	for c := 0; c < 4; c++ {
+		e.writeComponent(c, n)
+	}
+}
+
+// writeComponent encodes runs of at least 3 bytes, everything
+// else is written as literals of at most 128 bytes
+func (e *encoder) writeComponent(c, n int) {
+	at := func(i int) byte { return e.row[i*4+c] }
+
+	for i := 0; i < n; {
+		// find the next run
+		j := i
+		k := 0
+		for j < n {
+			k = 1
+			for j+k < n && k < 127 && at(j+k) == at(j) {
+				k++
+			}
+			if k >= 3 {
+				break
+			}
+			j += k
+		}
+		if j >= n {
+			j, k = n, 0
+		}
+
+		for i < j {
+			l := j - i
+			if l > 128 {
+				l = 128
+			}
+			e.w.WriteByte(uint8(l))
+			for ; l > 0; l-- {
+				e.w.WriteByte(at(i))
+				i++
+			}
+		}
+
+		if k > 0 {
+			e.w.WriteByte(uint8(128 + k))
+			e.w.WriteByte(at(j))
+			i = j + k
+		}
+	}
+}
+
+func toRGBE(c floatimage.Color) (r, g, b, e uint8) {
+	v := math.Max(float64(c.R), math.Max(float64(c.G), float64(c.B)))
+	if !(v >= 1e-32) {
+		return
+	}
+	m, x := math.Frexp(v)
+	if x > 127 {
+		return 255, 255, 255, 255
+	}
+	s := m * 256 / v
+	q := func(v float32) uint8 {
+		return uint8(math.Max(0, math.Min(255, float64(v)*s)))
+	}
+	return q(c.R), q(c.G), q(c.B), uint8(x + 128)
+}
@@ -0,0 +1,178 @@
+package ico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math/bits"
+)
+
+// compression types
+const (
+	biRGB       = 0
+	biBitfields = 3
+)
+
+// decodeDIB decodes a device independent bitmap as stored in icons,
+// the height covers both the color bitmap and the AND mask after it
+func decodeDIB(b []byte, e *Entry) (image.Image, error) {
+	var ih bitmapInfoHeader
+	err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &ih)
+	if err != nil {
+		return nil, errors.New("bitmap header too short")
+	}
+	if ih.Size < 40 || int64(ih.Size) > int64(len(b)) {
+		return nil, fmt.Errorf("unsupported bitmap header size %d", ih.Size)
+	}
+
+	w, h := int(ih.Width), int(ih.Height)/2
+	topDown := h < 0
+	if topDown {
+		h = -h
+	}
+	if w < 1 || h < 1 || w > 1024 || h > 1024 {
+		return nil, fmt.Errorf("invalid bitmap dimension %dx%d", w, h)
+	}
+	e.Planes, e.Bpp = int(ih.Planes), int(ih.Bpp)
+
+	off := int(ih.Size)
+	masks := [4]uint32{0x7c00, 0x3e0, 0x1f, 0}
+	switch {
+	case ih.Compression == biBitfields && (ih.Bpp == 16 || ih.Bpp == 32):
+		if off+12 > len(b) {
+			return nil, errors.New("bitmap bitfields truncated")
+		}
+		for i := 0; i < 3; i++ {
+			masks[i] = binary.LittleEndian.Uint32(b[off+i*4:])
+		}
+		// the masks are part of the larger headers
+		if ih.Size == 40 {
+			off += 12
+		}
+	case ih.Compression == biRGB:
+		if ih.Bpp == 32 {
+			masks = [4]uint32{0xff0000, 0xff00, 0xff, 0xff000000}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported bitmap compression %d", ih.Compression)
+	}
+
+	var pal color.Palette
+	switch ih.Bpp {
+	case 1, 4, 8:
+		n := int(ih.ColorsUsed)
+		if n == 0 || n > 1<<ih.Bpp {
+			n = 1 << ih.Bpp
+		}
+		if off+n*4 > len(b) {
+			return nil, errors.New("bitmap palette truncated")
+		}
+		pal = make(color.Palette, 1<<ih.Bpp)
+		for i := range pal {
+			pal[i] = color.NRGBA{A: 0xff}
+		}
+		for i := 0; i < n; i++ {
+			p := b[off+i*4:]
+			pal[i] = color.NRGBA{p[2], p[1], p[0], 0xff}
+		}
+		off += n * 4
+		e.Palette = n
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("unsupported bitmap depth %d", ih.Bpp)
+	}
+
+	stride := (w*int(ih.Bpp) + 31) / 32 * 4
+	mstride := (w + 31) / 32 * 4
+	if off+stride*h > len(b) {
+		return nil, errors.New("bitmap data truncated")
+	}
+	pix := b[off : off+stride*h]
+
+	// some writers leave out the mask for 32 bit images
+	var mask []byte
+	if moff := off + stride*h; moff+mstride*h <= len(b) {
+		mask = b[moff : moff+mstride*h]
+	}
+
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	alpha := false
+	for y := 0; y < h; y++ {
+		sy := h - 1 - y
+		if topDown {
+			sy = y
+		}
+		row := pix[sy*stride:]
+		dst := m.Pix[y*m.Stride:]
+
+		for x := 0; x < w; x++ {
+			var c color.NRGBA
+			switch ih.Bpp {
+			case 1, 4, 8:
+				bit := x * int(ih.Bpp)
+				v := row[bit/8] >> uint(8-int(ih.Bpp)-bit%8) & (1<<ih.Bpp - 1)
+				c = pal[v].(color.NRGBA)
+			case 16:
+				c = bitfields(uint32(binary.LittleEndian.Uint16(row[x*2:])), masks)
+			case 24:
+				c = color.NRGBA{row[x*3+2], row[x*3+1], row[x*3], 0xff}
+			case 32:
+				c = bitfields(binary.LittleEndian.Uint32(row[x*4:]), masks)
+				if c.A != 0 {
+					alpha = true
+				}
+			}
+			dst[x*4] = c.R
+			dst[x*4+1] = c.G
+			dst[x*4+2] = c.B
+			dst[x*4+3] = c.A
+		}
+	}
+
+	// an alpha channel takes precedence over the AND mask,
+	// 32 bit images with all zero alpha are treated as opaque
+	if ih.Bpp == 32 && alpha {
+		return m, nil
+	}
+	for y := 0; y < h; y++ {
+		sy := h - 1 - y
+		if topDown {
+			sy = y
+		}
+		dst := m.Pix[y*m.Stride:]
+		for x := 0; x < w; x++ {
+			dst[x*4+3] = 0xff
+			if mask != nil && mask[sy*mstride+x/8]&(0x80>>uint(x%8)) != 0 {
+				dst[x*4+3] = 0
+			}
+		}
+	}
+	return m, nil
+}
+
+// bitfields extracts a color using the channel masks
+func bitfields(v uint32, masks [4]uint32) color.NRGBA {
+	var c [4]uint8
+	for i, m := range masks {
+		if m == 0 {
+			continue
+		}
+		s := uint(bits.TrailingZeros32(m))
+		n := uint(bits.OnesCount32(m))
+		x := (v & m) >> s
+		if n >= 8 {
+			c[i] = uint8(x >> (n - 8))
+		} else {
+			// replicate the bits to fill the byte
+			x <<= 8 - n
+			for k := n; k < 8; k *= 2 {
+				x |= x >> k
+			}
+			c[i] = uint8(x)
+		}
+	}
+	return color.NRGBA{c[0], c[1], c[2], c[3]}
+}
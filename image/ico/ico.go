@@ -6,16 +6,46 @@ import (
 	"encoding/binary"
 	"fmt"
 	"image"
+	"image/color"
 	"image/png"
 	"io"
 	"io/ioutil"
 	"math"
+)
+
+const pngHeader = "\x89PNG\r\n\x1a\n"
 
-	"golang.org/x/image/bmp"
+// file types
+const (
+	TYPE_ICO = 1
+	TYPE_CUR = 2
 )
 
 type File struct {
+	// Type is TYPE_ICO or TYPE_CUR, zero is written as an icon
+	Type  int
 	Image []image.Image
+
+	// cursor hotspots for each image, missing entries are at the origin
+	Hotspot []image.Point
+
+	// how each image is stored, filled in by Decode
+	Entry []Entry
+}
+
+type Entry struct {
+	Width   int
+	Height  int
+	Palette int
+	Planes  int
+	Bpp     int
+	PNG     bool
+}
+
+type Options struct {
+	// BMP stores the images as 32 bit bitmaps with an AND mask
+	// instead of PNG, older programs can only read bitmaps
+	BMP bool
 }
 
 type header struct {
@@ -35,14 +65,40 @@ type dirent struct {
 	Off     uint32
 }
 
-func Encode(w io.Writer, f *File) error {
+type bitmapInfoHeader struct {
+	Size          uint32
+	Width         int32
+	Height        int32
+	Planes        uint16
+	Bpp           uint16
+	Compression   uint32
+	ImageSize     uint32
+	XPelsPerMeter int32
+	YPelsPerMeter int32
+	ColorsUsed    uint32
+	ColorsImp     uint32
+}
+
+func Encode(w io.Writer, f *File, o *Options) error {
+	if o == nil {
+		o = &Options{}
+	}
 	if len(f.Image) >= math.MaxUint16 {
 		return fmt.Errorf("ico: format cannot support %d images", len(f.Image))
 	}
 
+	typ := f.Type
+	switch typ {
+	case 0:
+		typ = TYPE_ICO
+	case TYPE_ICO, TYPE_CUR:
+	default:
+		return fmt.Errorf("ico: invalid type %d", f.Type)
+	}
+
 	b := bufio.NewWriter(w)
 	h := header{
-		Type:    1,
+		Type:    uint16(typ),
 		Entries: uint16(len(f.Image)),
 	}
 	binary.Write(b, binary.LittleEndian, &h)
@@ -52,41 +108,98 @@ func Encode(w io.Writer, f *File) error {
 		direntLen = 16
 	)
 
-	off := headerLen + direntLen*uint32(h.Entries)
+	var payloads [][]byte
+	off := headerLen + direntLen*int64(h.Entries)
 	for i, m := range f.Image {
-		p := new(bytes.Buffer)
-		err := png.Encode(p, m)
-		if err != nil {
-			return err
+		// a dimension of 0 in the directory means 256
+		r := m.Bounds()
+		if r.Dx() < 1 || r.Dy() < 1 || r.Dx() > 256 || r.Dy() > 256 {
+			return fmt.Errorf("ico: image %d with dimension %dx%d is not supported", i, r.Dx(), r.Dy())
 		}
 
-		if p.Len() >= math.MaxUint32 {
-			return fmt.Errorf("ico: image %d is too big", i)
+		p := new(bytes.Buffer)
+		var err error
+		if o.BMP {
+			err = encodeBMP(p, m)
+		} else {
+			err = png.Encode(p, m)
 		}
-
-		r := m.Bounds()
-		if r.Dx() >= math.MaxUint8 || r.Dy() >= math.MaxUint8 {
-			return fmt.Errorf("ico: image %d with dimension %dx%d is too big", i, r.Dx(), r.Dy())
+		if err != nil {
+			return err
 		}
 
 		d := dirent{
 			Width:  uint8(r.Dx()),
 			Height: uint8(r.Dy()),
+			Planes: 1,
 			Bpp:    32,
 			Size:   uint32(p.Len()),
-			Off:    off,
+			Off:    uint32(off),
+		}
+		if typ == TYPE_CUR {
+			var hs image.Point
+			if i < len(f.Hotspot) {
+				hs = f.Hotspot[i]
+			}
+			if hs.X < 0 || hs.Y < 0 || hs.X > math.MaxUint16 || hs.Y > math.MaxUint16 {
+				return fmt.Errorf("ico: image %d has invalid hotspot %v", i, hs)
+			}
+			d.Planes, d.Bpp = uint16(hs.X), uint16(hs.Y)
 		}
 		binary.Write(b, binary.LittleEndian, &d)
 
-		if int64(off)+int64(p.Len()) >= math.MaxUint32 {
+		off += int64(p.Len())
+		if off > math.MaxUint32 {
 			return fmt.Errorf("ico: too many images")
 		}
-		off += uint32(p.Len())
+		payloads = append(payloads, p.Bytes())
+	}
+
+	for _, p := range payloads {
+		b.Write(p)
 	}
 
 	return b.Flush()
 }
 
+// encodeBMP writes the image as a 32 bit bottom up DIB, the height
+// covers both the color bitmap and the AND mask that follows it
+func encodeBMP(w io.Writer, m image.Image) error {
+	r := m.Bounds()
+	dx, dy := r.Dx(), r.Dy()
+	mstride := (dx + 31) / 32 * 4
+
+	ih := bitmapInfoHeader{
+		Size:      40,
+		Width:     int32(dx),
+		Height:    int32(dy * 2),
+		Planes:    1,
+		Bpp:       32,
+		ImageSize: uint32(dx*dy*4 + mstride*dy),
+	}
+	binary.Write(w, binary.LittleEndian, &ih)
+
+	pix := make([]byte, dx*dy*4)
+	mask := make([]byte, mstride*dy)
+	for y := 0; y < dy; y++ {
+		row := pix[(dy-1-y)*dx*4:]
+		mrow := mask[(dy-1-y)*mstride:]
+		for x := 0; x < dx; x++ {
+			c := color.NRGBAModel.Convert(m.At(r.Min.X+x, r.Min.Y+y)).(color.NRGBA)
+			row[x*4] = c.B
+			row[x*4+1] = c.G
+			row[x*4+2] = c.R
+			row[x*4+3] = c.A
+			if c.A == 0 {
+				mrow[x/8] |= 0x80 >> uint(x%8)
+			}
+		}
+	}
+	w.Write(pix)
+	_, err := w.Write(mask)
+	return err
+}
+
 func Decode(r io.Reader) (*File, error) {
 	buf, err := ioutil.ReadAll(r)
 	if err != nil {
@@ -99,6 +212,9 @@ func Decode(r io.Reader) (*File, error) {
 	if err != nil {
 		return nil, err
 	}
+	if h.Type != TYPE_ICO && h.Type != TYPE_CUR {
+		return nil, fmt.Errorf("ico: invalid type %d", h.Type)
+	}
 
 	d := make([]dirent, h.Entries)
 	for i := range d {
@@ -108,57 +224,62 @@ func Decode(r io.Reader) (*File, error) {
 		}
 	}
 
-	f := &File{}
+	f := &File{Type: int(h.Type)}
 	for i, d := range d {
-		_, err = b.Seek(int64(d.Off), io.SeekStart)
-		if err != nil {
-			return nil, err
+		if int64(d.Off) > int64(len(buf)) || int64(len(buf))-int64(d.Off) < int64(d.Size) {
+			return nil, fmt.Errorf("ico: invalid size for image %d with offset %d and size %d",
+				i, d.Off, d.Size)
 		}
+		p := buf[d.Off : d.Off+d.Size]
 
-		m, _, err := image.Decode(b)
-		if err != nil {
-			m, err = decodeBMP(i, &d, buf)
+		e := Entry{
+			Width:   int(d.Width),
+			Height:  int(d.Height),
+			Palette: int(d.Palette),
+		}
+		if e.Width == 0 {
+			e.Width = 256
+		}
+		if e.Height == 0 {
+			e.Height = 256
+		}
+
+		var m image.Image
+		if bytes.HasPrefix(p, []byte(pngHeader)) {
+			m, err = png.Decode(bytes.NewReader(p))
+			e.PNG = true
+			e.Planes, e.Bpp = pngDepth(p)
+		} else {
+			m, err = decodeDIB(p, &e)
 		}
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("ico: image %d: %v", i, err)
 		}
 		f.Image = append(f.Image, m)
+		f.Entry = append(f.Entry, e)
+
+		// cursors store the hotspot in place of the planes and bpp
+		if f.Type == TYPE_CUR {
+			f.Hotspot = append(f.Hotspot, image.Pt(int(d.Planes), int(d.Bpp)))
+		}
 	}
 
 	return f, nil
 }
 
-func decodeBMP(n int, d *dirent, b []byte) (image.Image, error) {
-	const (
-		fileHeaderLen = 14
-		infoHeaderLen = 40
-	)
-
-	if int64(d.Off) >= int64(len(b)) || int64(len(b))-int64(d.Off) < int64(d.Size) || len(b) <= fileHeaderLen+infoHeaderLen {
-		return nil, fmt.Errorf("invalid size for bitmap %d with offset %d and size %d",
-			n, d.Off, d.Size)
+// pngDepth returns the planes and bits per pixel from the png header
+func pngDepth(b []byte) (int, int) {
+	if len(b) < 26 {
+		return 1, 0
 	}
-
-	sz := d.Size
-	b = b[d.Off : d.Off+d.Size]
-	bpp := readUint16(b[28-fileHeaderLen:])
-	off := fileHeaderLen + infoHeaderLen
-	switch bpp {
-	case 8:
-		off += 256 * 4
+	depth := int(b[24])
+	switch b[25] {
+	case 2:
+		return 1, depth * 3
+	case 4:
+		return 1, depth * 2
+	case 6:
+		return 1, depth * 4
 	}
-
-	b = append([]uint8{
-		'B', 'M',
-		uint8(sz), uint8(sz >> 8), uint8(sz >> 16), uint8(sz >> 32),
-		0, 0,
-		0, 0,
-		uint8(off), uint8(off >> 8), uint8(off >> 16), uint8(off >> 32),
-	}, b...)
-
-	return bmp.Decode(bytes.NewReader(b))
-}
-
-func readUint16(b []byte) uint16 {
-	return uint16(b[0]) | uint16(b[1])<<8
+	return 1, depth
 }
@@ -0,0 +1,427 @@
+package imageutil
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"reflect"
+	"unsafe"
+)
+
+// Surface is a packed pixel buffer described by channel masks like
+// sdl.Surface, it is converted directly from the pixel memory
+type Surface interface {
+	draw.Image
+	Pixels() []byte
+	Pitch() int
+	Masks() (bpp int, rmask, gmask, bmask, amask uint32)
+	Lock() error
+	Unlock()
+}
+
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// ToRGBA converts the image keeping its bounds,
+// an *image.RGBA is returned as is
+func ToRGBA(m image.Image) *image.RGBA {
+	if p, ok := m.(*image.RGBA); ok {
+		return p
+	}
+	p := image.NewRGBA(m.Bounds())
+	Convert(p, p.Rect, m, p.Rect.Min)
+	return p
+}
+
+// ToNRGBA converts the image keeping its bounds,
+// an *image.NRGBA is returned as is
+func ToNRGBA(m image.Image) *image.NRGBA {
+	if p, ok := m.(*image.NRGBA); ok {
+		return p
+	}
+	p := image.NewNRGBA(m.Bounds())
+	Convert(p, p.Rect, m, p.Rect.Min)
+	return p
+}
+
+// ToGray converts the image keeping its bounds,
+// an *image.Gray is returned as is
+func ToGray(m image.Image) *image.Gray {
+	if p, ok := m.(*image.Gray); ok {
+		return p
+	}
+	p := image.NewGray(m.Bounds())
+	Convert(p, p.Rect, m, p.Rect.Min)
+	return p
+}
+
+// ToPaletted maps every pixel to the closest color of the palette
+// without dithering, an *image.Paletted with the same palette is returned as is
+func ToPaletted(m image.Image, pal color.Palette) *image.Paletted {
+	if p, ok := m.(*image.Paletted); ok && samePalette(p.Palette, pal) {
+		return p
+	}
+	p := image.NewPaletted(m.Bounds(), pal)
+	Convert(p, p.Rect, m, p.Rect.Min)
+	return p
+}
+
+// Convert copies the pixels of src starting at sp into the rectangle r
+// of dst like draw.Draw with draw.Src, the common image types are
+// converted a row at a time through their pixel slices as 8 bit colors
+// so the results can differ slightly in rounding from draw.Draw
+func Convert(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
+	// clip to both images like draw.Draw
+	orig := r.Min
+	r = r.Intersect(dst.Bounds())
+	r = r.Intersect(src.Bounds().Add(orig.Sub(sp)))
+	if r.Empty() {
+		return
+	}
+	sp = sp.Add(r.Min.Sub(orig))
+
+	if copyRows(dst, r, src, sp) {
+		return
+	}
+
+	for _, s := range []image.Image{dst, src} {
+		if s, ok := s.(Surface); ok {
+			if s.Lock() == nil {
+				defer s.Unlock()
+			}
+		}
+	}
+
+	write, premul, ok := rowWriter(dst)
+	if !ok {
+		draw.Draw(dst, r, src, sp, draw.Src)
+		return
+	}
+	read := rowReader(src, premul)
+	row := make([]byte, r.Dx()*4)
+	for y := 0; y < r.Dy(); y++ {
+		read(row, sp.X, sp.Y+y)
+		write(row, r.Min.X, r.Min.Y+y)
+	}
+}
+
+// copyRows handles images of the same type that can be copied as bytes
+func copyRows(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) bool {
+	if reflect.TypeOf(dst) != reflect.TypeOf(src) {
+		return false
+	}
+	if d, ok := dst.(*image.Paletted); ok && !samePalette(d.Palette, src.(*image.Paletted).Palette) {
+		return false
+	}
+	dpix, dstride, size, ok := pixBuffer(dst)
+	if !ok {
+		return false
+	}
+	spix, sstride, _, _ := pixBuffer(src)
+
+	db, sb := dst.Bounds(), src.Bounds()
+	doff := (r.Min.Y-db.Min.Y)*dstride + (r.Min.X-db.Min.X)*size
+	soff := (sp.Y-sb.Min.Y)*sstride + (sp.X-sb.Min.X)*size
+	n := r.Dx() * size
+	for y := 0; y < r.Dy(); y++ {
+		copy(dpix[doff+y*dstride:doff+y*dstride+n], spix[soff+y*sstride:soff+y*sstride+n])
+	}
+	return true
+}
+
+func samePalette(a, b color.Palette) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// rowReader returns a function reading n pixels starting at x, y as 8 bit
+// rgba into b, premul selects premultiplied or straight alpha samples
+func rowReader(m image.Image, premul bool) func(b []byte, x, y int) {
+	switch m := m.(type) {
+	case *image.RGBA:
+		return func(b []byte, x, y int) {
+			i := m.PixOffset(x, y)
+			copy(b, m.Pix[i:i+len(b)])
+			if !premul {
+				unpremultiply(b)
+			}
+		}
+
+	case *image.NRGBA:
+		return func(b []byte, x, y int) {
+			i := m.PixOffset(x, y)
+			copy(b, m.Pix[i:i+len(b)])
+			if premul {
+				premultiply(b)
+			}
+		}
+
+	case *image.Gray:
+		return func(b []byte, x, y int) {
+			p := m.Pix[m.PixOffset(x, y):]
+			for i := 0; i < len(b); i += 4 {
+				v := p[i/4]
+				b[i], b[i+1], b[i+2], b[i+3] = v, v, v, 0xff
+			}
+		}
+
+	case *image.Paletted:
+		var lut [256][4]byte
+		for i, c := range m.Palette {
+			if i >= len(lut) {
+				break
+			}
+			if premul {
+				n := color.RGBAModel.Convert(c).(color.RGBA)
+				lut[i] = [4]byte{n.R, n.G, n.B, n.A}
+			} else {
+				n := color.NRGBAModel.Convert(c).(color.NRGBA)
+				lut[i] = [4]byte{n.R, n.G, n.B, n.A}
+			}
+		}
+		return func(b []byte, x, y int) {
+			p := m.Pix[m.PixOffset(x, y):]
+			for i := 0; i < len(b); i += 4 {
+				c := &lut[p[i/4]]
+				b[i], b[i+1], b[i+2], b[i+3] = c[0], c[1], c[2], c[3]
+			}
+		}
+
+	case *image.YCbCr:
+		return func(b []byte, x, y int) {
+			for i := 0; i < len(b); i += 4 {
+				yi := m.YOffset(x+i/4, y)
+				ci := m.COffset(x+i/4, y)
+				r, g, bb, _ := color.YCbCr{m.Y[yi], m.Cb[ci], m.Cr[ci]}.RGBA()
+				b[i], b[i+1], b[i+2], b[i+3] = uint8(r>>8), uint8(g>>8), uint8(bb>>8), 0xff
+			}
+		}
+
+	case Surface:
+		if read := surfaceReader(m, premul); read != nil {
+			return read
+		}
+	}
+
+	return func(b []byte, x, y int) {
+		for i := 0; i < len(b); i += 4 {
+			c := m.At(x+i/4, y)
+			if premul {
+				n := color.RGBAModel.Convert(c).(color.RGBA)
+				b[i], b[i+1], b[i+2], b[i+3] = n.R, n.G, n.B, n.A
+			} else {
+				n := color.NRGBAModel.Convert(c).(color.NRGBA)
+				b[i], b[i+1], b[i+2], b[i+3] = n.R, n.G, n.B, n.A
+			}
+		}
+	}
+}
+
+// rowWriter returns a function storing 8 bit rgba samples at x, y
+// and whether it expects the samples to be premultiplied, images
+// with deeper or other pixel layouts are left to draw.Draw
+func rowWriter(m draw.Image) (write func(b []byte, x, y int), premul, ok bool) {
+	switch m := m.(type) {
+	case *image.RGBA:
+		return func(b []byte, x, y int) {
+			copy(m.Pix[m.PixOffset(x, y):], b)
+		}, true, true
+
+	case *image.NRGBA:
+		return func(b []byte, x, y int) {
+			copy(m.Pix[m.PixOffset(x, y):], b)
+		}, false, true
+
+	case *image.Gray:
+		return func(b []byte, x, y int) {
+			p := m.Pix[m.PixOffset(x, y):]
+			for i := 0; i < len(b); i += 4 {
+				p[i/4] = gray(b[i], b[i+1], b[i+2])
+			}
+		}, true, true
+
+	case *image.Paletted:
+		cache := make(map[[4]byte]uint8)
+		return func(b []byte, x, y int) {
+			p := m.Pix[m.PixOffset(x, y):]
+			for i := 0; i < len(b); i += 4 {
+				k := [4]byte{b[i], b[i+1], b[i+2], b[i+3]}
+				v, ok := cache[k]
+				if !ok {
+					v = uint8(m.Palette.Index(color.RGBA{k[0], k[1], k[2], k[3]}))
+					cache[k] = v
+				}
+				p[i/4] = v
+			}
+		}, true, true
+
+	case Surface:
+		if write := surfaceWriter(m); write != nil {
+			return write, false, true
+		}
+	}
+
+	return nil, false, false
+}
+
+// gray matches color.GrayModel for premultiplied samples
+func gray(r, g, b uint8) uint8 {
+	y := (19595*uint32(r)*0x101 + 38470*uint32(g)*0x101 + 7471*uint32(b)*0x101 + 1<<15) >> 24
+	return uint8(y)
+}
+
+// premultiply and unpremultiply round like the conversions of
+// color.RGBAModel and color.NRGBAModel between 8 bit colors
+func premultiply(b []byte) {
+	for i := 0; i < len(b); i += 4 {
+		a := uint32(b[i+3])
+		if a == 0xff {
+			continue
+		}
+		b[i] = uint8(uint32(b[i]) * a * 0x101 / 0xff >> 8)
+		b[i+1] = uint8(uint32(b[i+1]) * a * 0x101 / 0xff >> 8)
+		b[i+2] = uint8(uint32(b[i+2]) * a * 0x101 / 0xff >> 8)
+	}
+}
+
+func unpremultiply(b []byte) {
+	for i := 0; i < len(b); i += 4 {
+		a := uint32(b[i+3])
+		switch a {
+		case 0xff:
+		case 0:
+			b[i], b[i+1], b[i+2] = 0, 0, 0
+		default:
+			b[i] = uint8(uint32(b[i]) * 0xffff / a >> 8)
+			b[i+1] = uint8(uint32(b[i+1]) * 0xffff / a >> 8)
+			b[i+2] = uint8(uint32(b[i+2]) * 0xffff / a >> 8)
+		}
+	}
+}
+
+// channel extracts a masked channel and scales it to 8 bits
+type channel struct {
+	mask  uint32
+	shift uint
+	max   uint32
+}
+
+func newChannel(mask uint32) channel {
+	c := channel{mask: mask}
+	if mask == 0 {
+		return c
+	}
+	for mask&1 == 0 {
+		mask >>= 1
+		c.shift++
+	}
+	c.max = mask
+	return c
+}
+
+func (c channel) get(p uint32, def uint8) uint8 {
+	if c.mask == 0 {
+		return def
+	}
+	v := (p & c.mask) >> c.shift
+	if c.max == 0xff {
+		return uint8(v)
+	}
+	return uint8((v*0xff + c.max/2) / c.max)
+}
+
+func (c channel) put(v uint8) uint32 {
+	if c.mask == 0 {
+		return 0
+	}
+	return (uint32(v)*c.max + 0x7f) / 0xff << c.shift & c.mask
+}
+
+// surfaceLayout returns the channels of surfaces with 16 to 32 bit
+// pixels, palette surfaces and other layouts return false
+func surfaceLayout(s Surface) (size int, ch [4]channel, ok bool) {
+	bpp, rm, gm, bm, am := s.Masks()
+	size = (bpp + 7) / 8
+	if size < 2 || size > 4 || rm == 0 {
+		return
+	}
+	return size, [4]channel{newChannel(rm), newChannel(gm), newChannel(bm), newChannel(am)}, true
+}
+
+func loadPixel(p []byte, size int) uint32 {
+	switch size {
+	case 2:
+		return uint32(nativeEndian.Uint16(p))
+	case 3:
+		if nativeEndian == binary.BigEndian {
+			return uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+		}
+		return uint32(p[0]) | uint32(p[1])<<8 | uint32(p[2])<<16
+	}
+	return nativeEndian.Uint32(p)
+}
+
+func storePixel(p []byte, size int, v uint32) {
+	switch size {
+	case 2:
+		nativeEndian.PutUint16(p, uint16(v))
+	case 3:
+		if nativeEndian == binary.BigEndian {
+			p[0], p[1], p[2] = uint8(v>>16), uint8(v>>8), uint8(v)
+		} else {
+			p[0], p[1], p[2] = uint8(v), uint8(v>>8), uint8(v>>16)
+		}
+	default:
+		nativeEndian.PutUint32(p, v)
+	}
+}
+
+func surfaceReader(s Surface, premul bool) func(b []byte, x, y int) {
+	size, ch, ok := surfaceLayout(s)
+	if !ok {
+		return nil
+	}
+	return func(b []byte, x, y int) {
+		pix := s.Pixels()
+		o := (y-s.Bounds().Min.Y)*s.Pitch() + (x-s.Bounds().Min.X)*size
+		for i := 0; i < len(b); i += 4 {
+			v := loadPixel(pix[o+i/4*size:], size)
+			b[i] = ch[0].get(v, 0)
+			b[i+1] = ch[1].get(v, 0)
+			b[i+2] = ch[2].get(v, 0)
+			b[i+3] = ch[3].get(v, 0xff)
+		}
+		if premul {
+			premultiply(b)
+		}
+	}
+}
+
+func surfaceWriter(s Surface) func(b []byte, x, y int) {
+	size, ch, ok := surfaceLayout(s)
+	if !ok {
+		return nil
+	}
+	return func(b []byte, x, y int) {
+		pix := s.Pixels()
+		o := (y-s.Bounds().Min.Y)*s.Pitch() + (x-s.Bounds().Min.X)*size
+		for i := 0; i < len(b); i += 4 {
+			v := ch[0].put(b[i]) | ch[1].put(b[i+1]) | ch[2].put(b[i+2]) | ch[3].put(b[i+3])
+			storePixel(pix[o+i/4*size:], size, v)
+		}
+	}
+}
@@ -0,0 +1,465 @@
+package imageutil
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sync"
+
+	"github.com/qeedquan/go-media/image/chroma"
+	"github.com/qeedquan/go-media/math/mt19937"
+)
+
+// ErrorDiffusion is a draw.Drawer that spreads the error of every pixel
+// mapped to the palette of the destination to the pixels not done yet
+type ErrorDiffusion struct {
+	// Matrix holds the weights of the neighbors, the first row is the
+	// current row and Origin is the column of the current pixel in it
+	Matrix  [][]float64
+	Origin  int
+	Divisor float64
+
+	// Serpentine alternates the direction of the rows
+	Serpentine bool
+
+	// Lab matches colors by their distance in the Lab color space
+	Lab bool
+}
+
+var (
+	FloydSteinberg = &ErrorDiffusion{
+		Matrix: [][]float64{
+			{0, 0, 7},
+			{3, 5, 1},
+		},
+		Origin:  1,
+		Divisor: 16,
+	}
+
+	// Atkinson spreads 3/4 of the error so it keeps more contrast
+	Atkinson = &ErrorDiffusion{
+		Matrix: [][]float64{
+			{0, 0, 1, 1},
+			{1, 1, 1, 0},
+			{0, 1, 0, 0},
+		},
+		Origin:  1,
+		Divisor: 8,
+	}
+
+	Sierra = &ErrorDiffusion{
+		Matrix: [][]float64{
+			{0, 0, 0, 5, 3},
+			{2, 4, 5, 4, 2},
+			{0, 2, 3, 2, 0},
+		},
+		Origin:  2,
+		Divisor: 32,
+	}
+
+	SierraLite = &ErrorDiffusion{
+		Matrix: [][]float64{
+			{0, 0, 2},
+			{1, 1, 0},
+		},
+		Origin:  1,
+		Divisor: 4,
+	}
+)
+
+// Ordered is a draw.Drawer that offsets every pixel by a threshold
+// tiled over the image before it is mapped to the palette
+type Ordered struct {
+	// Matrix holds the thresholds in [0, 1), nothing is
+	// drawn unless the rows have the same non-zero length
+	Matrix [][]float64
+
+	// Spread is the range of the offsets in 8 bit units,
+	// zero picks it from the size of the palette
+	Spread float64
+
+	// Lab matches colors by their distance in the Lab color space
+	Lab bool
+}
+
+// Bayer returns an ordered ditherer with a bayer matrix,
+// the size is rounded up to a power of two
+func Bayer(size int) *Ordered {
+	n := 1
+	m := [][]float64{{0}}
+	for n < size {
+		p := make([][]float64, 2*n)
+		for y := range p {
+			p[y] = make([]float64, 2*n)
+			for x := range p[y] {
+				v := 4 * m[y%n][x%n]
+				switch {
+				case y < n && x >= n:
+					v += 2
+				case y >= n && x < n:
+					v += 3
+				case y >= n && x >= n:
+					v += 1
+				}
+				p[y][x] = v
+			}
+		}
+		m, n = p, 2*n
+	}
+	for y := range m {
+		for x := range m[y] {
+			m[y][x] = (m[y][x] + .5) / float64(n*n)
+		}
+	}
+	return &Ordered{Matrix: m}
+}
+
+var (
+	blueNoiseOnce sync.Once
+	blueNoise     [][]float64
+)
+
+// BlueNoise returns an ordered ditherer with a 64x64 blue noise
+// matrix made with the void and cluster method, the matrix is
+// made once with a fixed seed so the output is reproducible
+func BlueNoise() *Ordered {
+	blueNoiseOnce.Do(func() {
+		blueNoise = voidAndCluster(64, 1.5, 5489)
+	})
+	return &Ordered{Matrix: blueNoise}
+}
+
+// voidAndCluster ranks the cells of a toroidal n*n grid so that every
+// prefix of the ranking is evenly spread without low frequencies
+func voidAndCluster(n int, sigma float64, seed uint64) [][]float64 {
+	size := n * n
+
+	// gaussian energy of the wrapped offsets
+	kernel := make([]float64, size)
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			dx := float64(min(x, n-x))
+			dy := float64(min(y, n-y))
+			kernel[y*n+x] = math.Exp(-(dx*dx + dy*dy) / (2 * sigma * sigma))
+		}
+	}
+
+	bits := make([]bool, size)
+	energy := make([]float64, size)
+	toggle := func(p int, on bool) {
+		bits[p] = on
+		k := 1.0
+		if !on {
+			k = -1
+		}
+		px, py := p%n, p/n
+		for y := 0; y < n; y++ {
+			ky := (y - py + n) % n
+			for x := 0; x < n; x++ {
+				energy[y*n+x] += k * kernel[ky*n+(x-px+n)%n]
+			}
+		}
+	}
+	// tightest cluster is the set bit with the most energy and
+	// the largest void is the unset bit with the least
+	extreme := func(set bool) int {
+		best := -1
+		for i, b := range bits {
+			if b != set {
+				continue
+			}
+			if best < 0 || (set && energy[i] > energy[best]) || (!set && energy[i] < energy[best]) {
+				best = i
+			}
+		}
+		return best
+	}
+
+	// initial pattern of randomly placed points moved
+	// from clusters to voids until it is stable
+	rng := mt19937.New64()
+	rng.Seed(seed)
+	ones := size / 10
+	for count := 0; count < ones; {
+		p := int(rng.Uint64() % uint64(size))
+		if !bits[p] {
+			toggle(p, true)
+			count++
+		}
+	}
+	for {
+		c := extreme(true)
+		toggle(c, false)
+		v := extreme(false)
+		if v == c {
+			toggle(c, true)
+			break
+		}
+		toggle(v, true)
+	}
+
+	rank := make([]int, size)
+	proto := append([]bool(nil), bits...)
+	protoEnergy := append([]float64(nil), energy...)
+	for r := ones - 1; r >= 0; r-- {
+		c := extreme(true)
+		toggle(c, false)
+		rank[c] = r
+	}
+
+	copy(bits, proto)
+	copy(energy, protoEnergy)
+	for r := ones; r < size; r++ {
+		v := extreme(false)
+		toggle(v, true)
+		rank[v] = r
+	}
+
+	m := make([][]float64, n)
+	for y := range m {
+		m[y] = make([]float64, n)
+		for x := range m[y] {
+			m[y][x] = (float64(rank[y*n+x]) + .5) / float64(size)
+		}
+	}
+	return m
+}
+
+// paletteMatcher finds the closest palette entry to a color,
+// transparent pixels map to the first transparent entry
+type paletteMatcher struct {
+	pal         color.Palette
+	points      [][3]float64
+	opaque      []bool
+	transparent int
+	lab         bool
+	cache       map[uint32]uint8
+}
+
+func newPaletteMatcher(pal color.Palette, lab bool) *paletteMatcher {
+	pm := &paletteMatcher{
+		pal:         pal,
+		transparent: -1,
+		lab:         lab,
+		cache:       make(map[uint32]uint8),
+	}
+	for i, c := range pal {
+		n := color.NRGBAModel.Convert(c).(color.NRGBA)
+		pm.points = append(pm.points, pm.point(n.R, n.G, n.B))
+		pm.opaque = append(pm.opaque, n.A >= 0x80)
+		if n.A < 0x80 && pm.transparent < 0 {
+			pm.transparent = i
+		}
+	}
+	return pm
+}
+
+func (pm *paletteMatcher) point(r, g, b uint8) [3]float64 {
+	if pm.lab {
+		l := chroma.RGB2LAB(color.RGBA{r, g, b, 0xff})
+		return [3]float64{l.L, l.A, l.B}
+	}
+	return [3]float64{float64(r), float64(g), float64(b)}
+}
+
+// index returns the entry for the color and the color of the entry
+func (pm *paletteMatcher) index(r, g, b float64, a uint8) (int, color.NRGBA) {
+	if a < 0x80 && pm.transparent >= 0 {
+		return pm.transparent, color.NRGBA{}
+	}
+
+	cr, cg, cb := clampByte(r), clampByte(g), clampByte(b)
+	key := uint32(cr)<<16 | uint32(cg)<<8 | uint32(cb)
+	i, ok := pm.cache[key]
+	if !ok {
+		p := pm.point(cr, cg, cb)
+		best, bd := 0, math.MaxFloat64
+		for j, q := range pm.points {
+			if !pm.opaque[j] {
+				continue
+			}
+			x, y, z := p[0]-q[0], p[1]-q[1], p[2]-q[2]
+			if d := x*x + y*y + z*z; d < bd {
+				best, bd = j, d
+			}
+		}
+		i = uint8(best)
+		pm.cache[key] = i
+	}
+	return int(i), color.NRGBAModel.Convert(pm.pal[i]).(color.NRGBA)
+}
+
+func clampByte(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + .5)
+}
+
+// ditherTarget returns the palette of the destination and a function
+// setting an index, images without a palette are drawn with draw.Src
+func ditherTarget(dst draw.Image) (color.Palette, func(x, y, i int), bool) {
+	if p, ok := dst.(*image.Paletted); ok {
+		return p.Palette, func(x, y, i int) {
+			p.Pix[p.PixOffset(x, y)] = uint8(i)
+		}, len(p.Palette) > 0 && len(p.Palette) <= 256
+	}
+	pal, ok := dst.ColorModel().(color.Palette)
+	return pal, func(x, y, i int) {
+		dst.Set(x, y, pal[i])
+	}, ok && len(pal) > 0 && len(pal) <= 256
+}
+
+// clip clips the rectangle to both images like draw.Draw
+func clip(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) (image.Rectangle, image.Point) {
+	orig := r.Min
+	r = r.Intersect(dst.Bounds())
+	r = r.Intersect(src.Bounds().Add(orig.Sub(sp)))
+	return r, sp.Add(r.Min.Sub(orig))
+}
+
+func (d *ErrorDiffusion) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
+	r, sp = clip(dst, r, src, sp)
+	if r.Empty() {
+		return
+	}
+	pal, set, ok := ditherTarget(dst)
+	if !ok {
+		draw.Draw(dst, r, src, sp, draw.Src)
+		return
+	}
+	pm := newPaletteMatcher(pal, d.Lab)
+
+	// rows of accumulated errors padded by the width of the matrix
+	w := r.Dx()
+	pad := 0
+	for _, row := range d.Matrix {
+		pad = max(pad, len(row))
+	}
+	errs := make([][]float64, len(d.Matrix))
+	for i := range errs {
+		errs[i] = make([]float64, (w+2*pad)*3)
+	}
+
+	read := rowReader(src, false)
+	row := make([]byte, w*4)
+	for y := 0; y < r.Dy(); y++ {
+		read(row, sp.X, sp.Y+y)
+		dir := 1
+		if d.Serpentine && y%2 == 1 {
+			dir = -1
+		}
+		for i := 0; i < w; i++ {
+			x := i
+			if dir < 0 {
+				x = w - 1 - i
+			}
+			e := errs[0][(x+pad)*3:]
+			p := row[x*4:]
+			cr := float64(p[0]) + e[0]
+			cg := float64(p[1]) + e[1]
+			cb := float64(p[2]) + e[2]
+
+			j, c := pm.index(cr, cg, cb, p[3])
+			set(r.Min.X+x, r.Min.Y+y, j)
+			if p[3] < 0x80 {
+				continue
+			}
+
+			er, eg, eb := cr-float64(c.R), cg-float64(c.G), cb-float64(c.B)
+			for k, mrow := range d.Matrix {
+				for l, wt := range mrow {
+					if wt == 0 {
+						continue
+					}
+					t := errs[k][(x+pad+(l-d.Origin)*dir)*3:]
+					wt /= d.Divisor
+					t[0] += er * wt
+					t[1] += eg * wt
+					t[2] += eb * wt
+				}
+			}
+		}
+
+		first := errs[0]
+		copy(errs, errs[1:])
+		for i := range first {
+			first[i] = 0
+		}
+		errs[len(errs)-1] = first
+	}
+}
+
+func (d *Ordered) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
+	r, sp = clip(dst, r, src, sp)
+	if r.Empty() || !d.valid() {
+		return
+	}
+	pal, set, ok := ditherTarget(dst)
+	if !ok {
+		draw.Draw(dst, r, src, sp, draw.Src)
+		return
+	}
+	pm := newPaletteMatcher(pal, d.Lab)
+
+	// with n colors spread over the cube the steps
+	// between them are about 255/cbrt(n)
+	spread := d.Spread
+	if spread == 0 {
+		spread = 255 / math.Max(math.Cbrt(float64(len(pal)))-1, 1)
+	}
+
+	read := rowReader(src, false)
+	row := make([]byte, r.Dx()*4)
+	for y := 0; y < r.Dy(); y++ {
+		read(row, sp.X, sp.Y+y)
+		mrow := d.Matrix[posmod(r.Min.Y+y, len(d.Matrix))]
+		for x := 0; x < r.Dx(); x++ {
+			t := (mrow[posmod(r.Min.X+x, len(mrow))] - .5) * spread
+			p := row[x*4:]
+			i, _ := pm.index(float64(p[0])+t, float64(p[1])+t, float64(p[2])+t, p[3])
+			set(r.Min.X+x, r.Min.Y+y, i)
+		}
+	}
+}
+
+// valid reports if the matrix is not empty or ragged
+func (d *Ordered) valid() bool {
+	if len(d.Matrix) == 0 {
+		return false
+	}
+	for _, row := range d.Matrix {
+		if len(row) == 0 || len(row) != len(d.Matrix[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// posmod keeps the matrix anchored to the image coordinates
+// for rectangles starting at negative coordinates
+func posmod(x, n int) int {
+	x %= n
+	if x < 0 {
+		x += n
+	}
+	return x
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
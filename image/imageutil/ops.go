@@ -0,0 +1,258 @@
+package imageutil
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// pixBuffer returns the pixel slice of the standard image types
+// along with the stride and the number of bytes per pixel
+func pixBuffer(m image.Image) (pix []byte, stride, size int, ok bool) {
+	switch m := m.(type) {
+	case *image.RGBA:
+		return m.Pix, m.Stride, 4, true
+	case *image.NRGBA:
+		return m.Pix, m.Stride, 4, true
+	case *image.CMYK:
+		return m.Pix, m.Stride, 4, true
+	case *image.RGBA64:
+		return m.Pix, m.Stride, 8, true
+	case *image.NRGBA64:
+		return m.Pix, m.Stride, 8, true
+	case *image.Gray:
+		return m.Pix, m.Stride, 1, true
+	case *image.Alpha:
+		return m.Pix, m.Stride, 1, true
+	case *image.Paletted:
+		return m.Pix, m.Stride, 1, true
+	case *image.Gray16:
+		return m.Pix, m.Stride, 2, true
+	case *image.Alpha16:
+		return m.Pix, m.Stride, 2, true
+	}
+	return nil, 0, 0, false
+}
+
+// newLike makes an image of the same type as m with the bounds r,
+// m has to be one of the types handled by pixBuffer
+func newLike(m image.Image, r image.Rectangle) draw.Image {
+	switch m := m.(type) {
+	case *image.RGBA:
+		return image.NewRGBA(r)
+	case *image.NRGBA:
+		return image.NewNRGBA(r)
+	case *image.CMYK:
+		return image.NewCMYK(r)
+	case *image.RGBA64:
+		return image.NewRGBA64(r)
+	case *image.NRGBA64:
+		return image.NewNRGBA64(r)
+	case *image.Gray:
+		return image.NewGray(r)
+	case *image.Alpha:
+		return image.NewAlpha(r)
+	case *image.Paletted:
+		return image.NewPaletted(r, append(color.Palette(nil), m.Palette...))
+	case *image.Gray16:
+		return image.NewGray16(r)
+	case *image.Alpha16:
+		return image.NewAlpha16(r)
+	}
+	panic("unreachable")
+}
+
+// packed returns m if its pixels can be moved as bytes,
+// other images are converted to NRGBA or RGBA first
+func packed(m image.Image) image.Image {
+	if _, _, _, ok := pixBuffer(m); ok {
+		return m
+	}
+	if m.ColorModel() == color.NRGBAModel {
+		return ToNRGBA(m)
+	}
+	return ToRGBA(m)
+}
+
+// transform copies every pixel of m to the position given by fn
+// in an image of the same type with the bounds r
+func transform(m image.Image, r image.Rectangle, fn func(x, y int) (int, int)) image.Image {
+	m = packed(m)
+	p := newLike(m, r)
+	spix, sstride, size, _ := pixBuffer(m)
+	dpix, dstride, _, _ := pixBuffer(p)
+
+	b := m.Bounds()
+	for y := 0; y < b.Dy(); y++ {
+		s := spix[y*sstride:]
+		for x := 0; x < b.Dx(); x++ {
+			dx, dy := fn(x, y)
+			d := dpix[dy*dstride+dx*size:]
+			copy(d[:size], s[x*size:])
+		}
+	}
+	return p
+}
+
+// FlipHorizontal mirrors the image around the vertical axis, the result
+// has the same type as m for the standard image types and RGBA or
+// NRGBA otherwise
+func FlipHorizontal(m image.Image) image.Image {
+	m = packed(m)
+	p := newLike(m, m.Bounds())
+	spix, sstride, size, _ := pixBuffer(m)
+	dpix, dstride, _, _ := pixBuffer(p)
+
+	w, h := m.Bounds().Dx(), m.Bounds().Dy()
+	for y := 0; y < h; y++ {
+		s := spix[y*sstride:]
+		d := dpix[y*dstride:]
+		for x := 0; x < w; x++ {
+			copy(d[(w-1-x)*size:(w-x)*size], s[x*size:])
+		}
+	}
+	return p
+}
+
+// FlipVertical mirrors the image around the horizontal axis
+func FlipVertical(m image.Image) image.Image {
+	m = packed(m)
+	p := newLike(m, m.Bounds())
+	spix, sstride, size, _ := pixBuffer(m)
+	dpix, dstride, _, _ := pixBuffer(p)
+
+	w, h := m.Bounds().Dx(), m.Bounds().Dy()
+	for y := 0; y < h; y++ {
+		copy(dpix[(h-1-y)*dstride:(h-1-y)*dstride+w*size], spix[y*sstride:])
+	}
+	return p
+}
+
+// Rotate90 rotates the image clockwise by 90 degrees,
+// the bounds of the result start at the origin
+func Rotate90(m image.Image) image.Image {
+	w, h := m.Bounds().Dx(), m.Bounds().Dy()
+	return transform(m, image.Rect(0, 0, h, w), func(x, y int) (int, int) {
+		return h - 1 - y, x
+	})
+}
+
+// Rotate180 rotates the image by 180 degrees
+func Rotate180(m image.Image) image.Image {
+	w, h := m.Bounds().Dx(), m.Bounds().Dy()
+	return transform(m, image.Rect(0, 0, w, h), func(x, y int) (int, int) {
+		return w - 1 - x, h - 1 - y
+	})
+}
+
+// Rotate270 rotates the image counter clockwise by 90 degrees
+func Rotate270(m image.Image) image.Image {
+	w, h := m.Bounds().Dx(), m.Bounds().Dy()
+	return transform(m, image.Rect(0, 0, h, w), func(x, y int) (int, int) {
+		return y, w - 1 - x
+	})
+}
+
+// Crop copies the part of the image inside r, unlike SubImage
+// the result does not share its pixels with m
+func Crop(m image.Image, r image.Rectangle) image.Image {
+	m = packed(m)
+	r = r.Intersect(m.Bounds())
+	p := newLike(m, r)
+	copyRows(p, r, m, r.Min)
+	return p
+}
+
+// Premultiply converts the image to premultiplied alpha in place,
+// the returned image shares its pixels with m
+func Premultiply(m *image.NRGBA) *image.RGBA {
+	r := m.Bounds()
+	for y := 0; y < r.Dy(); y++ {
+		i := y * m.Stride
+		premultiply(m.Pix[i : i+r.Dx()*4])
+	}
+	return &image.RGBA{Pix: m.Pix, Stride: m.Stride, Rect: m.Rect}
+}
+
+// Unpremultiply converts the image to straight alpha in place,
+// the returned image shares its pixels with m
+func Unpremultiply(m *image.RGBA) *image.NRGBA {
+	r := m.Bounds()
+	for y := 0; y < r.Dy(); y++ {
+		i := y * m.Stride
+		unpremultiply(m.Pix[i : i+r.Dx()*4])
+	}
+	return &image.NRGBA{Pix: m.Pix, Stride: m.Stride, Rect: m.Rect}
+}
+
+// EqualsTolerance compares the images as 8 bit premultiplied colors,
+// the channels of every pixel may differ by up to tol
+func EqualsTolerance(a, b image.Image, tol uint8) bool {
+	r, s := a.Bounds(), b.Bounds()
+	if r.Dx() != s.Dx() || r.Dy() != s.Dy() {
+		return false
+	}
+
+	ra, rb := rowReader(a, true), rowReader(b, true)
+	u := make([]byte, r.Dx()*4)
+	v := make([]byte, r.Dx()*4)
+	for y := 0; y < r.Dy(); y++ {
+		ra(u, r.Min.X, r.Min.Y+y)
+		rb(v, s.Min.X, s.Min.Y+y)
+		for i := range u {
+			if absDiff(u[i], v[i]) > tol {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Diff returns the absolute difference of every channel of the images
+// and the number of pixels that differ by more than tol, the alpha of
+// the difference image is opaque unless the alpha channels differ
+func Diff(a, b image.Image, tol uint8) (*image.NRGBA, int) {
+	r, s := a.Bounds(), b.Bounds()
+	w, h := r.Dx(), r.Dy()
+	if s.Dx() < w {
+		w = s.Dx()
+	}
+	if s.Dy() < h {
+		h = s.Dy()
+	}
+
+	p := image.NewNRGBA(image.Rect(0, 0, w, h))
+	ra, rb := rowReader(a, true), rowReader(b, true)
+	u := make([]byte, w*4)
+	v := make([]byte, w*4)
+	n := 0
+	for y := 0; y < h; y++ {
+		ra(u, r.Min.X, r.Min.Y+y)
+		rb(v, s.Min.X, s.Min.Y+y)
+		d := p.Pix[y*p.Stride:]
+		for i := 0; i < len(u); i += 4 {
+			over := false
+			for j := 0; j < 4; j++ {
+				d[i+j] = absDiff(u[i+j], v[i+j])
+				if d[i+j] > tol {
+					over = true
+				}
+			}
+			d[i+3] = 0xff - d[i+3]
+			if over {
+				n++
+			}
+		}
+	}
+
+	// pixels of either image outside of the overlap count as different
+	n += r.Dx()*r.Dy() + s.Dx()*s.Dy() - 2*w*h
+	return p, n
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
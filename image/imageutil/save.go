@@ -0,0 +1,298 @@
+package imageutil
+
+import (
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/qeedquan/go-media/image/dds"
+	"github.com/qeedquan/go-media/image/hdr"
+	"github.com/qeedquan/go-media/image/ico"
+	"github.com/qeedquan/go-media/image/ktx"
+	"github.com/qeedquan/go-media/image/pcx"
+	"github.com/qeedquan/go-media/image/pnm"
+	"github.com/qeedquan/go-media/image/psd"
+	"github.com/qeedquan/go-media/image/qoi"
+	"github.com/qeedquan/go-media/image/tga"
+	"github.com/qeedquan/go-media/image/xpm"
+	"github.com/qeedquan/go-media/xio"
+	"golang.org/x/image/bmp"
+)
+
+// EncodeOptions holds the settings passed to an encoder, the common
+// settings are mapped to each format and Options is passed to the
+// encoder as is when it is the options type of that format
+type EncodeOptions struct {
+	// Format overrides the format picked from the file extension
+	Format string
+
+	// Quality is the jpeg quality from 1 to 100,
+	// zero uses the default of the encoder
+	Quality int
+
+	// NumColors is the maximum size of the palette for formats
+	// that quantize the image like gif, zero is 256
+	NumColors int
+
+	// Options are format specific like *png.Encoder or *tga.Options
+	Options interface{}
+}
+
+type EncodeOption func(*EncodeOptions)
+
+func WithFormat(name string) EncodeOption {
+	return func(o *EncodeOptions) { o.Format = name }
+}
+
+func WithQuality(quality int) EncodeOption {
+	return func(o *EncodeOptions) { o.Quality = quality }
+}
+
+func WithNumColors(n int) EncodeOption {
+	return func(o *EncodeOptions) { o.NumColors = n }
+}
+
+func WithOptions(v interface{}) EncodeOption {
+	return func(o *EncodeOptions) { o.Options = v }
+}
+
+type EncodeFunc func(w io.Writer, m image.Image, o *EncodeOptions) error
+
+type encoderEntry struct {
+	name   string
+	exts   []string
+	encode EncodeFunc
+}
+
+var (
+	encodersMu sync.Mutex
+	encoders   []encoderEntry
+)
+
+// RegisterEncoder adds an encoder for the format name, the extensions
+// include the leading dot and a later registration of the same
+// format or extension takes precedence over an earlier one
+func RegisterEncoder(name string, exts []string, encode EncodeFunc) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+
+	e := encoderEntry{name: name, encode: encode}
+	for _, x := range exts {
+		e.exts = append(e.exts, strings.ToLower(x))
+	}
+	encoders = append(encoders, e)
+}
+
+// Encoders returns the names of the registered formats
+func Encoders() []string {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, e := range encoders {
+		if !seen[e.name] {
+			seen[e.name] = true
+			names = append(names, e.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupEncoder(name, ext string) (EncodeFunc, bool) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+
+	ext = strings.ToLower(ext)
+	for i := len(encoders) - 1; i >= 0; i-- {
+		e := &encoders[i]
+		if name != "" {
+			if e.name == name {
+				return e.encode, true
+			}
+			continue
+		}
+		for _, x := range e.exts {
+			if x == ext {
+				return e.encode, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Save encodes the image with the format picked from the extension
+// of the name unless one is given by WithFormat
+func Save(fs xio.FS, name string, m image.Image, opts ...EncodeOption) error {
+	o := &EncodeOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	ext := filepath.Ext(name)
+	enc, ok := lookupEncoder(o.Format, ext)
+	if !ok {
+		format := o.Format
+		if format == "" {
+			format = ext
+		}
+		return &FormatError{Op: "encode", Format: format}
+	}
+
+	f, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	err = enc(f, m, o)
+	xerr := f.Close()
+	if err == nil {
+		err = xerr
+	}
+	return err
+}
+
+// Encode writes the image in the named format
+func Encode(w io.Writer, format string, m image.Image, opts ...EncodeOption) error {
+	o := &EncodeOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	enc, ok := lookupEncoder(format, "")
+	if !ok {
+		return &FormatError{Op: "encode", Format: format}
+	}
+	return enc(w, m, o)
+}
+
+type FormatError struct {
+	Op     string
+	Format string
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("imageutil: %s: unknown format %q", e.Op, e.Format)
+}
+
+func init() {
+	RegisterEncoder("png", []string{".png"}, func(w io.Writer, m image.Image, o *EncodeOptions) error {
+		if e, ok := o.Options.(*png.Encoder); ok {
+			return e.Encode(w, m)
+		}
+		return png.Encode(w, m)
+	})
+	RegisterEncoder("jpeg", []string{".jpg", ".jpeg"}, func(w io.Writer, m image.Image, o *EncodeOptions) error {
+		jo, _ := o.Options.(*jpeg.Options)
+		if jo == nil {
+			jo = &jpeg.Options{Quality: jpeg.DefaultQuality}
+		}
+		if o.Quality != 0 {
+			jo = &jpeg.Options{Quality: o.Quality}
+		}
+		return jpeg.Encode(w, m, jo)
+	})
+	RegisterEncoder("gif", []string{".gif"}, func(w io.Writer, m image.Image, o *EncodeOptions) error {
+		if g, ok := o.Options.(*gif.GIF); ok {
+			return gif.EncodeAll(w, g)
+		}
+		gopt, _ := o.Options.(*gif.Options)
+		if gopt == nil {
+			gopt = &gif.Options{NumColors: 256}
+		}
+		if o.NumColors != 0 {
+			gopt = &gif.Options{NumColors: o.NumColors, Quantizer: gopt.Quantizer, Drawer: gopt.Drawer}
+		}
+		return gif.Encode(w, m, gopt)
+	})
+	RegisterEncoder("bmp", []string{".bmp"}, func(w io.Writer, m image.Image, o *EncodeOptions) error {
+		return bmp.Encode(w, m)
+	})
+	RegisterEncoder("tga", []string{".tga"}, func(w io.Writer, m image.Image, o *EncodeOptions) error {
+		if f, ok := o.Options.(*tga.File); ok {
+			return tga.EncodeFile(w, f, nil)
+		}
+		to, _ := o.Options.(*tga.Options)
+		return tga.Encode(w, m, to)
+	})
+	for i, ext := range []string{".pbm", ".pgm", ".ppm", ".pam"} {
+		format := 4 + i
+		if ext == ".pam" {
+			format = 7
+		}
+		RegisterEncoder(ext[1:], []string{ext}, func(w io.Writer, m image.Image, o *EncodeOptions) error {
+			po, _ := o.Options.(*pnm.Options)
+			if po == nil {
+				po = &pnm.Options{Format: format}
+			}
+			return pnm.Encode(w, m, po)
+		})
+	}
+	RegisterEncoder("pfm", []string{".pfm"}, func(w io.Writer, m image.Image, o *EncodeOptions) error {
+		po, _ := o.Options.(*pnm.PFMOptions)
+		return pnm.EncodePFM(w, m, po)
+	})
+	for i, name := range []string{"ico", "cur"} {
+		typ := ico.TYPE_ICO + i
+		RegisterEncoder(name, []string{"." + name}, func(w io.Writer, m image.Image, o *EncodeOptions) error {
+			f, ok := o.Options.(*ico.File)
+			if !ok {
+				f = &ico.File{Type: typ, Image: []image.Image{m}}
+			}
+			iopt, _ := o.Options.(*ico.Options)
+			return ico.Encode(w, f, iopt)
+		})
+	}
+	RegisterEncoder("psd", []string{".psd"}, func(w io.Writer, m image.Image, o *EncodeOptions) error {
+		if doc, ok := o.Options.(*psd.Document); ok {
+			return psd.EncodeDocument(w, doc)
+		}
+		return psd.Encode(w, m)
+	})
+	RegisterEncoder("dds", []string{".dds"}, func(w io.Writer, m image.Image, o *EncodeOptions) error {
+		if f, ok := o.Options.(*dds.File); ok {
+			return dds.EncodeFile(w, f)
+		}
+		do, _ := o.Options.(*dds.Options)
+		return dds.Encode(w, m, do)
+	})
+	for i, name := range []string{"ktx", "ktx2"} {
+		version := 1 + i
+		RegisterEncoder(name, []string{"." + name}, func(w io.Writer, m image.Image, o *EncodeOptions) error {
+			if f, ok := o.Options.(*ktx.File); ok {
+				return ktx.EncodeFile(w, f)
+			}
+			ko, _ := o.Options.(*ktx.Options)
+			if ko == nil {
+				ko = &ktx.Options{Version: version}
+			}
+			return ktx.Encode(w, m, ko)
+		})
+	}
+	RegisterEncoder("hdr", []string{".hdr", ".pic"}, func(w io.Writer, m image.Image, o *EncodeOptions) error {
+		ho, _ := o.Options.(*hdr.Options)
+		return hdr.Encode(w, m, ho)
+	})
+	RegisterEncoder("pcx", []string{".pcx"}, func(w io.Writer, m image.Image, o *EncodeOptions) error {
+		po, _ := o.Options.(*pcx.Options)
+		return pcx.Encode(w, m, po)
+	})
+	RegisterEncoder("qoi", []string{".qoi"}, func(w io.Writer, m image.Image, o *EncodeOptions) error {
+		qo, _ := o.Options.(*qoi.Options)
+		return qoi.Encode(w, m, qo)
+	})
+	RegisterEncoder("xpm", []string{".xpm"}, func(w io.Writer, m image.Image, o *EncodeOptions) error {
+		xo, _ := o.Options.(*xpm.Options)
+		return xpm.Encode(w, m, xo)
+	})
+	RegisterEncoder("xbm", []string{".xbm"}, func(w io.Writer, m image.Image, o *EncodeOptions) error {
+		xo, _ := o.Options.(*xpm.XBMOptions)
+		return xpm.EncodeXBM(w, m, xo)
+	})
+}
@@ -3,7 +3,6 @@ package imageutil
 import (
 	"image"
 	"image/color"
-	"image/draw"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
@@ -12,9 +11,15 @@ import (
 	"path/filepath"
 	"strings"
 
+	_ "github.com/qeedquan/go-media/image/dds"
+	_ "github.com/qeedquan/go-media/image/hdr"
+	_ "github.com/qeedquan/go-media/image/ktx"
+	_ "github.com/qeedquan/go-media/image/pcx"
 	"github.com/qeedquan/go-media/image/pnm"
 	_ "github.com/qeedquan/go-media/image/psd"
+	_ "github.com/qeedquan/go-media/image/qoi"
 	"github.com/qeedquan/go-media/image/tga"
+	_ "github.com/qeedquan/go-media/image/xpm"
 	"github.com/qeedquan/go-media/xio"
 	"golang.org/x/image/bmp"
 )
@@ -48,14 +53,7 @@ func LoadRGBAReader(rd io.Reader) (*image.RGBA, error) {
 		return nil, err
 	}
 
-	if p, _ := m.(*image.RGBA); p != nil {
-		return p, nil
-	}
-
-	r := m.Bounds()
-	p := image.NewRGBA(r)
-	draw.Draw(p, p.Bounds(), m, r.Min, draw.Src)
-	return p, nil
+	return ToRGBA(m), nil
 }
 
 func LoadGrayFile(name string) (*image.Gray, error) {
@@ -78,14 +76,7 @@ func LoadGrayReader(rd io.Reader) (*image.Gray, error) {
 		return nil, err
 	}
 
-	if p, _ := m.(*image.Gray); p != nil {
-		return p, nil
-	}
-
-	r := m.Bounds()
-	p := image.NewGray(r)
-	draw.Draw(p, p.Bounds(), m, r.Min, draw.Src)
-	return p, nil
+	return ToGray(m), nil
 }
 
 func WriteRGBAFile(name string, img image.Image) error {
@@ -109,7 +100,7 @@ func WriteRGBAFile(name string, img image.Image) error {
 			NumColors: 256,
 		})
 	case ".tga":
-		err = tga.Encode(f, img)
+		err = tga.Encode(f, img, nil)
 	case ".bmp":
 		err = bmp.Encode(f, img)
 	case ".png":
@@ -125,59 +116,41 @@ func WriteRGBAFile(name string, img image.Image) error {
 	return err
 }
 
+// ColorKey returns a copy of the image where the pixels
+// with the color of c ignoring alpha are transparent
 func ColorKey(m image.Image, c color.Color) *image.RGBA {
-	p := image.NewRGBA(m.Bounds())
-	b := p.Bounds()
-
-	cr, cg, cb, _ := c.RGBA()
-	for y := b.Min.Y; y < b.Max.Y; y++ {
-		for x := b.Min.X; x < b.Max.X; x++ {
-			col := m.At(x, y)
-			r, g, b, _ := col.RGBA()
-			if cr == r && cg == g && cb == b {
-				p.Set(x, y, color.Transparent)
-			} else {
-				p.Set(x, y, col)
+	r := m.Bounds()
+	p := image.NewRGBA(r)
+	read := rowReader(m, false)
+
+	k := color.NRGBAModel.Convert(c).(color.NRGBA)
+	row := make([]byte, r.Dx()*4)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		read(row, r.Min.X, y)
+		for i := 0; i < len(row); i += 4 {
+			if row[i] == k.R && row[i+1] == k.G && row[i+2] == k.B {
+				row[i], row[i+1], row[i+2], row[i+3] = 0, 0, 0, 0
 			}
 		}
+		premultiply(row)
+		copy(p.Pix[(y-r.Min.Y)*p.Stride:], row)
 	}
 	return p
 }
 
+// Equals compares the images as 8 bit premultiplied colors
 func Equals(a, b image.Image) bool {
-	r := a.Bounds()
-	s := b.Bounds()
-
-	if r.Dx() != s.Dx() || r.Dy() != s.Dy() {
-		return false
-	}
-
-	for y := 0; y < r.Dy(); y++ {
-		for x := 0; x < r.Dx(); x++ {
-			ax := x + r.Min.X
-			ay := y + r.Min.Y
-			bx := x + s.Min.X
-			by := y + s.Min.Y
-
-			u := a.At(ax, ay)
-			v := b.At(bx, by)
-
-			c := color.RGBAModel.Convert(u).(color.RGBA)
-			d := color.RGBAModel.Convert(v).(color.RGBA)
-			if c != d {
-				return false
-			}
-		}
-	}
-	return true
+	return EqualsTolerance(a, b, 0)
 }
 
 func IsTransparent(m image.Image) bool {
 	r := m.Bounds()
+	read := rowReader(m, true)
+	row := make([]byte, r.Dx()*4)
 	for y := r.Min.Y; y < r.Max.Y; y++ {
-		for x := r.Min.X; x < r.Max.X; x++ {
-			_, _, _, ca := m.At(x, y).RGBA()
-			if ca != 0 {
+		read(row, r.Min.X, y)
+		for i := 3; i < len(row); i += 4 {
+			if row[i] != 0 {
 				return false
 			}
 		}
@@ -0,0 +1,47 @@
+package parallel
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Bands splits n rows into bands small enough to balance the load
+// and runs work on each worker until all the bands are taken,
+// zero workers uses GOMAXPROCS
+func Bands(n, workers int, work func(bands <-chan [2]int)) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	size := (n + workers*4 - 1) / (workers * 4)
+	if size < 8 {
+		size = 8
+	}
+	bands := make(chan [2]int, (n+size-1)/size)
+	for y := 0; y < n; y += size {
+		end := y + size
+		if end > n {
+			end = n
+		}
+		bands <- [2]int{y, end}
+	}
+	close(bands)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < cap(bands); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			work(bands)
+		}()
+	}
+	wg.Wait()
+}
+
+// For is like Bands with fn called for the range of every band
+func For(n, workers int, fn func(lo, hi int)) {
+	Bands(n, workers, func(bands <-chan [2]int) {
+		for b := range bands {
+			fn(b[0], b[1])
+		}
+	})
+}
@@ -0,0 +1,238 @@
+package ktx
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// opengl enums used by ktx1
+const (
+	GL_UNSIGNED_BYTE   = 0x1401
+	GL_UNSIGNED_SHORT  = 0x1403
+	GL_RED             = 0x1903
+	GL_ALPHA           = 0x1906
+	GL_RGB             = 0x1907
+	GL_RGBA            = 0x1908
+	GL_LUMINANCE       = 0x1909
+	GL_LUMINANCE_ALPHA = 0x190a
+	GL_BGR             = 0x80e0
+	GL_BGRA            = 0x80e1
+	GL_RG              = 0x8227
+	GL_RGBA8           = 0x8058
+)
+
+// vulkan formats used by ktx2
+const (
+	VK_FORMAT_UNDEFINED          = 0
+	VK_FORMAT_R8_UNORM           = 9
+	VK_FORMAT_R8_SRGB            = 15
+	VK_FORMAT_R8G8_UNORM         = 16
+	VK_FORMAT_R8G8_SRGB          = 22
+	VK_FORMAT_R8G8B8_UNORM       = 23
+	VK_FORMAT_R8G8B8_SRGB        = 29
+	VK_FORMAT_B8G8R8_UNORM       = 30
+	VK_FORMAT_B8G8R8_SRGB        = 36
+	VK_FORMAT_R8G8B8A8_UNORM     = 37
+	VK_FORMAT_R8G8B8A8_SRGB      = 43
+	VK_FORMAT_B8G8R8A8_UNORM     = 44
+	VK_FORMAT_B8G8R8A8_SRGB      = 50
+	VK_FORMAT_R16_UNORM          = 70
+	VK_FORMAT_R16G16B16A16_UNORM = 91
+)
+
+// layout describes uncompressed pixels, the order names the channel
+// stored in each position and bpc is the number of bytes per channel
+type layout struct {
+	order string
+	bpc   int
+}
+
+func (l layout) bpp() int { return len(l.order) * l.bpc }
+
+func glLayout(typ, format uint32) (layout, bool) {
+	bpc := 1
+	switch typ {
+	case GL_UNSIGNED_BYTE:
+	case GL_UNSIGNED_SHORT:
+		bpc = 2
+	default:
+		return layout{}, false
+	}
+
+	order := map[uint32]string{
+		GL_RED:             "R",
+		GL_ALPHA:           "A",
+		GL_RGB:             "RGB",
+		GL_RGBA:            "RGBA",
+		GL_LUMINANCE:       "L",
+		GL_LUMINANCE_ALPHA: "LA",
+		GL_BGR:             "BGR",
+		GL_BGRA:            "BGRA",
+		GL_RG:              "RG",
+	}[format]
+	return layout{order, bpc}, order != ""
+}
+
+func vkLayout(format uint32) (layout, bool) {
+	switch format {
+	case VK_FORMAT_R8_UNORM, VK_FORMAT_R8_SRGB:
+		return layout{"R", 1}, true
+	case VK_FORMAT_R8G8_UNORM, VK_FORMAT_R8G8_SRGB:
+		return layout{"RG", 1}, true
+	case VK_FORMAT_R8G8B8_UNORM, VK_FORMAT_R8G8B8_SRGB:
+		return layout{"RGB", 1}, true
+	case VK_FORMAT_B8G8R8_UNORM, VK_FORMAT_B8G8R8_SRGB:
+		return layout{"BGR", 1}, true
+	case VK_FORMAT_R8G8B8A8_UNORM, VK_FORMAT_R8G8B8A8_SRGB:
+		return layout{"RGBA", 1}, true
+	case VK_FORMAT_B8G8R8A8_UNORM, VK_FORMAT_B8G8R8A8_SRGB:
+		return layout{"BGRA", 1}, true
+	case VK_FORMAT_R16_UNORM:
+		return layout{"R", 2}, true
+	case VK_FORMAT_R16G16B16A16_UNORM:
+		return layout{"RGBA", 2}, true
+	}
+	return layout{}, false
+}
+
+func (l layout) colorModel() color.Model {
+	switch l.order {
+	case "R", "L":
+		if l.bpc == 2 {
+			return color.Gray16Model
+		}
+		return color.GrayModel
+	case "A":
+		if l.bpc == 2 {
+			return color.Alpha16Model
+		}
+		return color.AlphaModel
+	}
+	if l.bpc == 2 {
+		return color.NRGBA64Model
+	}
+	return color.NRGBAModel
+}
+
+// decode converts the pixels of one image, samples are little endian
+func (l layout) decode(b []byte, w, h, stride int) image.Image {
+	r := image.Rect(0, 0, w, h)
+	sample := func(p []byte, i int) uint16 {
+		if l.bpc == 2 {
+			return binary.LittleEndian.Uint16(p[i*2:])
+		}
+		return uint16(p[i]) * 0x101
+	}
+
+	var m image.Image
+	switch l.colorModel() {
+	case color.GrayModel:
+		g := image.NewGray(r)
+		for y := 0; y < h; y++ {
+			copy(g.Pix[y*g.Stride:], b[y*stride:y*stride+w])
+		}
+		return g
+	case color.AlphaModel:
+		a := image.NewAlpha(r)
+		for y := 0; y < h; y++ {
+			copy(a.Pix[y*a.Stride:], b[y*stride:y*stride+w])
+		}
+		return a
+	case color.Gray16Model:
+		g := image.NewGray16(r)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				g.SetGray16(x, y, color.Gray16{sample(b[y*stride:], x)})
+			}
+		}
+		return g
+	case color.Alpha16Model:
+		a := image.NewAlpha16(r)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				a.SetAlpha16(x, y, color.Alpha16{sample(b[y*stride:], x)})
+			}
+		}
+		return a
+	case color.NRGBA64Model:
+		m = image.NewNRGBA64(r)
+	default:
+		m = image.NewNRGBA(r)
+	}
+
+	n := len(l.order)
+	for y := 0; y < h; y++ {
+		row := b[y*stride:]
+		for x := 0; x < w; x++ {
+			c := color.NRGBA64{A: 0xffff}
+			for i, ch := range l.order {
+				v := sample(row, x*n+i)
+				switch ch {
+				case 'R':
+					c.R = v
+				case 'G':
+					c.G = v
+				case 'B':
+					c.B = v
+				case 'A':
+					c.A = v
+				case 'L':
+					c.R, c.G, c.B = v, v, v
+				}
+			}
+			switch m := m.(type) {
+			case *image.NRGBA:
+				m.SetNRGBA(x, y, color.NRGBA{uint8(c.R >> 8), uint8(c.G >> 8), uint8(c.B >> 8), uint8(c.A >> 8)})
+			case *image.NRGBA64:
+				m.SetNRGBA64(x, y, c)
+			}
+		}
+	}
+	return m
+}
+
+// rgbaDFD builds the data format descriptor for VK_FORMAT_R8G8B8A8_UNORM
+func rgbaDFD() []byte {
+	const samples = 4
+	size := 4 + 24 + 16*samples
+	b := make([]byte, size)
+	put := func(i int, v uint32) {
+		binary.LittleEndian.PutUint32(b[i*4:], v)
+	}
+
+	put(0, uint32(size))
+	put(1, 0)
+	put(2, 2|uint32(24+16*samples)<<16)
+
+	// rgbsda color model, bt709 primaries, linear transfer, straight alpha
+	put(3, 1|1<<8|1<<16)
+	put(4, 0)
+	put(5, 4)
+	put(6, 0)
+	for i, ch := range []uint32{0, 1, 2, 15} {
+		put(7+i*4, uint32(i*8)|7<<16|ch<<24)
+		put(8+i*4, 0)
+		put(9+i*4, 0)
+		put(10+i*4, 255)
+	}
+	return b
+}
+
+// texelBlockSize reads the bytes per texel block from a basic
+// data format descriptor, unknown descriptors return 1
+func texelBlockSize(dfd []byte) int {
+	if len(dfd) < 24 {
+		return 1
+	}
+	n := int(dfd[4+16])
+	if n == 0 {
+		return 1
+	}
+	return n
+}
+
+func formatError(format string, v uint32) error {
+	return fmt.Errorf("ktx: unsupported %s format %#x for conversion", format, v)
+}
@@ -0,0 +1,487 @@
+package ktx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	ktx1Header = "\xabKTX 11\xbb\r\n\x1a\n"
+	ktx2Header = "\xabKTX 20\xbb\r\n\x1a\n"
+)
+
+type header1 struct {
+	Endianness            uint32
+	GLType                uint32
+	GLTypeSize            uint32
+	GLFormat              uint32
+	GLInternalFormat      uint32
+	GLBaseInternalFormat  uint32
+	PixelWidth            uint32
+	PixelHeight           uint32
+	PixelDepth            uint32
+	NumberOfArrayElements uint32
+	NumberOfFaces         uint32
+	NumberOfMipmapLevels  uint32
+	BytesOfKeyValueData   uint32
+}
+
+type header2 struct {
+	VkFormat               uint32
+	TypeSize               uint32
+	PixelWidth             uint32
+	PixelHeight            uint32
+	PixelDepth             uint32
+	LayerCount             uint32
+	FaceCount              uint32
+	LevelCount             uint32
+	SupercompressionScheme uint32
+	DFDByteOffset          uint32
+	DFDByteLength          uint32
+	KVDByteOffset          uint32
+	KVDByteLength          uint32
+	SGDByteOffset          uint64
+	SGDByteLength          uint64
+}
+
+type levelIndex struct {
+	ByteOffset             uint64
+	ByteLength             uint64
+	UncompressedByteLength uint64
+}
+
+// File is a texture container, the image data is kept as it is
+// stored so compressed and supercompressed formats are preserved
+type File struct {
+	// Version is 1 or 2, zero is written as 2
+	Version int
+
+	// opengl format of ktx1 files
+	GLType               uint32
+	GLTypeSize           uint32
+	GLFormat             uint32
+	GLInternalFormat     uint32
+	GLBaseInternalFormat uint32
+
+	// vulkan format of ktx2 files with the data format descriptor
+	// and supercompression global data stored as is
+	VkFormat         uint32
+	TypeSize         uint32
+	Supercompression uint32
+	DFD              []byte
+	SGD              []byte
+
+	Width  int
+	Height int
+	Depth  int
+
+	// Layers is zero if the texture is not an array
+	Layers int
+	Faces  int
+
+	// AutoMipmaps is set when the file asks for the
+	// mipmaps to be generated after loading level 0
+	AutoMipmaps bool
+
+	KeyValue []KeyValue
+	Levels   []Level
+}
+
+// KeyValue is a metadata entry, string values include
+// their terminating nul byte like the format requires
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// Level holds every layer, face and depth slice of a mip level in that
+// order, ktx1 rows of uncompressed formats are padded to 4 bytes
+type Level struct {
+	Data []byte
+
+	// size of the data before supercompression, ktx2 only
+	UncompressedLength uint64
+}
+
+type decoder struct {
+	r   io.Reader
+	f   *File
+	h1  header1
+	h2  header2
+	buf []byte
+	big bool
+}
+
+func Decode(r io.Reader) (image.Image, error) {
+	f, err := DecodeFile(r)
+	if err != nil {
+		return nil, err
+	}
+	return f.Image(0, 0, 0)
+}
+
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	d := &decoder{r: r, f: &File{}}
+	err := d.decodeHeader()
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	var model color.Model = color.NRGBAModel
+	if l, ok := d.f.layout(); ok {
+		model = l.colorModel()
+	}
+	return image.Config{
+		ColorModel: model,
+		Width:      d.f.Width,
+		Height:     d.f.Height,
+	}, nil
+}
+
+func DecodeFile(r io.Reader) (*File, error) {
+	d := &decoder{r: r, f: &File{}}
+	err := d.decodeHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	if d.f.Version == 1 {
+		err = d.decode1()
+	} else {
+		err = d.decode2()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.f, nil
+}
+
+func (d *decoder) decodeHeader() error {
+	var id [12]byte
+	_, err := io.ReadFull(d.r, id[:])
+	if err != nil {
+		return errUnexpectedEOF(err)
+	}
+
+	f := d.f
+	switch string(id[:]) {
+	case ktx1Header:
+		f.Version = 1
+		err = binary.Read(d.r, binary.LittleEndian, &d.h1)
+		if err != nil {
+			return errUnexpectedEOF(err)
+		}
+		h := &d.h1
+		switch h.Endianness {
+		case 0x04030201:
+		case 0x01020304:
+			d.big = true
+			swap32(h)
+		default:
+			return errors.New("ktx: invalid endianness")
+		}
+
+		f.GLType = h.GLType
+		f.GLTypeSize = h.GLTypeSize
+		f.GLFormat = h.GLFormat
+		f.GLInternalFormat = h.GLInternalFormat
+		f.GLBaseInternalFormat = h.GLBaseInternalFormat
+		err = f.setDimensions(h.PixelWidth, h.PixelHeight, h.PixelDepth, h.NumberOfArrayElements, h.NumberOfFaces, h.NumberOfMipmapLevels)
+
+	case ktx2Header:
+		f.Version = 2
+		err = binary.Read(d.r, binary.LittleEndian, &d.h2)
+		if err != nil {
+			return errUnexpectedEOF(err)
+		}
+		h := &d.h2
+		f.VkFormat = h.VkFormat
+		f.TypeSize = h.TypeSize
+		f.Supercompression = h.SupercompressionScheme
+		err = f.setDimensions(h.PixelWidth, h.PixelHeight, h.PixelDepth, h.LayerCount, h.FaceCount, h.LevelCount)
+
+	default:
+		return errors.New("ktx: invalid identifier")
+	}
+	return err
+}
+
+func (f *File) setDimensions(w, h, depth, layers, faces, levels uint32) error {
+	const max = 1 << 16
+	if w < 1 || w > max || h > max || depth > max || layers > max {
+		return fmt.Errorf("ktx: invalid dimension %dx%dx%d with %d layers", w, h, depth, layers)
+	}
+	if faces != 1 && faces != 6 {
+		return fmt.Errorf("ktx: invalid number of faces %d", faces)
+	}
+	if levels > 32 {
+		return fmt.Errorf("ktx: invalid number of mip levels %d", levels)
+	}
+
+	f.Width, f.Height, f.Depth = int(w), int(h), int(depth)
+	f.Layers, f.Faces = int(layers), int(faces)
+	if levels == 0 {
+		f.AutoMipmaps = true
+		levels = 1
+	}
+	f.Levels = make([]Level, levels)
+	return nil
+}
+
+func (d *decoder) decode1() error {
+	f, h := d.f, &d.h1
+
+	kv, err := d.read(int64(h.BytesOfKeyValueData))
+	if err != nil {
+		return err
+	}
+	f.KeyValue, err = decodeKeyValue(kv, d.big)
+	if err != nil {
+		return err
+	}
+
+	// non array cube maps store the size of one face
+	cube := f.Layers == 0 && f.Faces == 6
+	for i := range f.Levels {
+		var size uint32
+		err = d.rb(&size)
+		if err != nil {
+			return errUnexpectedEOF(err)
+		}
+
+		var data []byte
+		if cube {
+			for j := 0; j < 6; j++ {
+				face, err := d.read(int64(size))
+				if err != nil {
+					return err
+				}
+				data = append(data, face...)
+				d.read(int64(pad(int(size), 4)))
+			}
+		} else {
+			data, err = d.read(int64(size))
+			if err != nil {
+				return err
+			}
+			d.read(int64(pad(int(size), 4)))
+		}
+
+		if d.big {
+			swapData(data, int(f.GLTypeSize))
+		}
+		f.Levels[i].Data = data
+	}
+	return nil
+}
+
+func (d *decoder) decode2() error {
+	f, h := d.f, &d.h2
+
+	index := make([]levelIndex, len(f.Levels))
+	err := d.rb(index)
+	if err != nil {
+		return errUnexpectedEOF(err)
+	}
+
+	// the rest of the file is addressed by offsets from the start
+	rest, err := ioutil.ReadAll(d.r)
+	if err != nil {
+		return err
+	}
+	base := uint64(12 + binary.Size(h) + binary.Size(index))
+	section := func(off, n uint64) ([]byte, error) {
+		if n == 0 {
+			return nil, nil
+		}
+		if off < base || off-base > uint64(len(rest)) || n > uint64(len(rest))-(off-base) {
+			return nil, errors.New("ktx: section out of bounds")
+		}
+		return rest[off-base : off-base+n], nil
+	}
+
+	f.DFD, err = section(uint64(h.DFDByteOffset), uint64(h.DFDByteLength))
+	if err != nil {
+		return err
+	}
+	kv, err := section(uint64(h.KVDByteOffset), uint64(h.KVDByteLength))
+	if err != nil {
+		return err
+	}
+	f.KeyValue, err = decodeKeyValue(kv, false)
+	if err != nil {
+		return err
+	}
+	f.SGD, err = section(h.SGDByteOffset, h.SGDByteLength)
+	if err != nil {
+		return err
+	}
+
+	for i, x := range index {
+		f.Levels[i].Data, err = section(x.ByteOffset, x.ByteLength)
+		if err != nil {
+			return err
+		}
+		f.Levels[i].UncompressedLength = x.UncompressedByteLength
+	}
+	return nil
+}
+
+func decodeKeyValue(b []byte, big bool) ([]KeyValue, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	if big {
+		order = binary.BigEndian
+	}
+
+	var kv []KeyValue
+	for len(b) >= 4 {
+		n := int(order.Uint32(b))
+		b = b[4:]
+		if n > len(b) {
+			return nil, errors.New("ktx: key value data out of bounds")
+		}
+		p := bytes.IndexByte(b[:n], 0)
+		if p < 0 {
+			return nil, errors.New("ktx: key is not terminated")
+		}
+		kv = append(kv, KeyValue{string(b[:p]), b[p+1 : n]})
+
+		n += pad(n, 4)
+		if n > len(b) {
+			break
+		}
+		b = b[n:]
+	}
+	return kv, nil
+}
+
+// Lookup returns the value of the first entry with the key
+func (f *File) Lookup(key string) ([]byte, bool) {
+	for _, kv := range f.KeyValue {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (f *File) layout() (layout, bool) {
+	if f.Version == 1 {
+		return glLayout(f.GLType, f.GLFormat)
+	}
+	if f.Supercompression != 0 {
+		return layout{}, false
+	}
+	return vkLayout(f.VkFormat)
+}
+
+// Image converts a 2d image of an uncompressed format
+func (f *File) Image(level, layer, face int) (image.Image, error) {
+	l, ok := f.layout()
+	if !ok {
+		if f.Version == 1 {
+			return nil, formatError("opengl", f.GLFormat)
+		}
+		return nil, formatError("vulkan", f.VkFormat)
+	}
+	if f.Depth > 1 {
+		return nil, errors.New("ktx: 3d textures can't be converted to images")
+	}
+	if level < 0 || level >= len(f.Levels) || layer < 0 || layer >= imax(f.Layers, 1) || face < 0 || face >= f.Faces {
+		return nil, fmt.Errorf("ktx: image %d/%d/%d out of range", level, layer, face)
+	}
+
+	w, h := mipSize(f.Width, level), mipSize(f.Height, level)
+	stride := w * l.bpp()
+	if f.Version == 1 {
+		stride += pad(stride, 4)
+	}
+	size := stride * h
+	off := (layer*f.Faces + face) * size
+	data := f.Levels[level].Data
+	if off+size > len(data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return l.decode(data[off:off+size], w, h, stride), nil
+}
+
+func mipSize(n, level int) int {
+	n >>= uint(level)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+func imax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// pad returns the bytes needed to align n to a multiple of a
+func pad(n, a int) int {
+	return (a - n%a) % a
+}
+
+func (d *decoder) rb(v interface{}) error {
+	return binary.Read(d.r, binary.LittleEndian, v)
+}
+
+func (d *decoder) read(n int64) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(d.r, n))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) != n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
+
+func swap32(h *header1) {
+	v := []*uint32{
+		&h.Endianness, &h.GLType, &h.GLTypeSize, &h.GLFormat, &h.GLInternalFormat,
+		&h.GLBaseInternalFormat, &h.PixelWidth, &h.PixelHeight, &h.PixelDepth,
+		&h.NumberOfArrayElements, &h.NumberOfFaces, &h.NumberOfMipmapLevels,
+		&h.BytesOfKeyValueData,
+	}
+	for _, p := range v {
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], *p)
+		*p = binary.BigEndian.Uint32(b[:])
+	}
+}
+
+// swapData converts big endian samples to little endian
+func swapData(b []byte, size int) {
+	switch size {
+	case 2:
+		for i := 0; i+1 < len(b); i += 2 {
+			b[i], b[i+1] = b[i+1], b[i]
+		}
+	case 4:
+		for i := 0; i+3 < len(b); i += 4 {
+			b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+		}
+	}
+}
+
+func errUnexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func init() {
+	image.RegisterFormat("ktx", ktx1Header, Decode, DecodeConfig)
+	image.RegisterFormat("ktx2", ktx2Header, Decode, DecodeConfig)
+}
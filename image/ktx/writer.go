@@ -0,0 +1,287 @@
+package ktx
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+type Options struct {
+	// Version selects ktx1 or ktx2, zero is ktx2
+	Version int
+}
+
+type encoder struct {
+	w   *bufio.Writer
+	f   *File
+	off int
+}
+
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	if o == nil {
+		o = &Options{}
+	}
+	return EncodeFile(w, NewFile(o.Version, m))
+}
+
+// NewFile makes a rgba8 texture with one mip level per image,
+// each level is expected to be half the size of the last
+func NewFile(version int, levels ...image.Image) *File {
+	if version == 0 {
+		version = 2
+	}
+	f := &File{Version: version}
+	if version == 1 {
+		f.GLType = GL_UNSIGNED_BYTE
+		f.GLTypeSize = 1
+		f.GLFormat = GL_RGBA
+		f.GLInternalFormat = GL_RGBA8
+		f.GLBaseInternalFormat = GL_RGBA
+	} else {
+		f.VkFormat = VK_FORMAT_R8G8B8A8_UNORM
+		f.TypeSize = 1
+		f.DFD = rgbaDFD()
+	}
+	f.Faces = 1
+
+	for i, m := range levels {
+		r := m.Bounds()
+		if i == 0 {
+			f.Width, f.Height = r.Dx(), r.Dy()
+		}
+		f.Levels = append(f.Levels, Level{Data: rgba(m)})
+	}
+	return f
+}
+
+// rgba stores the pixels as straight alpha with rows packed
+// tightly, 4 bytes per pixel is already aligned for ktx1
+func rgba(m image.Image) []byte {
+	r := m.Bounds()
+	b := make([]byte, 0, r.Dx()*r.Dy()*4)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			var c color.NRGBA
+			if n, ok := m.(*image.NRGBA); ok {
+				c = n.NRGBAAt(x, y)
+			} else {
+				c = color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			}
+			b = append(b, c.R, c.G, c.B, c.A)
+		}
+	}
+	return b
+}
+
+// EncodeFile writes the container as it is described, the level
+// data is not converted so it must already match the format
+func EncodeFile(w io.Writer, f *File) error {
+	e := &encoder{
+		w: bufio.NewWriter(w),
+		f: f,
+	}
+	err := e.check()
+	if err != nil {
+		return err
+	}
+
+	if f.Version == 1 {
+		e.encode1()
+	} else {
+		e.encode2()
+	}
+
+	err = e.w.Flush()
+	if err != nil {
+		return fmt.Errorf("ktx: %v", err)
+	}
+	return nil
+}
+
+func (e *encoder) check() error {
+	f := e.f
+	switch f.Version {
+	case 0, 2:
+	case 1:
+		if f.Layers == 0 && f.Faces == 6 {
+			for i, l := range f.Levels {
+				if len(l.Data)%6 != 0 {
+					return fmt.Errorf("ktx: cube map level %d is not divisible into faces", i)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("ktx: unsupported version %d", f.Version)
+	}
+
+	if f.Width < 1 || f.Height < 0 || f.Depth < 0 || f.Layers < 0 {
+		return fmt.Errorf("ktx: invalid dimension %dx%dx%d with %d layers", f.Width, f.Height, f.Depth, f.Layers)
+	}
+	if f.Faces != 1 && f.Faces != 6 {
+		return fmt.Errorf("ktx: invalid number of faces %d", f.Faces)
+	}
+	if len(f.Levels) == 0 {
+		return errors.New("ktx: no mip levels to encode")
+	}
+	if f.AutoMipmaps && len(f.Levels) != 1 {
+		return errors.New("ktx: generated mipmaps require a single level")
+	}
+	return nil
+}
+
+func (e *encoder) levelCount() uint32 {
+	if e.f.AutoMipmaps {
+		return 0
+	}
+	return uint32(len(e.f.Levels))
+}
+
+func (e *encoder) encode1() {
+	f := e.f
+	kv := encodeKeyValue(f.KeyValue)
+	h := header1{
+		Endianness:            0x04030201,
+		GLType:                f.GLType,
+		GLTypeSize:            f.GLTypeSize,
+		GLFormat:              f.GLFormat,
+		GLInternalFormat:      f.GLInternalFormat,
+		GLBaseInternalFormat:  f.GLBaseInternalFormat,
+		PixelWidth:            uint32(f.Width),
+		PixelHeight:           uint32(f.Height),
+		PixelDepth:            uint32(f.Depth),
+		NumberOfArrayElements: uint32(f.Layers),
+		NumberOfFaces:         uint32(f.Faces),
+		NumberOfMipmapLevels:  e.levelCount(),
+		BytesOfKeyValueData:   uint32(len(kv)),
+	}
+	e.w.WriteString(ktx1Header)
+	e.wb(&h)
+	e.w.Write(kv)
+
+	cube := f.Layers == 0 && f.Faces == 6
+	for _, l := range f.Levels {
+		if cube {
+			n := len(l.Data) / 6
+			e.wb(uint32(n))
+			for i := 0; i < 6; i++ {
+				e.w.Write(l.Data[i*n : (i+1)*n])
+				e.zero(pad(n, 4))
+			}
+		} else {
+			e.wb(uint32(len(l.Data)))
+			e.w.Write(l.Data)
+			e.zero(pad(len(l.Data), 4))
+		}
+	}
+}
+
+func (e *encoder) encode2() {
+	f := e.f
+	kv := encodeKeyValue(f.KeyValue)
+	index := make([]levelIndex, len(f.Levels))
+	h := header2{
+		VkFormat:               f.VkFormat,
+		TypeSize:               f.TypeSize,
+		PixelWidth:             uint32(f.Width),
+		PixelHeight:            uint32(f.Height),
+		PixelDepth:             uint32(f.Depth),
+		LayerCount:             uint32(f.Layers),
+		FaceCount:              uint32(f.Faces),
+		LevelCount:             e.levelCount(),
+		SupercompressionScheme: f.Supercompression,
+	}
+
+	// lay out the sections after the header and level index
+	off := 12 + binary.Size(&h) + binary.Size(index)
+	if len(f.DFD) > 0 {
+		h.DFDByteOffset = uint32(off)
+		h.DFDByteLength = uint32(len(f.DFD))
+		off += len(f.DFD)
+	}
+	if len(kv) > 0 {
+		off += pad(off, 4)
+		h.KVDByteOffset = uint32(off)
+		h.KVDByteLength = uint32(len(kv))
+		off += len(kv)
+	}
+	if len(f.SGD) > 0 {
+		off += pad(off, 8)
+		h.SGDByteOffset = uint64(off)
+		h.SGDByteLength = uint64(len(f.SGD))
+		off += len(f.SGD)
+	}
+
+	// levels are stored from the smallest to the largest
+	align := 1
+	if f.Supercompression == 0 {
+		align = lcm(texelBlockSize(f.DFD), 4)
+	}
+	for i := len(f.Levels) - 1; i >= 0; i-- {
+		l := &f.Levels[i]
+		off += pad(off, align)
+		index[i].ByteOffset = uint64(off)
+		index[i].ByteLength = uint64(len(l.Data))
+		index[i].UncompressedByteLength = l.UncompressedLength
+		if f.Supercompression == 0 {
+			index[i].UncompressedByteLength = uint64(len(l.Data))
+		}
+		off += len(l.Data)
+	}
+
+	e.w.WriteString(ktx2Header)
+	e.wb(&h)
+	e.wb(index)
+	e.off = 12 + binary.Size(&h) + binary.Size(index)
+	e.section(int(h.DFDByteOffset), f.DFD)
+	e.section(int(h.KVDByteOffset), kv)
+	e.section(int(h.SGDByteOffset), f.SGD)
+	for i := len(f.Levels) - 1; i >= 0; i-- {
+		e.section(int(index[i].ByteOffset), f.Levels[i].Data)
+	}
+}
+
+// section pads up to the offset of the data and writes it
+func (e *encoder) section(off int, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	e.zero(off - e.off)
+	e.w.Write(b)
+	e.off = off + len(b)
+}
+
+func encodeKeyValue(kv []KeyValue) []byte {
+	var b []byte
+	for _, x := range kv {
+		n := len(x.Key) + 1 + len(x.Value)
+		b = append(b, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(n))
+		b = append(b, x.Key...)
+		b = append(b, 0)
+		b = append(b, x.Value...)
+		b = append(b, make([]byte, pad(n, 4))...)
+	}
+	return b
+}
+
+func (e *encoder) wb(v interface{}) {
+	binary.Write(e.w, binary.LittleEndian, v)
+}
+
+func (e *encoder) zero(n int) {
+	for ; n > 0; n-- {
+		e.w.WriteByte(0)
+	}
+}
+
+func lcm(a, b int) int {
+	x, y := a, b
+	for y != 0 {
+		x, y = y, x%y
+	}
+	return a / x * b
+}
@@ -0,0 +1,285 @@
+package pcx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+)
+
+type header struct {
+	Manufacturer uint8
+	Version      uint8
+	Encoding     uint8
+	Bpp          uint8
+	Xmin         uint16
+	Ymin         uint16
+	Xmax         uint16
+	Ymax         uint16
+	HDpi         uint16
+	VDpi         uint16
+	Colormap     [48]uint8
+	Reserved     uint8
+	Planes       uint8
+	BytesPerLine uint16
+	PaletteInfo  uint16
+	HScreenSize  uint16
+	VScreenSize  uint16
+	Filler       [54]uint8
+}
+
+// the 256 color palette is appended after the image data
+const (
+	vgaPaletteMarker = 0x0c
+	vgaPaletteSize   = 1 + 256*3
+)
+
+type decoder struct {
+	header
+	r       io.Reader
+	w, h    int
+	palette color.Palette
+}
+
+func Decode(r io.Reader) (image.Image, error) {
+	d := &decoder{r: r}
+	err := d.decodeHeader()
+	if err != nil {
+		return nil, err
+	}
+	return d.decode()
+}
+
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	d := &decoder{r: r}
+	err := d.decodeHeader()
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	var model color.Model
+	switch {
+	case d.Planes == 3:
+		model = color.RGBAModel
+	case d.Planes == 4 && d.Bpp == 8:
+		model = color.NRGBAModel
+	case d.Bpp == 8:
+		// the palette is at the end of the file
+		buf, err := ioutil.ReadAll(d.r)
+		if err != nil {
+			return image.Config{}, fmt.Errorf("pcx: %v", err)
+		}
+		d.vgaPalette(buf)
+		model = d.palette
+	default:
+		model = d.headerPalette()
+	}
+
+	return image.Config{
+		ColorModel: model,
+		Width:      d.w,
+		Height:     d.h,
+	}, nil
+}
+
+func (d *decoder) decodeHeader() error {
+	err := binary.Read(d.r, binary.LittleEndian, &d.header)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("pcx: %v", err)
+	}
+
+	if d.Manufacturer != 0x0a {
+		return errors.New("pcx: invalid signature")
+	}
+	if d.Encoding > 1 {
+		return fmt.Errorf("pcx: unsupported encoding %d", d.Encoding)
+	}
+	if d.Xmax < d.Xmin || d.Ymax < d.Ymin {
+		return fmt.Errorf("pcx: invalid window %d,%d-%d,%d", d.Xmin, d.Ymin, d.Xmax, d.Ymax)
+	}
+	d.w = int(d.Xmax) - int(d.Xmin) + 1
+	d.h = int(d.Ymax) - int(d.Ymin) + 1
+
+	switch {
+	case d.Bpp == 1 && 1 <= d.Planes && d.Planes <= 4:
+	case (d.Bpp == 2 || d.Bpp == 4) && d.Planes == 1:
+	case d.Bpp == 8 && (d.Planes == 1 || d.Planes == 3 || d.Planes == 4):
+	default:
+		return fmt.Errorf("pcx: unsupported %d bits per pixel with %d planes", d.Bpp, d.Planes)
+	}
+	if int(d.BytesPerLine)*8 < d.w*int(d.Bpp) {
+		return fmt.Errorf("pcx: %d bytes per line is too small for width %d", d.BytesPerLine, d.w)
+	}
+	return nil
+}
+
+// headerPalette returns the colors stored in the header, one bit
+// images without a palette in the header are black and white
+func (d *decoder) headerPalette() color.Palette {
+	n := 1 << (uint(d.Bpp) * uint(d.Planes))
+	p := make(color.Palette, n)
+	for i := range p {
+		c := d.Colormap[i*3:]
+		p[i] = color.RGBA{c[0], c[1], c[2], 0xff}
+	}
+
+	if n == 2 && p[0] == p[1] {
+		p[0] = color.RGBA{0, 0, 0, 0xff}
+		p[1] = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	}
+	return p
+}
+
+func (d *decoder) decode() (image.Image, error) {
+	buf, err := ioutil.ReadAll(d.r)
+	if err != nil {
+		return nil, fmt.Errorf("pcx: %v", err)
+	}
+
+	vga := d.Bpp == 8 && d.Planes == 1
+	if vga {
+		buf = d.vgaPalette(buf)
+	} else if d.Planes*d.Bpp <= 4 {
+		d.palette = d.headerPalette()
+	}
+
+	// rle runs are allowed to cross lines and planes
+	// so the whole image is unpacked at once
+	stride := int(d.BytesPerLine) * int(d.Planes)
+
+	// two bytes of rle data unpack to at most 63 bytes, checking
+	// first keeps a short file from allocating a huge image
+	limit := len(buf)
+	if d.Encoding == 1 {
+		limit = (len(buf) + 1) / 2 * 63
+	}
+	if stride*d.h > limit {
+		return nil, fmt.Errorf("pcx: %v", io.ErrUnexpectedEOF)
+	}
+
+	pix := make([]byte, stride*d.h)
+	if d.Encoding == 1 {
+		err = unpack(pix, buf)
+	} else {
+		copy(pix, buf)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("pcx: %v", err)
+	}
+
+	r := image.Rect(0, 0, d.w, d.h)
+	bpl := int(d.BytesPerLine)
+	switch {
+	case d.Bpp == 8 && d.Planes >= 3:
+		var (
+			m   image.Image
+			p   []byte
+			pst int
+		)
+		if d.Planes == 4 {
+			n := image.NewNRGBA(r)
+			m, p, pst = n, n.Pix, n.Stride
+		} else {
+			n := image.NewRGBA(r)
+			m, p, pst = n, n.Pix, n.Stride
+		}
+		for y := 0; y < d.h; y++ {
+			line := pix[y*stride:]
+			for x := 0; x < d.w; x++ {
+				o := y*pst + x*4
+				p[o], p[o+1], p[o+2], p[o+3] = line[x], line[bpl+x], line[2*bpl+x], 0xff
+				if d.Planes == 4 {
+					p[o+3] = line[3*bpl+x]
+				}
+			}
+		}
+		return m, nil
+
+	case vga:
+		m := image.NewPaletted(r, d.palette)
+		for y := 0; y < d.h; y++ {
+			copy(m.Pix[y*m.Stride:], pix[y*stride:y*stride+d.w])
+		}
+		return m, nil
+
+	default:
+		m := image.NewPaletted(r, d.palette)
+		bpp, planes := uint(d.Bpp), int(d.Planes)
+		for y := 0; y < d.h; y++ {
+			line := pix[y*stride:]
+			for x := 0; x < d.w; x++ {
+				var v uint8
+				if planes == 1 {
+					// chunky pixels packed from the high bit
+					s := uint(x) * bpp
+					v = line[s/8] >> (8 - bpp - s%8) & (1<<bpp - 1)
+				} else {
+					// one bit from each plane
+					for p := 0; p < planes; p++ {
+						b := line[p*bpl+x/8] >> (7 - uint(x%8)) & 1
+						v |= b << uint(p)
+					}
+				}
+				m.Pix[y*m.Stride+x] = v
+			}
+		}
+		return m, nil
+	}
+}
+
+// vgaPalette finds the 256 color palette by its marker at the end of the file
+// and returns the image data before it, files without one are grayscale
+func (d *decoder) vgaPalette(buf []byte) []byte {
+	d.palette = make(color.Palette, 256)
+	n := len(buf) - vgaPaletteSize
+	if n >= 0 && buf[n] == vgaPaletteMarker {
+		for i := range d.palette {
+			c := buf[n+1+i*3:]
+			d.palette[i] = color.RGBA{c[0], c[1], c[2], 0xff}
+		}
+		return buf[:n]
+	}
+
+	for i := range d.palette {
+		d.palette[i] = color.RGBA{uint8(i), uint8(i), uint8(i), 0xff}
+	}
+	return buf
+}
+
+// unpack expands the rle data into b, a byte with the two high bits
+// set repeats the next byte by the count in the low six bits
+func unpack(b, src []byte) error {
+	r := bytes.NewReader(src)
+	for i := 0; i < len(b); {
+		c, err := r.ReadByte()
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+
+		n := 1
+		if c&0xc0 == 0xc0 {
+			n = int(c & 0x3f)
+			c, err = r.ReadByte()
+			if err != nil {
+				return io.ErrUnexpectedEOF
+			}
+		}
+		for ; n > 0 && i < len(b); n-- {
+			b[i] = c
+			i++
+		}
+	}
+	return nil
+}
+
+func init() {
+	image.RegisterFormat("pcx", "\x0a?\x01", Decode, DecodeConfig)
+	image.RegisterFormat("pcx", "\x0a?\x00", Decode, DecodeConfig)
+}
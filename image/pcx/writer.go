@@ -0,0 +1,232 @@
+package pcx
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+type Options struct {
+	// Bpp selects the depth of paletted images, 1, 2, 4 or 8,
+	// zero picks the smallest depth that holds the palette
+	Bpp int
+
+	// Planar stores paletted images of 4 bits or less as
+	// one bit planes instead of packing the bits together
+	Planar bool
+
+	// Uncompressed writes the pixels without RLE
+	Uncompressed bool
+}
+
+type encoder struct {
+	w       *bufio.Writer
+	m       image.Image
+	o       Options
+	palette color.Palette
+	bpp     int
+	planes  int
+	bpl     int
+	line    []byte
+}
+
+// Encode writes paletted and grayscale images with a palette,
+// other images are written as 24 bit or 32 bit if they have alpha
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	e := &encoder{
+		w: bufio.NewWriter(w),
+		m: m,
+	}
+	if o != nil {
+		e.o = *o
+	}
+
+	r := m.Bounds()
+	if r.Dx() < 1 || r.Dy() < 1 || r.Dx() > 0xffff || r.Dy() > 0xffff {
+		return fmt.Errorf("pcx: invalid dimension %dx%d", r.Dx(), r.Dy())
+	}
+
+	err := e.setup()
+	if err != nil {
+		return err
+	}
+
+	e.writeHeader()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		e.scanline(y)
+		if e.o.Uncompressed {
+			e.w.Write(e.line)
+		} else {
+			e.pack(e.line)
+		}
+	}
+
+	if e.bpp == 8 && e.planes == 1 {
+		e.w.WriteByte(vgaPaletteMarker)
+		for i := 0; i < 256; i++ {
+			e.w.Write(e.color(i))
+		}
+	}
+
+	err = e.w.Flush()
+	if err != nil {
+		return fmt.Errorf("pcx: %v", err)
+	}
+	return nil
+}
+
+func (e *encoder) setup() error {
+	switch m := e.m.(type) {
+	case *image.Paletted:
+		e.palette = m.Palette
+	case *image.Gray:
+		e.palette = make(color.Palette, 256)
+		for i := range e.palette {
+			e.palette[i] = color.Gray{uint8(i)}
+		}
+	}
+
+	if e.palette == nil {
+		e.bpp, e.planes = 8, 3
+		if o, ok := e.m.(interface{ Opaque() bool }); !ok || !o.Opaque() {
+			e.planes = 4
+		}
+	} else {
+		if len(e.palette) > 256 {
+			return fmt.Errorf("pcx: palette of %d colors is too big", len(e.palette))
+		}
+
+		bpp := e.o.Bpp
+		if bpp == 0 {
+			for bpp = 1; 1<<uint(bpp) < len(e.palette); bpp *= 2 {
+			}
+		}
+		switch bpp {
+		case 1, 2, 4, 8:
+		default:
+			return fmt.Errorf("pcx: unsupported depth %d", bpp)
+		}
+		if 1<<uint(bpp) < len(e.palette) {
+			return fmt.Errorf("pcx: palette of %d colors does not fit in %d bits", len(e.palette), bpp)
+		}
+
+		e.bpp, e.planes = bpp, 1
+		if e.o.Planar && bpp > 1 && bpp <= 4 {
+			e.bpp, e.planes = 1, bpp
+		}
+	}
+
+	// lines are padded to an even number of bytes
+	w := e.m.Bounds().Dx()
+	e.bpl = (w*e.bpp + 7) / 8
+	e.bpl += e.bpl & 1
+	e.line = make([]byte, e.bpl*e.planes)
+	return nil
+}
+
+// color returns the palette entry as rgb, entries
+// past the end of the palette are written as black
+func (e *encoder) color(i int) []byte {
+	if i >= len(e.palette) {
+		return []byte{0, 0, 0}
+	}
+	c := color.RGBAModel.Convert(e.palette[i]).(color.RGBA)
+	return []byte{c.R, c.G, c.B}
+}
+
+func (e *encoder) writeHeader() {
+	r := e.m.Bounds()
+	h := header{
+		Manufacturer: 0x0a,
+		Version:      5,
+		Encoding:     1,
+		Bpp:          uint8(e.bpp),
+		Xmax:         uint16(r.Dx() - 1),
+		Ymax:         uint16(r.Dy() - 1),
+		HDpi:         72,
+		VDpi:         72,
+		Planes:       uint8(e.planes),
+		BytesPerLine: uint16(e.bpl),
+		PaletteInfo:  1,
+	}
+	if e.o.Uncompressed {
+		h.Encoding = 0
+	}
+	if _, ok := e.m.(*image.Gray); ok {
+		h.PaletteInfo = 2
+	}
+	if e.bpp*e.planes <= 4 {
+		for i := 0; i < 16; i++ {
+			copy(h.Colormap[i*3:], e.color(i))
+		}
+	}
+	binary.Write(e.w, binary.LittleEndian, &h)
+}
+
+func (e *encoder) scanline(y int) {
+	b := e.line
+	for i := range b {
+		b[i] = 0
+	}
+
+	r := e.m.Bounds()
+	switch m := e.m.(type) {
+	case *image.Paletted:
+		e.indices(m.Pix[m.PixOffset(r.Min.X, y):], r.Dx())
+		return
+	case *image.Gray:
+		copy(b, m.Pix[m.PixOffset(r.Min.X, y):m.PixOffset(r.Max.X, y)])
+		return
+	}
+
+	bpl := e.bpl
+	for x := r.Min.X; x < r.Max.X; x++ {
+		i := x - r.Min.X
+		if e.planes == 3 {
+			c := color.RGBAModel.Convert(e.m.At(x, y)).(color.RGBA)
+			b[i], b[bpl+i], b[2*bpl+i] = c.R, c.G, c.B
+		} else {
+			c := color.NRGBAModel.Convert(e.m.At(x, y)).(color.NRGBA)
+			b[i], b[bpl+i], b[2*bpl+i], b[3*bpl+i] = c.R, c.G, c.B, c.A
+		}
+	}
+}
+
+func (e *encoder) indices(p []byte, w int) {
+	b := e.line
+	switch {
+	case e.bpp == 8:
+		copy(b, p[:w])
+	case e.planes == 1:
+		bpp := uint(e.bpp)
+		for x := 0; x < w; x++ {
+			s := uint(x) * bpp
+			b[s/8] |= p[x] << (8 - bpp - s%8)
+		}
+	default:
+		for x := 0; x < w; x++ {
+			for i := 0; i < e.planes; i++ {
+				b[i*e.bpl+x/8] |= (p[x] >> uint(i) & 1) << (7 - uint(x%8))
+			}
+		}
+	}
+}
+
+// pack writes a scanline with runs of at most 63 bytes,
+// single bytes with the two high bits set need a run of one
+func (e *encoder) pack(b []byte) {
+	for i := 0; i < len(b); {
+		n := 1
+		for i+n < len(b) && n < 63 && b[i+n] == b[i] {
+			n++
+		}
+		if n > 1 || b[i]&0xc0 == 0xc0 {
+			e.w.WriteByte(0xc0 | uint8(n))
+		}
+		e.w.WriteByte(b[i])
+		i += n
+	}
+}
@@ -8,27 +8,69 @@ import (
 	"image"
 	"image/color"
 	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/qeedquan/go-media/image/floatimage"
 )
 
+// PFM does not have a number like the other formats,
+// so we give it one past the last netpbm format
+const formatPFM = 8
+
 var (
 	ErrFormat = errors.New("pnm: unsupported format")
 )
 
 func Decode(r io.Reader) (image.Image, error) {
 	d := decoder{r: r}
+	return d.decode()
+}
+
+// Reader decodes a stream of concatenated images
+type Reader struct {
+	b   *bufio.Reader
+	buf []byte
+	row []uint16
+}
+
+func NewReader(r io.Reader) *Reader {
+	b, ok := r.(*bufio.Reader)
+	if !ok {
+		b = bufio.NewReader(r)
+	}
+	return &Reader{b: b}
+}
+
+// Next decodes the next image in the stream,
+// it returns io.EOF when there are no more images
+func (r *Reader) Next() (image.Image, error) {
+	d := decoder{b: r.b, buf: r.buf, row: r.row}
+
+	// allow whitespace between images
+	d.skipws()
+	if d.err == io.EOF {
+		return nil, io.EOF
+	}
+
+	m, err := d.decode()
+	r.buf, r.row = d.buf, d.row
+	return m, err
+}
+
+func (d *decoder) decode() (image.Image, error) {
 	err := d.decodeHeader()
 	if err != nil {
 		return nil, err
 	}
 
-	b := image.Rect(0, 0, d.w, d.h)
-	m := image.NewRGBA(b)
-	for y := b.Min.Y; y < b.Max.Y; y++ {
-		for x := b.Min.X; x < b.Max.X; x++ {
-			m.Set(x, y, d.readColor())
-		}
+	var m image.Image
+	if d.format == formatPFM {
+		m = d.decodeFloat()
+	} else {
+		m = d.decodeImage()
 	}
-
 	if d.err != nil {
 		return nil, fmt.Errorf("pnm: %v", d.err)
 	}
@@ -43,58 +85,385 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 		return image.Config{}, err
 	}
 
+	var model color.Model
+	wide := d.maxval > 255
+	switch {
+	case d.format == formatPFM:
+		model = color.NRGBA64Model
+	case d.depth == 1:
+		model = color.GrayModel
+		if wide {
+			model = color.Gray16Model
+		}
+	case d.depth == 2 || d.depth == 4:
+		model = color.NRGBAModel
+		if wide {
+			model = color.NRGBA64Model
+		}
+	default:
+		model = color.RGBAModel
+		if wide {
+			model = color.RGBA64Model
+		}
+	}
+
 	return image.Config{
-		ColorModel: color.RGBAModel,
+		ColorModel: model,
 		Width:      d.w,
 		Height:     d.h,
 	}, nil
 }
 
 type header struct {
-	format int
-	maxval int
-	w, h   int
+	format   int
+	maxval   int
+	w, h     int
+	depth    int
+	tupltype string
+	order    binary.ByteOrder
 }
 
 type decoder struct {
-	r    io.Reader
-	b    *bufio.Reader
-	err  error
-	bits uint8
-	bw   uint8
+	r   io.Reader
+	b   *bufio.Reader
+	err error
+	buf []byte
+	row []uint16
 	header
 }
 
 func (d *decoder) decodeHeader() error {
-	d.b = bufio.NewReader(d.r)
+	if d.b == nil {
+		d.b = bufio.NewReader(d.r)
+	}
 
 	var sig [2]byte
-	fmt.Fscanf(d.b, "%c%c", &sig[0], &sig[1])
+	sig[0] = d.getch()
+	sig[1] = d.getch()
 	switch string(sig[:]) {
-	case "P1", "P2", "P3", "P4", "P5", "P6":
+	case "P1", "P2", "P3", "P4", "P5", "P6", "P7":
 		d.format = int(sig[1] - '0')
+	case "PF", "Pf":
+		d.format = formatPFM
 	default:
 		return ErrFormat
 	}
 
-	d.w = d.readInt()
-	d.h = d.readInt()
-	if d.format != 1 && d.format != 4 {
+	switch d.format {
+	case 1, 4:
+		d.w = d.readInt()
+		d.h = d.readInt()
+		d.maxval = 1
+		d.depth = 1
+	case 2, 3, 5, 6:
+		d.w = d.readInt()
+		d.h = d.readInt()
 		d.maxval = d.readInt()
-	} else {
-		d.maxval = 255
+		d.depth = 1
+		if d.format == 3 || d.format == 6 {
+			d.depth = 3
+		}
+	case 7:
+		d.decodePAMHeader()
+	case formatPFM:
+		d.decodePFMHeader(sig[1])
 	}
-	if d.maxval <= 0 {
-		d.maxval = 255
+
+	// binary data starts after exactly one whitespace
+	if d.format >= 4 && d.format != 7 {
+		d.getch()
 	}
 
 	if d.err != nil {
 		return fmt.Errorf("pnm: %v", d.err)
 	}
 
+	if d.w <= 0 || d.h <= 0 {
+		return fmt.Errorf("pnm: invalid dimension %dx%d", d.w, d.h)
+	}
+	if d.maxval <= 0 || d.maxval > 65535 {
+		return fmt.Errorf("pnm: invalid maxval %d", d.maxval)
+	}
+	if d.depth < 1 || d.depth > 4 {
+		return fmt.Errorf("pnm: unsupported depth %d", d.depth)
+	}
+
 	return nil
 }
 
+// decodePAMHeader reads the P7 header which consists
+// of keyword value lines terminated by ENDHDR
+func (d *decoder) decodePAMHeader() {
+	var tupltype []string
+	for d.err == nil {
+		switch tok := d.readToken(); tok {
+		case "WIDTH":
+			d.w = d.readInt()
+		case "HEIGHT":
+			d.h = d.readInt()
+		case "DEPTH":
+			d.depth = d.readInt()
+		case "MAXVAL":
+			d.maxval = d.readInt()
+		case "TUPLTYPE":
+			tupltype = append(tupltype, strings.TrimSpace(d.readLine()))
+		case "ENDHDR":
+			d.readLine()
+			d.tupltype = strings.Join(tupltype, " ")
+			d.checkTupleType()
+			return
+		default:
+			if d.err == nil {
+				d.err = fmt.Errorf("unknown header field %q", tok)
+			}
+		}
+	}
+}
+
+// decodePFMHeader reads the header of a float map, the sign of
+// the scale gives the byte order and the magnitude is ignored
+func (d *decoder) decodePFMHeader(sig byte) {
+	d.depth = 1
+	if sig == 'F' {
+		d.depth = 3
+		if d.peek() == '4' {
+			d.getch()
+			d.depth = 4
+		}
+	}
+
+	d.w = d.readInt()
+	d.h = d.readInt()
+	d.maxval = 1
+
+	tok := d.readToken()
+	if d.err != nil {
+		return
+	}
+
+	scale, err := strconv.ParseFloat(tok, 64)
+	if err != nil || scale == 0 || math.IsNaN(scale) {
+		d.err = fmt.Errorf("invalid scale %q", tok)
+		return
+	}
+
+	d.order = binary.BigEndian
+	if scale < 0 {
+		d.order = binary.LittleEndian
+	}
+}
+
+// checkTupleType makes sure the depth agrees with the known
+// tuple types, unknown tuple types are decoded based on depth
+func (d *decoder) checkTupleType() {
+	depth := 0
+	switch d.tupltype {
+	case "BLACKANDWHITE", "GRAYSCALE":
+		depth = 1
+	case "BLACKANDWHITE_ALPHA", "GRAYSCALE_ALPHA":
+		depth = 2
+	case "RGB":
+		depth = 3
+	case "RGB_ALPHA":
+		depth = 4
+	}
+
+	if depth != 0 && depth != d.depth {
+		d.err = fmt.Errorf("tuple type %s has depth %d, expected %d", d.tupltype, d.depth, depth)
+	}
+}
+
+func (d *decoder) decodeImage() image.Image {
+	var (
+		m      image.Image
+		pix    []uint8
+		stride int
+	)
+
+	r := image.Rect(0, 0, d.w, d.h)
+	wide := d.maxval > 255
+	switch d.depth {
+	case 1:
+		if wide {
+			p := image.NewGray16(r)
+			m, pix, stride = p, p.Pix, p.Stride
+		} else {
+			p := image.NewGray(r)
+			m, pix, stride = p, p.Pix, p.Stride
+		}
+	case 2, 4:
+		if wide {
+			p := image.NewNRGBA64(r)
+			m, pix, stride = p, p.Pix, p.Stride
+		} else {
+			p := image.NewNRGBA(r)
+			m, pix, stride = p, p.Pix, p.Stride
+		}
+	default:
+		if wide {
+			p := image.NewRGBA64(r)
+			m, pix, stride = p, p.Pix, p.Stride
+		} else {
+			p := image.NewRGBA(r)
+			m, pix, stride = p, p.Pix, p.Stride
+		}
+	}
+
+	// fast path for the common 8 bit binary formats
+	if d.maxval == 255 && d.format >= 5 && d.format <= 7 {
+		for y := 0; y < d.h && d.err == nil; y++ {
+			s := d.readBytes(d.w * d.depth)
+			p := pix[y*stride:]
+			switch d.depth {
+			case 1, 4:
+				copy(p, s)
+			case 2:
+				for x := 0; x < d.w; x++ {
+					p[x*4], p[x*4+1], p[x*4+2], p[x*4+3] = s[x*2], s[x*2], s[x*2], s[x*2+1]
+				}
+			case 3:
+				for x := 0; x < d.w; x++ {
+					p[x*4], p[x*4+1], p[x*4+2], p[x*4+3] = s[x*3], s[x*3+1], s[x*3+2], 255
+				}
+			}
+		}
+		return m
+	}
+
+	max := uint16(d.maxval)
+	for y := 0; y < d.h && d.err == nil; y++ {
+		s := d.readRow()
+		p := pix[y*stride:]
+		for x := 0; x < d.w; x++ {
+			var c [4]uint16
+
+			n := 4
+			switch d.depth {
+			case 1:
+				c[0], n = s[x], 1
+			case 2:
+				c = [4]uint16{s[x*2], s[x*2], s[x*2], s[x*2+1]}
+			case 3:
+				c = [4]uint16{s[x*3], s[x*3+1], s[x*3+2], max}
+			case 4:
+				c = [4]uint16{s[x*4], s[x*4+1], s[x*4+2], s[x*4+3]}
+			}
+
+			for i := 0; i < n; i++ {
+				j := x*n + i
+				if wide {
+					v := d.scale(c[i], 65535)
+					p[j*2], p[j*2+1] = uint8(v>>8), uint8(v)
+				} else {
+					p[j] = uint8(d.scale(c[i], 255))
+				}
+			}
+		}
+	}
+
+	return m
+}
+
+// decodeFloat reads the raster of a float map,
+// rows are stored from the bottom to the top
+func (d *decoder) decodeFloat() image.Image {
+	m := floatimage.NewRGBA(image.Rect(0, 0, d.w, d.h))
+	for y := d.h - 1; y >= 0 && d.err == nil; y-- {
+		b := d.readBytes(d.w * d.depth * 4)
+		p := m.Pix[y*m.Stride:]
+		for x := 0; x < d.w; x++ {
+			var c [4]float32
+			for i := 0; i < d.depth; i++ {
+				c[i] = math.Float32frombits(d.order.Uint32(b[(x*d.depth+i)*4:]))
+			}
+
+			switch d.depth {
+			case 1:
+				c = [4]float32{c[0], c[0], c[0], 1}
+			case 3:
+				c[3] = 1
+			}
+			copy(p[x*4:x*4+4], c[:])
+		}
+	}
+	return m
+}
+
+// scale converts a sample from [0, maxval] to [0, max]
+func (d *decoder) scale(v uint16, max int) uint16 {
+	if int(v) >= d.maxval {
+		return uint16(max)
+	}
+	return uint16((int(v)*max + d.maxval/2) / d.maxval)
+}
+
+// readRow reads a row of samples, pbm bitmaps are
+// converted so that 0 is black and 1 is white
+func (d *decoder) readRow() []uint16 {
+	n := d.w * d.depth
+	if len(d.row) < n {
+		d.row = make([]uint16, n)
+	}
+	row := d.row[:n]
+
+	switch d.format {
+	case 1:
+		for i := range row {
+			d.skipws()
+			switch d.getch() {
+			case '0':
+				row[i] = 1
+			case '1':
+				row[i] = 0
+			default:
+				if d.err == nil {
+					d.err = errors.New("invalid bitmap value")
+				}
+			}
+		}
+
+	case 2, 3:
+		for i := range row {
+			row[i] = uint16(d.readInt())
+		}
+
+	case 4:
+		// each row is padded to a byte boundary
+		b := d.readBytes((n + 7) / 8)
+		for i := range row {
+			row[i] = uint16(^b[i/8]>>(7-uint(i%8))) & 1
+		}
+
+	case 5, 6, 7:
+		if d.maxval < 256 {
+			b := d.readBytes(n)
+			for i := range row {
+				row[i] = uint16(b[i])
+			}
+		} else {
+			b := d.readBytes(n * 2)
+			for i := range row {
+				row[i] = uint16(b[i*2])<<8 | uint16(b[i*2+1])
+			}
+		}
+	}
+
+	return row
+}
+
+func (d *decoder) readBytes(n int) []byte {
+	if len(d.buf) < n {
+		d.buf = make([]byte, n)
+	}
+	b := d.buf[:n]
+	if d.err != nil {
+		return b
+	}
+
+	_, d.err = io.ReadFull(d.b, b)
+	return b
+}
+
 func (d *decoder) peek() uint8 {
 	if d.err != nil {
 		return 0
@@ -123,7 +492,7 @@ func (d *decoder) getch() byte {
 func (d *decoder) skipws() {
 	for {
 		switch d.peek() {
-		case ' ', '\t', '\n', '\r':
+		case ' ', '\t', '\n', '\r', '\v', '\f':
 			d.getch()
 			continue
 		case '#':
@@ -145,65 +514,48 @@ func (d *decoder) readInt() int {
 	}
 
 	d.skipws()
-	var n int
-	_, d.err = fmt.Fscan(d.b, &n)
-	return n
-}
-
-func (d *decoder) readColor() color.RGBA {
-	var (
-		c color.RGBA
-		y uint8
-	)
+	n, i := 0, 0
+	for ; ; i++ {
+		ch := d.peek()
+		if ch < '0' || ch > '9' {
+			break
+		}
+		if n = n*10 + int(ch-'0'); n > 1<<30 {
+			d.err = errors.New("integer overflow")
+			return 0
+		}
+		d.getch()
+	}
 
-	if d.err != nil {
-		return c
+	if i == 0 && d.err == nil {
+		d.err = errors.New("expected integer")
 	}
+	return n
+}
 
+func (d *decoder) readToken() string {
 	d.skipws()
-	switch d.format {
-	case 1, 2:
-		_, d.err = fmt.Fscanf(d.b, "%d", &y)
-		if d.format == 1 && y != 0 {
-			y = 255
-		}
-		c = color.RGBA{y, y, y, 255}
-	case 3:
-		_, d.err = fmt.Fscanf(d.b, "%d %d %d", &c.R, &c.G, &c.B)
-		c.A = 255
-	case 4:
-		if d.bits == 0 {
-			d.err = binary.Read(d.b, binary.LittleEndian, &d.bw)
-			d.bits = 8
-		} else {
-			y := uint8(0)
-			if d.bw&(1<<(7-(d.bits-1))) != 0 {
-				y = 255
-			}
-			c = color.RGBA{y, y, y, 255}
-			d.bits--
+
+	var s []byte
+	for {
+		switch ch := d.peek(); ch {
+		case 0, ' ', '\t', '\n', '\r', '\v', '\f':
+			return string(s)
+		default:
+			s = append(s, d.getch())
 		}
-	case 5:
-		d.err = binary.Read(d.b, binary.LittleEndian, &y)
-		c = color.RGBA{y, y, y, 255}
-	case 6:
-		var p [3]uint8
-		d.err = binary.Read(d.b, binary.LittleEndian, p)
-		c = color.RGBA{p[0], p[1], p[2], 255}
 	}
-
-	s := 255 / float64(d.maxval)
-	cr := float64(c.R) * s
-	cg := float64(c.G) * s
-	cb := float64(c.B) * s
-	return color.RGBA{clamp(cr), clamp(cg), clamp(cb), c.A}
 }
 
-func clamp(x float64) uint8 {
-	if x > 255 {
-		return 255
+func (d *decoder) readLine() string {
+	var s []byte
+	for {
+		ch := d.getch()
+		if ch == '\n' || d.err != nil {
+			return string(s)
+		}
+		s = append(s, ch)
 	}
-	return uint8(x)
 }
 
 func init() {
@@ -213,4 +565,7 @@ func init() {
 	image.RegisterFormat("pbm", "P4", Decode, DecodeConfig)
 	image.RegisterFormat("pgm", "P5", Decode, DecodeConfig)
 	image.RegisterFormat("ppm", "P6", Decode, DecodeConfig)
+	image.RegisterFormat("pam", "P7", Decode, DecodeConfig)
+	image.RegisterFormat("pfm", "PF", Decode, DecodeConfig)
+	image.RegisterFormat("pfm", "Pf", Decode, DecodeConfig)
 }
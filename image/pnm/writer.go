@@ -7,10 +7,36 @@ import (
 	"image"
 	"image/color"
 	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/qeedquan/go-media/image/floatimage"
 )
 
 type Options struct {
 	Format int
+
+	// Maxval is the maximum sample value, values above 255
+	// store samples as 16 bit, zero picks 65535 for 16 bit
+	// images and 255 for everything else
+	Maxval int
+
+	// TupleType is used by the P7 format, if empty it is
+	// chosen based on the image
+	TupleType string
+}
+
+type encoder struct {
+	w        *bufio.Writer
+	m        image.Image
+	format   int
+	maxval   int
+	depth    int
+	tupltype string
+	opaque   bool
+	row      []uint16
+	buf      []byte
 }
 
 func Encode(w io.Writer, m image.Image, o *Options) error {
@@ -18,71 +44,308 @@ func Encode(w io.Writer, m image.Image, o *Options) error {
 		o = &Options{Format: 3}
 	}
 
-	b := bufio.NewWriter(w)
+	e := &encoder{
+		w:        bufio.NewWriter(w),
+		m:        m,
+		format:   o.Format,
+		maxval:   o.Maxval,
+		tupltype: o.TupleType,
+	}
+
+	err := e.writeHeader()
+	if err != nil {
+		return err
+	}
+
+	if m, _ := m.(*image.RGBA); m != nil && e.depth == 4 {
+		e.opaque = m.Opaque()
+	}
+
 	r := m.Bounds()
-	bits := uint(0)
-	bw := uint8(0)
+	e.row = make([]uint16, r.Dx()*e.depth)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		e.buf = e.buf[:0]
+		if !e.fastRow(y) {
+			e.samples(y)
+			e.pack()
+		}
+		e.w.Write(e.buf)
+	}
+
+	err = e.w.Flush()
+	if err != nil {
+		return fmt.Errorf("pnm: %v", err)
+	}
+	return nil
+}
+
+func (e *encoder) writeHeader() error {
+	m := e.m
+	if e.maxval == 0 {
+		e.maxval = 255
+		switch m.(type) {
+		case *image.Gray16, *image.RGBA64, *image.NRGBA64:
+			e.maxval = 65535
+		}
+	}
+	if e.maxval < 1 || e.maxval > 65535 {
+		return fmt.Errorf("pnm: invalid maxval %d", e.maxval)
+	}
 
-	fmt.Fprintf(w, "P%d\n", o.Format)
-	fmt.Fprintf(w, "%d %d\n", r.Dx(), r.Dy())
-	switch o.Format {
+	switch e.format {
 	case 1, 4:
-	case 2, 3, 5, 6:
-		fmt.Fprintf(w, "255\n")
+		e.maxval = 1
+		e.depth = 1
+	case 2, 5:
+		e.depth = 1
+	case 3, 6:
+		e.depth = 3
+	case 7:
+		if e.tupltype == "" {
+			e.tupltype = tupleType(m)
+		}
+		switch e.tupltype {
+		case "BLACKANDWHITE", "GRAYSCALE":
+			e.depth = 1
+		case "BLACKANDWHITE_ALPHA", "GRAYSCALE_ALPHA":
+			e.depth = 2
+		case "RGB":
+			e.depth = 3
+		case "RGB_ALPHA":
+			e.depth = 4
+		default:
+			return fmt.Errorf("pnm: unsupported tuple type %q", e.tupltype)
+		}
+		if strings.HasPrefix(e.tupltype, "BLACKANDWHITE") {
+			e.maxval = 1
+		}
 	default:
 		return ErrFormat
 	}
 
-	for y := r.Min.Y; y < r.Max.Y; y++ {
-		for x := r.Min.X; x < r.Max.X; x++ {
-			p := m.At(x, y)
-			switch o.Format {
-			case 1, 2:
-				c := (color.GrayModel.Convert(p)).(color.Gray)
-				if o.Format == 1 && c.Y != 0 {
-					c.Y = 1
-				}
-				fmt.Fprintf(w, "%d ", c.Y)
-
-			case 3:
-				c := color.RGBAModel.Convert(p).(color.RGBA)
-				fmt.Fprintf(w, "%d %d %d", c.R, c.G, c.B)
-
-			case 4:
-				c := color.RGBAModel.Convert(p).(color.Gray)
-				if c.Y != 0 {
-					bw |= 1 << (7 - bits)
-				}
-
-				if bits++; bits == 8 {
-					binary.Write(w, binary.LittleEndian, bw)
-					bits = 0
-					bw = 0
-				}
-
-			case 5:
-				c := (color.GrayModel.Convert(p)).(color.Gray)
-				binary.Write(w, binary.LittleEndian, c.Y)
-
-			case 6:
-				c := color.RGBAModel.Convert(p).(color.RGBA)
-				p := [3]uint8{c.R, c.G, c.B}
-				binary.Write(w, binary.LittleEndian, p)
+	r := m.Bounds()
+	fmt.Fprintf(e.w, "P%d\n", e.format)
+	switch e.format {
+	case 1, 4:
+		fmt.Fprintf(e.w, "%d %d\n", r.Dx(), r.Dy())
+	case 2, 3, 5, 6:
+		fmt.Fprintf(e.w, "%d %d\n", r.Dx(), r.Dy())
+		fmt.Fprintf(e.w, "%d\n", e.maxval)
+	case 7:
+		fmt.Fprintf(e.w, "WIDTH %d\nHEIGHT %d\nDEPTH %d\nMAXVAL %d\nTUPLTYPE %s\nENDHDR\n",
+			r.Dx(), r.Dy(), e.depth, e.maxval, e.tupltype)
+	}
+	return nil
+}
+
+// fastRow handles the common case of writing 8 bit binary
+// data straight out of the pixel buffer of the image
+func (e *encoder) fastRow(y int) bool {
+	if e.maxval != 255 || e.format < 5 {
+		return false
+	}
+
+	r := e.m.Bounds()
+	switch m := e.m.(type) {
+	case *image.Gray:
+		if e.depth != 1 {
+			return false
+		}
+		i := m.PixOffset(r.Min.X, y)
+		e.buf = append(e.buf, m.Pix[i:i+r.Dx()]...)
+
+	case *image.RGBA:
+		if e.depth != 3 && !(e.depth == 4 && e.opaque) {
+			return false
+		}
+		i := m.PixOffset(r.Min.X, y)
+		s := m.Pix[i : i+r.Dx()*4]
+		if e.depth == 4 {
+			e.buf = append(e.buf, s...)
+			break
+		}
+		for i := 0; i < len(s); i += 4 {
+			e.buf = append(e.buf, s[i], s[i+1], s[i+2])
+		}
+
+	case *image.NRGBA:
+		if e.depth != 4 {
+			return false
+		}
+		i := m.PixOffset(r.Min.X, y)
+		e.buf = append(e.buf, m.Pix[i:i+r.Dx()*4]...)
+
+	default:
+		return false
+	}
+	return true
+}
+
+// samples converts a row of the image into samples
+// in the range of [0, maxval] for the output depth
+func (e *encoder) samples(y int) {
+	r := e.m.Bounds()
+	s := e.row
+
+	// gray images do not need to go through color conversion
+	if m, _ := e.m.(*image.Gray); m != nil && e.depth == 1 {
+		p := m.Pix[m.PixOffset(r.Min.X, y):]
+		for x := range s {
+			s[x] = e.scale(uint32(p[x]) * 0x101)
+		}
+		e.threshold()
+		return
+	}
+
+	for x := r.Min.X; x < r.Max.X; x++ {
+		p := e.m.At(x, y)
+		i := (x - r.Min.X) * e.depth
+		switch e.depth {
+		case 1:
+			c := color.Gray16Model.Convert(p).(color.Gray16)
+			s[i] = e.scale(uint32(c.Y))
+
+		case 2:
+			c := color.NRGBA64Model.Convert(p).(color.NRGBA64)
+			g := color.Gray16Model.Convert(color.RGBA64{c.R, c.G, c.B, 0xffff}).(color.Gray16)
+			s[i] = e.scale(uint32(g.Y))
+			s[i+1] = e.scale(uint32(c.A))
+
+		case 3:
+			c := color.RGBA64Model.Convert(p).(color.RGBA64)
+			s[i] = e.scale(uint32(c.R))
+			s[i+1] = e.scale(uint32(c.G))
+			s[i+2] = e.scale(uint32(c.B))
+
+		case 4:
+			c := color.NRGBA64Model.Convert(p).(color.NRGBA64)
+			s[i] = e.scale(uint32(c.R))
+			s[i+1] = e.scale(uint32(c.G))
+			s[i+2] = e.scale(uint32(c.B))
+			s[i+3] = e.scale(uint32(c.A))
+		}
+	}
+	e.threshold()
+}
+
+// threshold converts gray samples to pbm bits where 1 is black
+func (e *encoder) threshold() {
+	if e.format != 1 && e.format != 4 {
+		return
+	}
+	for i := range e.row {
+		e.row[i] ^= 1
+	}
+}
+
+func (e *encoder) scale(v uint32) uint16 {
+	return uint16((v*uint32(e.maxval) + 32767) / 65535)
+}
+
+// pack converts the samples into the output representation
+func (e *encoder) pack() {
+	s := e.row
+	switch e.format {
+	case 1, 2, 3:
+		for i := range s {
+			if i > 0 {
+				e.buf = append(e.buf, ' ')
 			}
+			e.buf = strconv.AppendUint(e.buf, uint64(s[i]), 10)
+		}
+		e.buf = append(e.buf, '\n')
 
-			if x+1 < r.Max.X {
-				fmt.Fprintf(w, " ")
+	case 4:
+		// rows are padded to a byte boundary
+		for i := 0; i < len(s); i += 8 {
+			b := uint8(0)
+			for j := 0; j < 8 && i+j < len(s); j++ {
+				b |= uint8(s[i+j]) << (7 - uint(j))
 			}
+			e.buf = append(e.buf, b)
 		}
 
-		switch o.Format {
-		case 1, 2, 3:
-			fmt.Fprintf(w, "\n")
+	default:
+		if e.maxval < 256 {
+			for i := range s {
+				e.buf = append(e.buf, uint8(s[i]))
+			}
+		} else {
+			for i := range s {
+				e.buf = append(e.buf, uint8(s[i]>>8), uint8(s[i]))
+			}
+		}
+	}
+}
+
+type PFMOptions struct {
+	// Channels is 1 for grayscale, 3 for RGB and 4 for RGBA,
+	// zero picks 4 if the image has transparency and 3 otherwise
+	Channels int
+
+	// BigEndian stores the samples in big endian order
+	BigEndian bool
+}
+
+// EncodePFM writes the image as a portable float map, images that
+// are not a *floatimage.RGBA are converted to linear light first
+func EncodePFM(w io.Writer, m image.Image, o *PFMOptions) error {
+	if o == nil {
+		o = &PFMOptions{}
+	}
+
+	r := m.Bounds()
+	f, _ := m.(*floatimage.RGBA)
+	channels := o.Channels
+	if channels == 0 {
+		channels = 3
+		if tupleType(m) == "RGB_ALPHA" {
+			channels = 4
 		}
 	}
 
-	if bits != 0 {
-		binary.Write(w, binary.LittleEndian, bw)
+	var (
+		sig   string
+		order binary.ByteOrder = binary.LittleEndian
+		scale                  = -1.0
+	)
+	switch channels {
+	case 1:
+		sig = "Pf"
+	case 3:
+		sig = "PF"
+	case 4:
+		sig = "PF4"
+	default:
+		return fmt.Errorf("pnm: unsupported number of float channels %d", channels)
+	}
+	if o.BigEndian {
+		order, scale = binary.BigEndian, 1
+	}
+
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "%s\n%d %d\n%.6f\n", sig, r.Dx(), r.Dy(), scale)
+
+	for y := r.Max.Y - 1; y >= r.Min.Y; y-- {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			var c floatimage.Color
+			if f != nil {
+				c = f.FloatAt(x, y)
+			} else {
+				c = floatimage.FloatModel.Convert(m.At(x, y)).(floatimage.Color)
+			}
+
+			p := [4]float32{c.R, c.G, c.B, c.A}
+			if channels == 1 {
+				p[0] = 0.2126*c.R + 0.7152*c.G + 0.0722*c.B
+			}
+
+			var buf [16]byte
+			for i := 0; i < channels; i++ {
+				order.PutUint32(buf[i*4:], math.Float32bits(p[i]))
+			}
+			b.Write(buf[:channels*4])
+		}
 	}
 
 	err := b.Flush()
@@ -91,3 +354,23 @@ func Encode(w io.Writer, m image.Image, o *Options) error {
 	}
 	return nil
 }
+
+// tupleType picks the P7 tuple type that can
+// represent the image without losing information
+func tupleType(m image.Image) string {
+	opaque := false
+	if o, ok := m.(interface {
+		Opaque() bool
+	}); ok {
+		opaque = o.Opaque()
+	}
+
+	switch m.(type) {
+	case *image.Gray, *image.Gray16:
+		return "GRAYSCALE"
+	}
+	if opaque {
+		return "RGB"
+	}
+	return "RGB_ALPHA"
+}
@@ -0,0 +1,624 @@
+package psd
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"unicode/utf16"
+)
+
+// color modes
+const (
+	MODE_BITMAP       = 0
+	MODE_GRAYSCALE    = 1
+	MODE_INDEXED      = 2
+	MODE_RGB          = 3
+	MODE_CMYK         = 4
+	MODE_MULTICHANNEL = 7
+	MODE_DUOTONE      = 8
+	MODE_LAB          = 9
+)
+
+// special channel ids, color channels are numbered from 0
+const (
+	CHANNEL_ALPHA     = -1
+	CHANNEL_MASK      = -2
+	CHANNEL_REAL_MASK = -3
+)
+
+// layer mask flags
+const (
+	MASK_RELATIVE = 1 << iota
+	MASK_DISABLED
+	MASK_INVERT
+)
+
+// common blend mode keys
+const (
+	BLEND_PASS_THROUGH = "pass"
+	BLEND_NORMAL       = "norm"
+	BLEND_DISSOLVE     = "diss"
+	BLEND_DARKEN       = "dark"
+	BLEND_MULTIPLY     = "mul "
+	BLEND_COLOR_BURN   = "idiv"
+	BLEND_LIGHTEN      = "lite"
+	BLEND_SCREEN       = "scrn"
+	BLEND_COLOR_DODGE  = "div "
+	BLEND_OVERLAY      = "over"
+	BLEND_SOFT_LIGHT   = "sLit"
+	BLEND_HARD_LIGHT   = "hLit"
+	BLEND_DIFFERENCE   = "diff"
+	BLEND_EXCLUSION    = "smud"
+	BLEND_HUE          = "hue "
+	BLEND_SATURATION   = "sat "
+	BLEND_COLOR        = "colr"
+	BLEND_LUMINOSITY   = "lum "
+)
+
+// section divider types
+const (
+	sectionOther = iota
+	sectionOpen
+	sectionClosed
+	sectionEnd
+)
+
+// Document is a PSD file with its layers, the layers are
+// ordered from bottom to top like they are stored in the file
+type Document struct {
+	Width    int
+	Height   int
+	Depth    int
+	Mode     int
+	Channels int
+
+	// flattened composite image
+	Image image.Image
+
+	Layers []*Layer
+}
+
+// Layer is a layer or group of a document, the zero value has an
+// Opacity of 0 and is not Visible, so a layer made for encoding
+// needs Opacity set to 255 and Visible set to true to be shown
+type Layer struct {
+	Name      string
+	Rect      image.Rectangle
+	Opacity   uint8
+	BlendMode string
+	Visible   bool
+	Clipping  bool
+
+	// groups hold their children in Layers and have no pixel data
+	Group  bool
+	Layers []*Layer
+
+	// raw channel data, the bounds of each channel
+	// are in document coordinates
+	Channels []Channel
+
+	// color and alpha channels combined, nil if the layer is
+	// empty or the color mode can't be represented
+	Image image.Image
+
+	Mask *Mask
+}
+
+type Channel struct {
+	ID    int
+	Image image.Image
+}
+
+type Mask struct {
+	Rect         image.Rectangle
+	DefaultColor uint8
+	Flags        uint8
+	Image        image.Image
+
+	// layers with both a vector and a user mask store
+	// the user mask as the CHANNEL_REAL_MASK channel
+	RealRect         image.Rectangle
+	RealDefaultColor uint8
+	RealFlags        uint8
+	RealImage        image.Image
+}
+
+type layerRecord struct {
+	Top, Left, Bottom, Right int32
+	Channels                 uint16
+}
+
+type channelInfo struct {
+	ID     int16
+	Length uint32
+}
+
+type layerBlend struct {
+	Sig      [4]byte
+	Key      [4]byte
+	Opacity  uint8
+	Clipping uint8
+	Flags    uint8
+	Filler   uint8
+	Extra    uint32
+}
+
+type maskRecord struct {
+	Top, Left, Bottom, Right int32
+	DefaultColor             uint8
+	Flags                    uint8
+}
+
+type layerInfo struct {
+	*Layer
+	channels []channelInfo
+	section  int
+}
+
+// DecodeDocument reads the layers along with the composite image
+func DecodeDocument(r io.Reader) (*Document, error) {
+	d := &decoder{r: r, doc: &Document{}}
+
+	err := d.checkHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.decode()
+	if err != nil {
+		return nil, err
+	}
+
+	doc := d.doc
+	doc.Width = int(d.Width)
+	doc.Height = int(d.Height)
+	doc.Depth = int(d.Depth)
+	doc.Mode = int(d.Mode)
+	doc.Channels = int(d.Channels)
+	doc.Image = d.img
+	return doc, nil
+}
+
+// decodeLayerSection reads the layer and mask information section
+func (d *decoder) decodeLayerSection() error {
+	var size uint32
+	err := d.rb(&size)
+	if err != nil {
+		return err
+	}
+	if d.doc == nil {
+		return nopRead(d.r, int64(size))
+	}
+
+	b, err := readFull(d.r, int64(size))
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return nil
+	}
+
+	r := bytes.NewReader(b)
+	b, err = readBlock(r)
+	if err != nil {
+		return err
+	}
+	if len(b) > 0 {
+		err = d.decodeLayers(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	// global layer mask info
+	if r.Len() < 4 {
+		return nil
+	}
+	_, err = readBlock(r)
+	if err != nil {
+		return err
+	}
+
+	// 16 bit documents store their layers in the additional layer info
+	for r.Len() >= 12 {
+		key, data, err := readTaggedBlock(r)
+		if err != nil {
+			return err
+		}
+		if (key == "Lr16" || key == "Lr32") && len(d.doc.Layers) == 0 {
+			err = d.decodeLayers(data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *decoder) decodeLayers(b []byte) error {
+	r := bytes.NewReader(b)
+
+	// a negative count means the first alpha channel
+	// holds the transparency of the composite image
+	var count int16
+	err := binary.Read(r, binary.BigEndian, &count)
+	if err != nil {
+		return errUnexpectedEOF(err)
+	}
+	n := int(count)
+	if n < 0 {
+		n = -n
+	}
+	if n*34 > r.Len() {
+		return errors.New("psd: layer count exceeds section size")
+	}
+
+	layers := make([]*layerInfo, n)
+	for i := range layers {
+		layers[i], err = d.decodeLayerRecord(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, l := range layers {
+		for _, c := range l.channels {
+			data, err := readFull(r, int64(c.Length))
+			if err != nil {
+				return err
+			}
+
+			rect := l.Rect
+			if k := l.Mask; k != nil {
+				switch c.ID {
+				case CHANNEL_MASK:
+					rect = k.Rect
+				case CHANNEL_REAL_MASK:
+					rect = k.RealRect
+				}
+			}
+			m, err := d.decodeChannel(data, rect)
+			if err != nil {
+				return err
+			}
+
+			if k := l.Mask; k != nil {
+				switch c.ID {
+				case CHANNEL_MASK:
+					k.Image = m
+				case CHANNEL_REAL_MASK:
+					k.RealImage = m
+				}
+			}
+			l.Channels = append(l.Channels, Channel{int(c.ID), m})
+		}
+		if !l.Group {
+			l.Image = d.combine(l.Layer)
+		}
+	}
+
+	d.doc.Layers = groupLayers(layers)
+	return nil
+}
+
+func (d *decoder) decodeLayerRecord(r *bytes.Reader) (*layerInfo, error) {
+	var (
+		lr layerRecord
+		lb layerBlend
+	)
+
+	err := binary.Read(r, binary.BigEndian, &lr)
+	if err != nil {
+		return nil, errUnexpectedEOF(err)
+	}
+	if int(lr.Channels)*6 > r.Len() {
+		return nil, errors.New("psd: layer channel count exceeds section size")
+	}
+	l := &layerInfo{
+		Layer:    &Layer{Rect: image.Rect(int(lr.Left), int(lr.Top), int(lr.Right), int(lr.Bottom))},
+		channels: make([]channelInfo, lr.Channels),
+	}
+	err = binary.Read(r, binary.BigEndian, l.channels)
+	if err != nil {
+		return nil, errUnexpectedEOF(err)
+	}
+
+	err = binary.Read(r, binary.BigEndian, &lb)
+	if err != nil {
+		return nil, errUnexpectedEOF(err)
+	}
+	if string(lb.Sig[:]) != "8BIM" {
+		return nil, errors.New("psd: invalid blend mode signature")
+	}
+	l.BlendMode = string(lb.Key[:])
+	l.Opacity = lb.Opacity
+	l.Clipping = lb.Clipping != 0
+	l.Visible = lb.Flags&2 == 0
+
+	extra, err := readFull(r, int64(lb.Extra))
+	if err != nil {
+		return nil, err
+	}
+	x := bytes.NewReader(extra)
+
+	mask, err := readBlock(x)
+	if err != nil {
+		return nil, err
+	}
+	if len(mask) >= 18 {
+		var mr maskRecord
+		binary.Read(bytes.NewReader(mask), binary.BigEndian, &mr)
+		l.Mask = &Mask{
+			Rect:         image.Rect(int(mr.Left), int(mr.Top), int(mr.Right), int(mr.Bottom)),
+			DefaultColor: mr.DefaultColor,
+			Flags:        mr.Flags,
+		}
+
+		// the mask parameters come before the real fields, the bits
+		// select the user and vector densities and feathers present
+		o := 18
+		if mr.Flags&0x10 != 0 && o < len(mask) {
+			p := mask[o]
+			o++
+			for i, n := range [4]int{1, 8, 1, 8} {
+				if p&(1<<uint(i)) != 0 {
+					o += n
+				}
+			}
+		}
+
+		// the real flags, color and rect follow in the long form
+		if len(mask) >= o+18 {
+			var rr [4]int32
+			binary.Read(bytes.NewReader(mask[o+2:o+18]), binary.BigEndian, &rr)
+			l.Mask.RealFlags = mask[o]
+			l.Mask.RealDefaultColor = mask[o+1]
+			l.Mask.RealRect = image.Rect(int(rr[1]), int(rr[0]), int(rr[3]), int(rr[2]))
+		}
+	}
+
+	// blending ranges
+	_, err = readBlock(x)
+	if err != nil {
+		return nil, err
+	}
+
+	// pascal string padded to a multiple of 4 bytes
+	c, err := x.ReadByte()
+	if err != nil {
+		return nil, errUnexpectedEOF(err)
+	}
+	name, err := readFull(x, int64(c))
+	if err != nil {
+		return nil, err
+	}
+	l.Name = string(name)
+	x.Seek(int64(3-int(c)%4), io.SeekCurrent)
+
+	for x.Len() >= 12 {
+		key, data, err := readTaggedBlock(x)
+		if err != nil {
+			return nil, err
+		}
+
+		switch key {
+		case "luni":
+			if len(data) >= 4 {
+				n := int(binary.BigEndian.Uint32(data))
+				data = data[4:]
+				if n*2 <= len(data) {
+					s := make([]uint16, n)
+					for i := range s {
+						s[i] = binary.BigEndian.Uint16(data[i*2:])
+					}
+					l.Name = string(utf16.Decode(s))
+				}
+			}
+
+		case "lsct", "lsdk":
+			if len(data) >= 4 {
+				l.section = int(binary.BigEndian.Uint32(data))
+			}
+			if len(data) >= 12 && string(data[4:8]) == "8BIM" {
+				l.BlendMode = string(data[8:12])
+			}
+		}
+	}
+
+	l.Group = l.section == sectionOpen || l.section == sectionClosed
+	return l, nil
+}
+
+// groupLayers builds the group hierarchy, in file order a group
+// starts with a divider and ends with the layer describing the group
+func groupLayers(layers []*layerInfo) []*Layer {
+	stack := [][]*Layer{nil}
+	for _, l := range layers {
+		n := len(stack) - 1
+		switch {
+		case l.section == sectionEnd:
+			stack = append(stack, nil)
+		case l.Group && n > 0:
+			l.Layers = stack[n]
+			stack = stack[:n]
+			stack[n-1] = append(stack[n-1], l.Layer)
+		default:
+			stack[n] = append(stack[n], l.Layer)
+		}
+	}
+
+	// unterminated groups have their children moved up
+	for n := len(stack) - 1; n > 0; n-- {
+		stack[n-1] = append(stack[n-1], stack[n]...)
+	}
+	return stack[0]
+}
+
+// decodeChannel decodes the compressed image data of a layer channel
+func (d *decoder) decodeChannel(b []byte, rect image.Rectangle) (image.Image, error) {
+	if len(b) < 2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	compression := binary.BigEndian.Uint16(b)
+	b = b[2:]
+
+	w, h := rect.Dx(), rect.Dy()
+	if w <= 0 || h <= 0 {
+		return nil, nil
+	}
+	if d.Depth < 8 {
+		return nil, fmt.Errorf("psd: unsupported layer channel depth: %v", d.Depth)
+	}
+	bpc := int(d.Depth) / 8
+	pix := make([]byte, w*h*bpc)
+
+	switch compression {
+	case 0:
+		if len(b) < len(pix) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		copy(pix, b)
+
+	case 1:
+		if len(b) < h*2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		err := unpackBits(pix, b[h*2:])
+		if err != nil {
+			return nil, err
+		}
+
+	case 2, 3:
+		z, err := zlib.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("psd: %v", err)
+		}
+		_, err = io.ReadFull(z, pix)
+		if err != nil {
+			return nil, fmt.Errorf("psd: %v", err)
+		}
+		if compression == 3 {
+			unpredict(pix, w, bpc)
+		}
+
+	default:
+		return nil, fmt.Errorf("psd: unsupported channel compression %d", compression)
+	}
+
+	if bpc == 2 {
+		return &image.Gray16{Pix: pix, Stride: w * 2, Rect: rect}, nil
+	}
+	return &image.Gray{Pix: pix, Stride: w, Rect: rect}, nil
+}
+
+// unpredict undoes the horizontal delta encoding used by zip with prediction
+func unpredict(pix []byte, w, bpc int) {
+	stride := w * bpc
+	for y := 0; y+stride <= len(pix); y += stride {
+		row := pix[y : y+stride]
+		if bpc == 2 {
+			for x := 2; x < len(row); x += 2 {
+				v := binary.BigEndian.Uint16(row[x-2:]) + binary.BigEndian.Uint16(row[x:])
+				binary.BigEndian.PutUint16(row[x:], v)
+			}
+		} else {
+			for x := 1; x < len(row); x++ {
+				row[x] += row[x-1]
+			}
+		}
+	}
+}
+
+// combine merges the color and alpha channels of a layer into one image
+func (d *decoder) combine(l *Layer) image.Image {
+	r := l.Rect
+	if r.Empty() {
+		return nil
+	}
+
+	nc := d.colorChannels()
+	p := make([][]byte, nc+1)
+	for _, c := range l.Channels {
+		var pix []byte
+		switch m := c.Image.(type) {
+		case *image.Gray:
+			pix = m.Pix
+		case *image.Gray16:
+			pix = m.Pix
+		}
+
+		switch {
+		case c.ID >= 0 && c.ID < nc:
+			p[c.ID] = pix
+		case c.ID == CHANNEL_ALPHA:
+			p[nc] = pix
+		}
+	}
+
+	if d.Mode == MODE_GRAYSCALE && p[nc] == nil {
+		for _, c := range l.Channels {
+			if c.ID == 0 {
+				return c.Image
+			}
+		}
+	}
+
+	model := color.NRGBAModel
+	if d.Depth == 16 {
+		model = color.NRGBA64Model
+	}
+	return d.convert(p, r, model, false)
+}
+
+// readBlock reads a block prefixed by a 32 bit length
+func readBlock(r io.Reader) ([]byte, error) {
+	var n uint32
+	err := binary.Read(r, binary.BigEndian, &n)
+	if err != nil {
+		return nil, errUnexpectedEOF(err)
+	}
+	return readFull(r, int64(n))
+}
+
+// readTaggedBlock reads an additional layer information block
+func readTaggedBlock(r io.Reader) (string, []byte, error) {
+	var sig, key [4]byte
+	_, err := io.ReadFull(r, sig[:])
+	if err != nil {
+		return "", nil, errUnexpectedEOF(err)
+	}
+	if s := string(sig[:]); s != "8BIM" && s != "8B64" {
+		return "", nil, fmt.Errorf("psd: invalid additional layer info signature %q", s)
+	}
+	_, err = io.ReadFull(r, key[:])
+	if err != nil {
+		return "", nil, errUnexpectedEOF(err)
+	}
+	b, err := readBlock(r)
+	return string(key[:]), b, err
+}
+
+// readFull reads n bytes without trusting n for the allocation size
+func readFull(r io.Reader, n int64) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, n))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) != n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
+
+func errUnexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
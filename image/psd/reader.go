@@ -4,16 +4,26 @@ package psd
 
 import (
 	"bytes"
+	"compress/zlib"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"io"
+	"math"
+
+	"github.com/qeedquan/go-media/image/chroma"
 )
 
 const psdHeader = "8BPS"
 
+// image resource ids
+const (
+	resIndexedCount      = 1046
+	resTransparencyIndex = 1047
+)
+
 type header struct {
 	Sig      [4]byte
 	Version  uint16
@@ -27,9 +37,11 @@ type header struct {
 
 type decoder struct {
 	header
-	r   io.Reader
-	img image.Image
-	bps int
+	r         io.Reader
+	img       image.Image
+	doc       *Document
+	colormap  []byte
+	resources []byte
 }
 
 func Decode(r io.Reader) (image.Image, error) {
@@ -55,8 +67,20 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 		return image.Config{}, err
 	}
 
+	// the palette lives in the color mode data and resources
+	if d.Mode == MODE_INDEXED {
+		d.colormap, err = readBlock(d.r)
+		if err != nil {
+			return image.Config{}, err
+		}
+		d.resources, err = readBlock(d.r)
+		if err != nil {
+			return image.Config{}, err
+		}
+	}
+
 	return image.Config{
-		ColorModel: color.RGBAModel,
+		ColorModel: d.colorModel(),
 		Width:      int(d.Width),
 		Height:     int(d.Height),
 	}, nil
@@ -67,283 +91,456 @@ func (d *decoder) checkHeader() error {
 
 	err := d.rb(&h)
 	if err != nil {
-		return err
+		return errUnexpectedEOF(err)
 	}
 	if bytes.Compare(h.Sig[:], []byte(psdHeader)) != 0 {
-		return errors.New("invalid psd signature")
+		return errors.New("psd: invalid signature")
 	}
 
 	if h.Version != 1 {
-		return fmt.Errorf("unsupported psd version %d", h.Version)
+		return fmt.Errorf("psd: unsupported version %d", h.Version)
 	}
 
 	for _, v := range h.Reserved {
 		if v != 0 {
-			return errors.New("reserved field is not all zeroes")
+			return errors.New("psd: reserved field is not all zeroes")
 		}
 	}
 
-	if h.Channels < 1 || h.Channels > 24 {
-		return fmt.Errorf("unsupported number of channels: %d", h.Channels)
+	if h.Channels < 1 || h.Channels > 56 {
+		return fmt.Errorf("psd: unsupported number of channels: %d", h.Channels)
 	}
 
-	if h.Height < 1 || h.Width < 1 {
-		return fmt.Errorf("invalid dimension %dx%d", h.Width, h.Height)
+	if h.Height < 1 || h.Width < 1 || h.Height > 30000 || h.Width > 30000 {
+		return fmt.Errorf("psd: invalid dimension %dx%d", h.Width, h.Height)
 	}
 
-	if h.Depth != 1 && h.Depth != 8 && h.Depth != 16 {
-		return fmt.Errorf("unsupported depth: %v", h.Depth)
+	switch h.Mode {
+	case MODE_BITMAP:
+		if h.Depth != 1 {
+			return fmt.Errorf("psd: unsupported bitmap depth: %v", h.Depth)
+		}
+	case MODE_INDEXED:
+		if h.Depth != 8 {
+			return fmt.Errorf("psd: unsupported indexed depth: %v", h.Depth)
+		}
+	case MODE_GRAYSCALE, MODE_RGB, MODE_CMYK, MODE_MULTICHANNEL, MODE_DUOTONE, MODE_LAB:
+		if h.Depth != 8 && h.Depth != 16 {
+			return fmt.Errorf("psd: unsupported depth: %v", h.Depth)
+		}
+	default:
+		return fmt.Errorf("psd: mode not supported: %d", h.Mode)
 	}
 
 	d.header = h
+	if int(h.Channels) < d.colorChannels() {
+		return fmt.Errorf("psd: mode %d needs at least %d channels", h.Mode, d.colorChannels())
+	}
 	return nil
 }
 
 func (d *decoder) decode() error {
-	var err error
-
-	switch d.Mode {
-	case 1: // grayscale
-		err = d.decodeGray()
-	case 2: // indexed
-		err = d.decodeIndexed()
-	case 3: // rgb
-		err = d.decodeRGB()
-	case 4: // cmyk
-		err = d.decodeCMYK()
-	default:
-		err = fmt.Errorf("mode not supported: %d", d.Mode)
+	err := d.decodeSections()
+	if err != nil {
+		return err
 	}
 
-	return err
+	return d.decodeImage()
 }
 
-func (d *decoder) decodeGray() error {
-	return errors.New("mode gray not supported yet")
-}
-
-func (d *decoder) decodeIndexed() error {
-	return errors.New("mode indexed not supported yet")
-}
-
-func (d *decoder) decodeRGB() error {
-	var colorMode, resourceSize, miscInfo uint32
-	var compressed uint16
+// decodeSections reads everything between the header and the image data
+func (d *decoder) decodeSections() error {
+	var err error
 
-	err := d.rb(&colorMode)
+	d.colormap, err = readBlock(d.r)
 	if err != nil {
 		return err
 	}
 
-	// skip over color mode data section
-	err = nopRead(d.r, int64(colorMode))
+	d.resources, err = readBlock(d.r)
 	if err != nil {
 		return err
 	}
 
-	// resources
-	err = d.rb(&resourceSize)
-	if err != nil {
-		return err
-	}
-	resources := make([]byte, resourceSize)
-	_, err = io.ReadAtLeast(d.r, resources, int(resourceSize))
-	if err != nil {
-		return err
-	}
+	return d.decodeLayerSection()
+}
 
-	// misc info
-	err = d.rb(&miscInfo)
-	if err != nil {
-		return err
+// colorChannels is the number of channels holding color for the mode
+func (d *decoder) colorChannels() int {
+	switch d.Mode {
+	case MODE_RGB, MODE_LAB:
+		return 3
+	case MODE_CMYK:
+		return 4
+	case MODE_MULTICHANNEL:
+		if d.Channels >= 3 {
+			return 3
+		}
 	}
-	err = nopRead(d.r, int64(miscInfo))
+	return 1
+}
 
-	err = d.rb(&compressed)
-	if err != nil {
-		return err
+// hasAlpha reports whether the first channel after the
+// color channels is used as the alpha of the composite
+func (d *decoder) hasAlpha() bool {
+	switch d.Mode {
+	case MODE_BITMAP, MODE_INDEXED, MODE_MULTICHANNEL:
+		return false
 	}
+	return int(d.Channels) > d.colorChannels()
+}
 
-	var bpc int
-	rgba := image.NewRGBA(image.Rect(0, 0, int(d.Width), int(d.Height)))
-
-	// any channels beyond 5 combines into an alpha
-	switch c := d.Channels; {
-	case c >= 3:
-		bpc = 4
-	default:
-		return fmt.Errorf("unsupported number of rgb channels: %d", d.Channels)
+func (d *decoder) colorModel() color.Model {
+	switch {
+	case d.Mode == MODE_BITMAP:
+		return color.GrayModel
+	case d.Mode == MODE_INDEXED:
+		return d.palette()
+	case d.Mode == MODE_CMYK && d.Depth == 8 && !d.hasAlpha():
+		return color.CMYKModel
+	case d.hasAlpha() && d.Depth == 16:
+		return color.NRGBA64Model
+	case d.hasAlpha():
+		return color.NRGBAModel
+	case d.colorChannels() == 1 && d.Depth == 16:
+		return color.Gray16Model
+	case d.colorChannels() == 1:
+		return color.GrayModel
+	case d.Depth == 16:
+		return color.RGBA64Model
 	}
+	return color.RGBAModel
+}
 
-	switch d.Depth {
-	case 8, 16:
-	default:
-		return fmt.Errorf("unsupported rgb depth: %d", d.Depth)
+// palette builds the palette from the color mode data, it
+// stores all the reds followed by the greens and blues
+func (d *decoder) palette() color.Palette {
+	n := 256
+	if len(d.colormap) < 768 {
+		n = len(d.colormap) / 3
 	}
-
-	if compressed == 0 {
-	} else {
-		err := d.readDataCompressed(rgba.Pix, bpc)
-		if err != nil {
-			return err
+	if b := d.resource(resIndexedCount); len(b) >= 2 {
+		if c := int(binary.BigEndian.Uint16(b)); c > 0 && c < n {
+			n = c
 		}
 	}
 
-	d.img = rgba
-	return nil
-}
-
-func (d *decoder) decodeCMYK() error {
-	return errors.New("mode CYMK not supported yet")
-}
+	p := make(color.Palette, 256)
+	for i := range p {
+		p[i] = color.NRGBA{A: 0xff}
+	}
+	s := len(d.colormap) / 3
+	for i := 0; i < n; i++ {
+		p[i] = color.NRGBA{d.colormap[i], d.colormap[s+i], d.colormap[2*s+i], 0xff}
+	}
 
-func (d *decoder) readByte() (b byte, err error) {
-	var buf [1]byte
-	_, err = d.r.Read(buf[:])
-	b = buf[0]
-	return
+	if b := d.resource(resTransparencyIndex); len(b) >= 2 {
+		if t := int(binary.BigEndian.Uint16(b)); t < len(p) {
+			p[t] = color.NRGBA{}
+		}
+	}
+	return p
 }
 
-func (d *decoder) readInt8() (v int8, err error) {
-	b, err := d.readByte()
-	v = int8(b)
-	return
-}
+// resource returns the data of the image resource block with the given id
+func (d *decoder) resource(id uint16) []byte {
+	b := d.resources
+	for len(b) >= 8 && string(b[:4]) == "8BIM" {
+		rid := binary.BigEndian.Uint16(b[4:])
 
-func (d *decoder) rb(v interface{}) error {
-	return binary.Read(d.r, binary.BigEndian, v)
-}
+		// pascal string name padded to an even size
+		n := 6 + (int(b[6])+2)&^1
+		if n+4 > len(b) {
+			break
+		}
+		size := int(binary.BigEndian.Uint32(b[n:]))
+		n += 4
+		if size > len(b)-n {
+			break
+		}
+		if rid == id {
+			return b[n : n+size]
+		}
 
-func (d *decoder) numChan() int {
-	// needed to correctly load grayscale and paletted images
-	switch d.Mode {
-	case 1, 2:
-		return 1
+		n += (size + 1) &^ 1
+		if n > len(b) {
+			break
+		}
+		b = b[n:]
 	}
-	return 3
+	return nil
 }
 
-func (d *decoder) readDataCompressed(pix []byte, bpc int) error {
-	// TODO: add support for this, but very rare format
-	if d.Depth == 16 {
-		return errors.New("compressed format at depth 16 not supported")
+// decodeImage reads the composite image data
+func (d *decoder) decodeImage() error {
+	var compression uint16
+	err := d.rb(&compression)
+	if err != nil {
+		return errUnexpectedEOF(err)
 	}
 
-	_, err := d.getCompressedChanLen()
+	n := d.colorChannels()
+	if d.hasAlpha() {
+		n++
+	}
+	p, err := d.readPlanes(compression, n)
 	if err != nil {
 		return err
 	}
 
-	numChan := d.numChan()
 	w, h := int(d.Width), int(d.Height)
-	size := w * h
-	channel := make([]byte, w*h*int(d.Depth/8))
-	c := 0
-	for ; c < numChan; c++ {
-		err := d.readCompressedChan(size, channel)
-		if err != nil {
-			return err
-		}
-
-		i := 0
+	r := image.Rect(0, 0, w, h)
+	switch d.Mode {
+	case MODE_BITMAP:
+		// set bits are black
+		m := image.NewGray(r)
+		stride := (w + 7) / 8
 		for y := 0; y < h; y++ {
 			for x := 0; x < w; x++ {
-				j := (y*w + x) * bpc
-				pix[j+c] = channel[i]
-				if channel[i] != 0 {
-					pix[j+3] = 255
+				if p[0][y*stride+x/8]&(0x80>>uint(x%8)) == 0 {
+					m.Pix[y*m.Stride+x] = 0xff
 				}
-				i++
 			}
 		}
+		d.img = m
+		return nil
+
+	case MODE_INDEXED:
+		d.img = &image.Paletted{Pix: p[0], Stride: w, Rect: r, Palette: d.palette()}
+		return nil
 	}
 
-	// TODO: this needs to be changed for grayscale images
-	if d.Channels >= 4 {
-		for y := 0; y < h; y++ {
-			for x := 0; x < w; x++ {
-				i := (y*w + x) * bpc
-				pix[i+3] = 255
+	switch model := d.colorModel(); model {
+	case color.CMYKModel:
+		// samples are stored as 255 minus the ink amount
+		m := image.NewCMYK(r)
+		for i := 0; i < w*h; i++ {
+			for c := 0; c < 4; c++ {
+				m.Pix[i*4+c] = 255 - p[c][i]
 			}
 		}
+		d.img = m
 
-		for ; c < int(d.Channels); c++ {
-			err := d.readCompressedChan(size, channel)
-			if err != nil {
-				return err
-			}
+	case color.GrayModel:
+		d.img = &image.Gray{Pix: p[0], Stride: w, Rect: r}
 
-			i := 0
-			for y := 0; y < h; y++ {
-				for x := 0; x < w; x++ {
-					j := (y*w + x) * bpc
-					cv := byteToFloat32(pix[j+3])
-					nv := byteToFloat32(channel[i])
-					pix[j+3] = float32ToByte(cv * nv)
-					i++
-				}
-			}
-		}
+	case color.Gray16Model:
+		d.img = &image.Gray16{Pix: p[0], Stride: w * 2, Rect: r}
+
+	default:
+		d.img = d.convert(p, r, model, true)
 	}
 	return nil
 }
 
-func (d *decoder) readCompressedChan(size int, channel []byte) error {
-	for i := 0; i < size; {
-		b8, err := d.readInt8()
-		if err != nil {
-			return err
+// convert builds an image of the given model out of channel planes,
+// composite images with transparency are matted against white
+func (d *decoder) convert(p [][]byte, r image.Rectangle, model color.Model, matte bool) image.Image {
+	w, h := r.Dx(), r.Dy()
+	matte = matte && (d.Mode == MODE_GRAYSCALE || d.Mode == MODE_RGB)
+
+	var (
+		m   image.Image
+		pix []byte
+	)
+	switch model {
+	case color.NRGBAModel:
+		n := image.NewNRGBA(r)
+		m, pix = n, n.Pix
+	case color.NRGBA64Model:
+		n := image.NewNRGBA64(r)
+		m, pix = n, n.Pix
+	case color.RGBAModel:
+		n := image.NewRGBA(r)
+		m, pix = n, n.Pix
+	default:
+		n := image.NewRGBA64(r)
+		m, pix = n, n.Pix
+	}
+
+	for i := 0; i < w*h; i++ {
+		c := d.colorAt(p, i)
+		if matte {
+			c = unmatte(c)
 		}
-		hb := int(b8)
 
-		if hb >= 0 {
-			if i+hb > size {
-				return errors.New("corrupted compressed file")
-			}
+		switch model {
+		case color.NRGBAModel, color.RGBAModel:
+			pix[i*4] = uint8(c.R >> 8)
+			pix[i*4+1] = uint8(c.G >> 8)
+			pix[i*4+2] = uint8(c.B >> 8)
+			pix[i*4+3] = uint8(c.A >> 8)
+		default:
+			s := pix[i*8 : i*8+8]
+			binary.BigEndian.PutUint16(s[0:], c.R)
+			binary.BigEndian.PutUint16(s[2:], c.G)
+			binary.BigEndian.PutUint16(s[4:], c.B)
+			binary.BigEndian.PutUint16(s[6:], c.A)
+		}
+	}
+	return m
+}
 
-			_, err := io.ReadAtLeast(d.r, channel[i:i+hb+1], hb+1)
-			if err != nil {
-				return err
-			}
+// colorAt converts the samples of the color channels and the alpha
+// channel following them at index i, nil planes take default values
+func (d *decoder) colorAt(p [][]byte, i int) color.NRGBA64 {
+	s := func(c int, def uint16) uint16 {
+		if c >= len(p) || p[c] == nil {
+			return def
+		}
+		if d.Depth == 16 {
+			return binary.BigEndian.Uint16(p[c][i*2:])
+		}
+		return uint16(p[c][i]) * 0x101
+	}
+
+	nc := d.colorChannels()
+	c := color.NRGBA64{A: s(nc, 0xffff)}
+	switch d.Mode {
+	case MODE_GRAYSCALE, MODE_DUOTONE:
+		c.R = s(0, 0)
+		c.G, c.B = c.R, c.R
+
+	case MODE_RGB:
+		c.R, c.G, c.B = s(0, 0), s(1, 0), s(2, 0)
+
+	case MODE_MULTICHANNEL:
+		// like cmyk the samples are the inverse of the ink
+		c.R = s(0, 0xffff)
+		c.G, c.B = c.R, c.R
+		if nc == 3 {
+			c.G, c.B = s(1, 0xffff), s(2, 0xffff)
+		}
+
+	case MODE_CMYK:
+		k := uint32(s(3, 0xffff))
+		c.R = uint16(uint32(s(0, 0xffff)) * k / 0xffff)
+		c.G = uint16(uint32(s(1, 0xffff)) * k / 0xffff)
+		c.B = uint16(uint32(s(2, 0xffff)) * k / 0xffff)
+
+	case MODE_LAB:
+		c.R, c.G, c.B = lab(s(0, 0), s(1, 0x8080), s(2, 0x8080))
+	}
+	return c
+}
+
+// unmatte removes the white background blended into the composite
+func unmatte(c color.NRGBA64) color.NRGBA64 {
+	if c.A == 0 || c.A == 0xffff {
+		return c
+	}
+	f := func(v uint16) uint16 {
+		x := (int(v) - int(0xffff-c.A)) * 0xffff / int(c.A)
+		if x < 0 {
+			x = 0
+		}
+		if x > 0xffff {
+			x = 0xffff
+		}
+		return uint16(x)
+	}
+	return color.NRGBA64{f(c.R), f(c.G), f(c.B), c.A}
+}
+
+// lab converts from the D50 Lab color space to sRGB
+func lab(l, a, b uint16) (uint16, uint16, uint16) {
+	L := float64(l) / 0xffff * 100
+	A := float64(a)/0xffff*255 - 128
+	B := float64(b)/0xffff*255 - 128
+
+	f := func(t float64) float64 {
+		if t > 6.0/29 {
+			return t * t * t
+		}
+		return 3 * (6.0 / 29) * (6.0 / 29) * (t - 4.0/29)
+	}
+	fy := (L + 16) / 116
+	X := 0.9642 * f(fy+A/500)
+	Y := 1.0000 * f(fy)
+	Z := 0.8249 * f(fy-B/200)
+
+	// XYZ to linear sRGB with bradford adaptation from D50
+	rgb := [3]float64{
+		3.1338561*X - 1.6168667*Y - 0.4906146*Z,
+		-0.9787684*X + 1.9161415*Y + 0.0334540*Z,
+		0.0719453*X - 0.2289914*Y + 1.4052427*Z,
+	}
+	var v [3]uint16
+	for i := range rgb {
+		x := chroma.Linear2SRGB(math.Max(0, math.Min(1, rgb[i])))
+		v[i] = uint16(x*0xffff + .5)
+	}
+	return v[0], v[1], v[2]
+}
+
+// readPlanes reads the first n channels of the composite image
+func (d *decoder) readPlanes(compression uint16, n int) ([][]byte, error) {
+	w, h := int(d.Width), int(d.Height)
+	stride := (w*int(d.Depth) + 7) / 8
+	p := make([][]byte, n)
 
-			i += hb + 1
-		} else if hb >= -127 && hb <= -1 {
-			run, err := d.readByte()
+	var err error
+	switch compression {
+	case 0:
+		for i := range p {
+			p[i], err = readFull(d.r, int64(stride*h))
 			if err != nil {
-				return err
-			}
-			if i+(-hb+1) > size {
-				return errors.New("corrupted compressed file")
+				return nil, err
 			}
+		}
+
+	case 1:
+		// byte counts for every scanline of every channel
+		counts := make([]uint16, int(d.Channels)*h)
+		err = d.rb(counts)
+		if err != nil {
+			return nil, errUnexpectedEOF(err)
+		}
 
-			for j := 0; j < -hb+1; j++ {
-				channel[i+j] = run
+		var buf []byte
+		for i := range p {
+			p[i] = make([]byte, stride*h)
+			for y := 0; y < h; y++ {
+				c := int(counts[i*h+y])
+				if cap(buf) < c {
+					buf = make([]byte, c)
+				}
+				buf = buf[:c]
+				_, err = io.ReadFull(d.r, buf)
+				if err != nil {
+					return nil, errUnexpectedEOF(err)
+				}
+				err = unpackBits(p[i][y*stride:(y+1)*stride], buf)
+				if err != nil {
+					return nil, err
+				}
 			}
-			i += -hb + 1
 		}
-	}
-	return nil
-}
 
-// this is just a table for fast lookup, not really needed
-// if we just want to be simple about reading rle data
-// but we still need to read it in because we cant seek
-func (d *decoder) getCompressedChanLen() ([]uint, error) {
-	tab := make([]uint16, d.Height*uint32(d.Channels))
-	cl := make([]uint, d.Channels)
-	for i := range tab {
-		err := d.rb(&tab[i])
+	case 2, 3:
+		z, err := zlib.NewReader(d.r)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("psd: %v", err)
 		}
-	}
-	for c := 0; c < int(d.Channels); c++ {
-		j := c * int(d.Height)
-		for i := 0; i < int(d.Height); i++ {
-			cl[c] = uint(tab[i+j])
+		for i := range p {
+			p[i] = make([]byte, stride*h)
+			_, err = io.ReadFull(z, p[i])
+			if err != nil {
+				return nil, fmt.Errorf("psd: %v", err)
+			}
+			if compression == 3 && d.Depth >= 8 {
+				unpredict(p[i], w, int(d.Depth)/8)
+			}
 		}
+
+	default:
+		return nil, fmt.Errorf("psd: unsupported compression %d", compression)
 	}
-	return cl, nil
+	return p, nil
+}
+
+func (d *decoder) rb(v interface{}) error {
+	return binary.Read(d.r, binary.BigEndian, v)
 }
 
 func nopRead(r io.Reader, length int64) error {
@@ -365,9 +562,6 @@ func nopRead(r io.Reader, length int64) error {
 	return nil
 }
 
-func byteToFloat32(v byte) float32 { return float32(v) / 255 }
-func float32ToByte(v float32) byte { return byte(v * 255) }
-
 func init() {
 	image.RegisterFormat("psd", psdHeader, Decode, DecodeConfig)
 }
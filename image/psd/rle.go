@@ -0,0 +1,67 @@
+package psd
+
+import (
+	"errors"
+	"io"
+)
+
+// unpackBits decodes packbits data until dst is full
+func unpackBits(dst, src []byte) error {
+	i, j := 0, 0
+	for i < len(dst) {
+		if j >= len(src) {
+			return io.ErrUnexpectedEOF
+		}
+		n := int(int8(src[j]))
+		j++
+
+		switch {
+		case n >= 0:
+			n++
+			if i+n > len(dst) || j+n > len(src) {
+				return errors.New("psd: corrupted compressed data")
+			}
+			copy(dst[i:], src[j:j+n])
+			i += n
+			j += n
+
+		case n > -128:
+			n = 1 - n
+			if i+n > len(dst) || j >= len(src) {
+				return errors.New("psd: corrupted compressed data")
+			}
+			for k := 0; k < n; k++ {
+				dst[i+k] = src[j]
+			}
+			i += n
+			j++
+		}
+	}
+	return nil
+}
+
+// packBits appends the packbits encoding of src to dst
+func packBits(dst, src []byte) []byte {
+	for i := 0; i < len(src); {
+		j := i + 1
+		for j < len(src) && j-i < 128 && src[j] == src[i] {
+			j++
+		}
+		if j-i > 1 {
+			dst = append(dst, byte(1-(j-i)), src[i])
+			i = j
+			continue
+		}
+
+		// literals run until the next run of at least 3 bytes
+		for j = i; j < len(src) && j-i < 128; j++ {
+			if j+2 < len(src) && src[j] == src[j+1] && src[j] == src[j+2] {
+				break
+			}
+		}
+		dst = append(dst, byte(j-i-1))
+		dst = append(dst, src[i:j]...)
+		i = j
+	}
+	return dst
+}
@@ -0,0 +1,502 @@
+package psd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"unicode/utf16"
+)
+
+type encoder struct {
+	w     *bufio.Writer
+	doc   *Document
+	mode  int
+	depth int
+	nc    int
+	rect  image.Rectangle
+}
+
+// Encode writes a flat image, 16 bit images are
+// written with 16 bits per channel
+func Encode(w io.Writer, m image.Image) error {
+	doc := &Document{
+		Mode:  MODE_RGB,
+		Depth: 8,
+		Image: m,
+	}
+	switch m.(type) {
+	case *image.Gray:
+		doc.Mode = MODE_GRAYSCALE
+	case *image.Gray16:
+		doc.Mode, doc.Depth = MODE_GRAYSCALE, 16
+	case *image.RGBA64, *image.NRGBA64:
+		doc.Depth = 16
+	}
+	return EncodeDocument(w, doc)
+}
+
+// EncodeDocument writes a layered document using packbits compression,
+// Mode can be MODE_GRAYSCALE or MODE_RGB and Depth 8 or 16, other
+// modes are written as RGB and other depths as 8 bits. Layer images
+// are placed at Rect.Min, or at their own bounds if Rect is empty.
+// Layers are written as they are, so Opacity and Visible must be set
+// or the layer is hidden and fully transparent. If the document has
+// no composite image one is made by drawing the visible layers over
+// each other, ignoring the blend modes
+func EncodeDocument(w io.Writer, doc *Document) error {
+	e := &encoder{
+		w:     bufio.NewWriter(w),
+		doc:   doc,
+		mode:  MODE_RGB,
+		depth: 8,
+		nc:    3,
+	}
+	if doc.Mode == MODE_GRAYSCALE {
+		e.mode, e.nc = MODE_GRAYSCALE, 1
+	}
+	if doc.Depth == 16 {
+		e.depth = 16
+	}
+
+	e.rect = image.Rect(0, 0, doc.Width, doc.Height)
+	if e.rect.Empty() {
+		if doc.Image != nil {
+			e.rect = image.Rect(0, 0, doc.Image.Bounds().Dx(), doc.Image.Bounds().Dy())
+		} else {
+			r := layerBounds(doc.Layers)
+			e.rect = image.Rect(0, 0, r.Max.X, r.Max.Y)
+		}
+	}
+	if e.rect.Dx() < 1 || e.rect.Dy() < 1 || e.rect.Dx() > 30000 || e.rect.Dy() > 30000 {
+		return fmt.Errorf("psd: invalid dimension %dx%d", e.rect.Dx(), e.rect.Dy())
+	}
+
+	m := doc.Image
+	if m == nil {
+		m = e.flatten()
+	}
+	alpha := !opaque(m)
+
+	channels := e.nc
+	if alpha {
+		channels++
+	}
+	h := header{
+		Version:  1,
+		Channels: uint16(channels),
+		Width:    uint32(e.rect.Dx()),
+		Height:   uint32(e.rect.Dy()),
+		Depth:    uint16(e.depth),
+		Mode:     uint16(e.mode),
+	}
+	copy(h.Sig[:], psdHeader)
+	binary.Write(e.w, binary.BigEndian, &h)
+
+	// color mode data and image resources
+	binary.Write(e.w, binary.BigEndian, [2]uint32{})
+
+	e.writeLayerSection(alpha)
+	e.writeImage(m, alpha)
+
+	err := e.w.Flush()
+	if err != nil {
+		return fmt.Errorf("psd: %v", err)
+	}
+	return nil
+}
+
+func layerBounds(layers []*Layer) image.Rectangle {
+	var r image.Rectangle
+	for _, l := range layers {
+		r = r.Union(l.bounds()).Union(layerBounds(l.Layers))
+	}
+	return r
+}
+
+// bounds places the layer image at Rect.Min, or at
+// the image bounds if the rectangle is empty
+func (l *Layer) bounds() image.Rectangle {
+	if l.Image == nil {
+		return l.Rect
+	}
+	r := l.Image.Bounds()
+	if l.Rect.Empty() {
+		return r
+	}
+	return r.Sub(r.Min).Add(l.Rect.Min)
+}
+
+func opaque(m image.Image) bool {
+	if o, ok := m.(interface {
+		Opaque() bool
+	}); ok {
+		return o.Opaque()
+	}
+
+	r := m.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if _, _, _, a := m.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// flatten draws the visible layers from bottom to top
+func (e *encoder) flatten() image.Image {
+	m := image.NewNRGBA64(e.rect)
+	var draws func(layers []*Layer)
+	draws = func(layers []*Layer) {
+		for _, l := range layers {
+			if !l.Visible {
+				continue
+			}
+			if l.Group {
+				draws(l.Layers)
+				continue
+			}
+			if l.Image == nil {
+				continue
+			}
+			mask := image.NewUniform(color.Alpha{l.Opacity})
+			draw.DrawMask(m, l.bounds(), l.Image, l.Image.Bounds().Min, mask, image.Point{}, draw.Over)
+		}
+	}
+	draws(e.doc.Layers)
+	return m
+}
+
+// planes splits the image in the rectangle into channel planes
+// followed by alpha, matte blends the colors against white
+func (e *encoder) planes(m image.Image, r image.Rectangle, alpha, matte bool) [][]byte {
+	n := e.nc
+	if alpha {
+		n++
+	}
+	bpc := e.depth / 8
+	p := make([][]byte, n)
+	for i := range p {
+		p[i] = make([]byte, r.Dx()*r.Dy()*bpc)
+	}
+
+	put := func(c, i int, v uint16) {
+		if bpc == 2 {
+			binary.BigEndian.PutUint16(p[c][i*2:], v)
+		} else {
+			p[c][i] = uint8(v >> 8)
+		}
+	}
+
+	i := 0
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := nrgba64At(m, x, y)
+			if matte {
+				pr, pg, pb, pa := c.RGBA()
+				c = color.NRGBA64{
+					uint16(pr + 0xffff - pa),
+					uint16(pg + 0xffff - pa),
+					uint16(pb + 0xffff - pa),
+					c.A,
+				}
+			}
+
+			if e.nc == 1 {
+				g := color.Gray16Model.Convert(color.NRGBA64{c.R, c.G, c.B, 0xffff}).(color.Gray16)
+				put(0, i, g.Y)
+			} else {
+				put(0, i, c.R)
+				put(1, i, c.G)
+				put(2, i, c.B)
+			}
+			if alpha {
+				put(e.nc, i, c.A)
+			}
+			i++
+		}
+	}
+	return p
+}
+
+// nrgba64At avoids going through premultiplied alpha
+// for images that store straight alpha
+func nrgba64At(m image.Image, x, y int) color.NRGBA64 {
+	switch m := m.(type) {
+	case *image.NRGBA:
+		c := m.NRGBAAt(x, y)
+		return color.NRGBA64{
+			uint16(c.R) * 0x101,
+			uint16(c.G) * 0x101,
+			uint16(c.B) * 0x101,
+			uint16(c.A) * 0x101,
+		}
+	case *image.NRGBA64:
+		return m.NRGBA64At(x, y)
+	}
+	return color.NRGBA64Model.Convert(m.At(x, y)).(color.NRGBA64)
+}
+
+// compress packs the rows of a plane, returning the
+// byte count of each row and the compressed data
+func (e *encoder) compress(p []byte, w, h int) ([]uint16, []byte) {
+	stride := w * e.depth / 8
+	counts := make([]uint16, h)
+	var b []byte
+	for y := 0; y < h; y++ {
+		n := len(b)
+		b = packBits(b, p[y*stride:(y+1)*stride])
+		counts[y] = uint16(len(b) - n)
+	}
+	return counts, b
+}
+
+// writeImage writes the composite image data
+func (e *encoder) writeImage(m image.Image, alpha bool) {
+	r := e.rect.Add(m.Bounds().Min)
+	p := e.planes(m, r, alpha, alpha)
+
+	var (
+		counts []uint16
+		data   [][]byte
+	)
+	for i := range p {
+		c, b := e.compress(p[i], r.Dx(), r.Dy())
+		counts = append(counts, c...)
+		data = append(data, b)
+	}
+
+	binary.Write(e.w, binary.BigEndian, uint16(1))
+	binary.Write(e.w, binary.BigEndian, counts)
+	for i := range data {
+		e.w.Write(data[i])
+	}
+}
+
+// writeLayerSection writes the layer and mask information,
+// 16 bit layers are stored in the additional layer info like
+// photoshop does it
+func (e *encoder) writeLayerSection(alpha bool) {
+	if len(e.doc.Layers) == 0 {
+		binary.Write(e.w, binary.BigEndian, uint32(0))
+		return
+	}
+
+	info := e.layerInfo(alpha)
+	b := new(bytes.Buffer)
+	if e.depth == 16 {
+		binary.Write(b, binary.BigEndian, [2]uint32{})
+		writeTaggedBlock(b, "Lr16", info)
+	} else {
+		binary.Write(b, binary.BigEndian, uint32(len(info)))
+		b.Write(info)
+		binary.Write(b, binary.BigEndian, uint32(0))
+	}
+
+	binary.Write(e.w, binary.BigEndian, uint32(b.Len()))
+	e.w.Write(b.Bytes())
+}
+
+// layerInfo builds the layer records followed by the channel data,
+// groups are stored as a divider, their children and then the group
+func (e *encoder) layerInfo(alpha bool) []byte {
+	var layers []*layerInfo
+	var walk func([]*Layer)
+	walk = func(ls []*Layer) {
+		for _, l := range ls {
+			if l.Group {
+				layers = append(layers, &layerInfo{
+					Layer:   &Layer{Name: "</Layer group>", BlendMode: BLEND_NORMAL},
+					section: sectionEnd,
+				})
+				walk(l.Layers)
+				layers = append(layers, &layerInfo{Layer: l, section: sectionOpen})
+			} else {
+				layers = append(layers, &layerInfo{Layer: l})
+			}
+		}
+	}
+	walk(e.doc.Layers)
+
+	records := new(bytes.Buffer)
+	data := new(bytes.Buffer)
+
+	// a negative count marks the first alpha
+	// channel as the transparency of the composite
+	count := int16(len(layers))
+	if alpha {
+		count = -count
+	}
+	binary.Write(records, binary.BigEndian, count)
+
+	for _, l := range layers {
+		chans := e.layerChannels(l)
+
+		r := l.bounds()
+		if l.Group || l.section == sectionEnd {
+			r = image.Rectangle{}
+		}
+		binary.Write(records, binary.BigEndian, &layerRecord{
+			int32(r.Min.Y), int32(r.Min.X), int32(r.Max.Y), int32(r.Max.X),
+			uint16(len(chans)),
+		})
+		for _, c := range chans {
+			binary.Write(records, binary.BigEndian, channelInfo{int16(c.id), uint32(len(c.data))})
+			data.Write(c.data)
+		}
+
+		extra := e.layerExtra(l)
+		lb := layerBlend{
+			Opacity: l.Opacity,
+			Extra:   uint32(len(extra)),
+		}
+		copy(lb.Sig[:], "8BIM")
+		copy(lb.Key[:], blendKey(l))
+		if l.section == sectionEnd {
+			lb.Opacity = 0xff
+		}
+		if l.Clipping {
+			lb.Clipping = 1
+		}
+		if !l.Visible && l.section != sectionEnd {
+			lb.Flags |= 2
+		}
+		binary.Write(records, binary.BigEndian, &lb)
+		records.Write(extra)
+	}
+
+	records.Write(data.Bytes())
+	if records.Len()%2 != 0 {
+		records.WriteByte(0)
+	}
+	return records.Bytes()
+}
+
+type channelData struct {
+	id   int
+	data []byte
+}
+
+// layerChannels encodes the alpha, color and mask channels of a layer
+func (e *encoder) layerChannels(l *layerInfo) []channelData {
+	var chans []channelData
+
+	ids := []int{CHANNEL_ALPHA, 0, 1, 2}[:e.nc+1]
+	if l.Group || l.section == sectionEnd || l.Image == nil {
+		for _, id := range ids {
+			chans = append(chans, channelData{id, []byte{0, 0}})
+		}
+		return chans
+	}
+
+	r := l.Image.Bounds()
+	p := e.planes(l.Image, r, true, false)
+	p = append(p[e.nc:], p[:e.nc]...)
+	for i, id := range ids {
+		chans = append(chans, channelData{id, e.channel(p[i], r.Dx(), r.Dy())})
+	}
+
+	if k := l.Mask; k != nil && k.Image != nil {
+		mr := k.Image.Bounds()
+		b := make([]byte, mr.Dx()*mr.Dy()*e.depth/8)
+		i := 0
+		for y := mr.Min.Y; y < mr.Max.Y; y++ {
+			for x := mr.Min.X; x < mr.Max.X; x++ {
+				g := color.Gray16Model.Convert(k.Image.At(x, y)).(color.Gray16)
+				if e.depth == 16 {
+					binary.BigEndian.PutUint16(b[i*2:], g.Y)
+				} else {
+					b[i] = uint8(g.Y >> 8)
+				}
+				i++
+			}
+		}
+		chans = append(chans, channelData{CHANNEL_MASK, e.channel(b, mr.Dx(), mr.Dy())})
+	}
+	return chans
+}
+
+// channel compresses one channel of a layer
+func (e *encoder) channel(p []byte, w, h int) []byte {
+	counts, data := e.compress(p, w, h)
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.BigEndian, uint16(1))
+	binary.Write(b, binary.BigEndian, counts)
+	b.Write(data)
+	return b.Bytes()
+}
+
+// layerExtra builds the mask, blending ranges, name and additional info of a layer
+func (e *encoder) layerExtra(l *layerInfo) []byte {
+	b := new(bytes.Buffer)
+
+	if k := l.Mask; k != nil && k.Image != nil && !l.Group {
+		r := k.Image.Bounds()
+		if !k.Rect.Empty() {
+			r = r.Sub(r.Min).Add(k.Rect.Min)
+		}
+		binary.Write(b, binary.BigEndian, uint32(20))
+		binary.Write(b, binary.BigEndian, &maskRecord{
+			int32(r.Min.Y), int32(r.Min.X), int32(r.Max.Y), int32(r.Max.X),
+			k.DefaultColor, k.Flags,
+		})
+		b.Write([]byte{0, 0})
+	} else {
+		binary.Write(b, binary.BigEndian, uint32(0))
+	}
+
+	// blending ranges
+	binary.Write(b, binary.BigEndian, uint32(0))
+
+	// pascal string padded to a multiple of 4 bytes
+	name := []byte(l.Name)
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	b.WriteByte(uint8(len(name)))
+	b.Write(name)
+	b.Write(make([]byte, 3-len(name)%4))
+
+	u := utf16.Encode([]rune(l.Name))
+	luni := make([]byte, 4+len(u)*2)
+	binary.BigEndian.PutUint32(luni, uint32(len(u)))
+	for i := range u {
+		binary.BigEndian.PutUint16(luni[4+i*2:], u[i])
+	}
+	writeTaggedBlock(b, "luni", luni)
+
+	if l.section != sectionOther {
+		lsct := make([]byte, 12)
+		binary.BigEndian.PutUint32(lsct, uint32(l.section))
+		copy(lsct[4:], "8BIM")
+		copy(lsct[8:], blendKey(l))
+		writeTaggedBlock(b, "lsct", lsct)
+	}
+	return b.Bytes()
+}
+
+func blendKey(l *layerInfo) string {
+	switch {
+	case len(l.BlendMode) == 4:
+		return l.BlendMode
+	case l.Group:
+		return BLEND_PASS_THROUGH
+	}
+	return BLEND_NORMAL
+}
+
+// writeTaggedBlock writes an additional layer information block padded to an even size
+func writeTaggedBlock(w io.Writer, key string, data []byte) {
+	n := (len(data) + 1) &^ 1
+	io.WriteString(w, "8BIM")
+	io.WriteString(w, key)
+	binary.Write(w, binary.BigEndian, uint32(n))
+	w.Write(data)
+	w.Write(make([]byte, n-len(data)))
+}
@@ -0,0 +1,205 @@
+package qoi
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// frames returns the fixtures shared by the tests and benchmarks,
+// they cover the runs, index hits, small differences and alpha
+// changes the encoder has ops for
+func frames() []struct {
+	name string
+	m    image.Image
+} {
+	r := image.Rect(0, 0, 512, 384)
+
+	photo := image.NewRGBA(r)
+	seed := uint32(1)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			seed = seed*1664525 + 1013904223
+			n := uint8(seed>>28) - 8
+			i := photo.PixOffset(x, y)
+			photo.Pix[i] = uint8(x/2) + n
+			photo.Pix[i+1] = uint8(y/2) + n
+			photo.Pix[i+2] = uint8((x+y)/4) + n
+			photo.Pix[i+3] = 0xff
+		}
+	}
+
+	flat := image.NewRGBA(r)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			c := uint8((x/37 + y/23) % 5 * 60)
+			flat.SetRGBA(x, y, color.RGBA{c, 255 - c, c / 2, 0xff})
+		}
+	}
+
+	alpha := image.NewNRGBA(r)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			alpha.SetNRGBA(x, y, color.NRGBA{uint8(x), uint8(y), uint8(x ^ y), uint8(x * y / 64)})
+		}
+	}
+
+	premul := image.NewRGBA(r)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			a := uint8(x + y)
+			premul.SetRGBA(x, y, color.RGBA{a / 3, a / 2, a - a/7, a})
+		}
+	}
+
+	return []struct {
+		name string
+		m    image.Image
+	}{
+		{"photo", photo},
+		{"flat", flat},
+		{"alpha", alpha},
+		{"premul", premul},
+	}
+}
+
+func equal(t *testing.T, name string, a, b image.Image) {
+	ra, rb := a.Bounds(), b.Bounds()
+	if ra.Size() != rb.Size() {
+		t.Fatalf("%s: size %v, want %v", name, rb.Size(), ra.Size())
+	}
+	for y := 0; y < ra.Dy(); y++ {
+		for x := 0; x < ra.Dx(); x++ {
+			ca := color.NRGBAModel.Convert(a.At(ra.Min.X+x, ra.Min.Y+y))
+			cb := color.NRGBAModel.Convert(b.At(rb.Min.X+x, rb.Min.Y+y))
+			if ca != cb {
+				t.Fatalf("%s: pixel (%d, %d) is %v, want %v", name, x, y, cb, ca)
+			}
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, f := range frames() {
+		var b bytes.Buffer
+		if err := Encode(&b, f.m, nil); err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+		m, err := Decode(&b)
+		if err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+		equal(t, f.name, f.m, m)
+	}
+}
+
+func TestRoundTripSubImage(t *testing.T) {
+	for _, f := range frames() {
+		s := f.m.(interface {
+			SubImage(image.Rectangle) image.Image
+		}).SubImage(image.Rect(13, 7, 300, 211))
+
+		var b bytes.Buffer
+		if err := Encode(&b, s, nil); err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+		m, err := Decode(&b)
+		if err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+		equal(t, f.name, s, m)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	for _, f := range frames() {
+		var b bytes.Buffer
+		if err := Encode(&b, f.m, &Options{Channels: 3}); err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+		c, err := DecodeConfig(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+		if c.ColorModel != color.RGBAModel {
+			t.Errorf("%s: three channel image is not opaque", f.name)
+		}
+
+		m, err := Decode(&b)
+		if err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+		if _, _, _, a := m.At(5, 5).RGBA(); a != 0xffff {
+			t.Errorf("%s: alpha is %#x, want 0xffff", f.name, a)
+		}
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	var b bytes.Buffer
+	if err := Encode(&b, frames()[0].m, nil); err != nil {
+		t.Fatal(err)
+	}
+	p := b.Bytes()
+	if _, err := Decode(bytes.NewReader(p[:len(p)/2])); err == nil {
+		t.Error("truncated image decoded without an error")
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for _, f := range frames() {
+		b.Run(f.name, func(b *testing.B) {
+			r := f.m.Bounds()
+			b.SetBytes(int64(r.Dx() * r.Dy() * 4))
+			for i := 0; i < b.N; i++ {
+				var w bytes.Buffer
+				Encode(&w, f.m, nil)
+			}
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	for _, f := range frames() {
+		b.Run(f.name, func(b *testing.B) {
+			var w bytes.Buffer
+			Encode(&w, f.m, nil)
+			r := f.m.Bounds()
+			b.SetBytes(int64(r.Dx() * r.Dy() * 4))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				Decode(bytes.NewReader(w.Bytes()))
+			}
+		})
+	}
+}
+
+func BenchmarkEncodePNG(b *testing.B) {
+	for _, f := range frames() {
+		b.Run(f.name, func(b *testing.B) {
+			r := f.m.Bounds()
+			b.SetBytes(int64(r.Dx() * r.Dy() * 4))
+			for i := 0; i < b.N; i++ {
+				var w bytes.Buffer
+				png.Encode(&w, f.m)
+			}
+		})
+	}
+}
+
+func BenchmarkDecodePNG(b *testing.B) {
+	for _, f := range frames() {
+		b.Run(f.name, func(b *testing.B) {
+			var w bytes.Buffer
+			png.Encode(&w, f.m)
+			r := f.m.Bounds()
+			b.SetBytes(int64(r.Dx() * r.Dy() * 4))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				png.Decode(bytes.NewReader(w.Bytes()))
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package qoi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+const (
+	opIndex = 0x00
+	opDiff  = 0x40
+	opLuma  = 0x80
+	opRun   = 0xc0
+	opRGB   = 0xfe
+	opRGBA  = 0xff
+	opMask  = 0xc0
+)
+
+const (
+	COLORSPACE_SRGB   = 0
+	COLORSPACE_LINEAR = 1
+)
+
+const (
+	qoiHeader = "qoif"
+
+	// the reference implementation refuses anything bigger
+	maxPixels = 400000000
+)
+
+var padding = [8]byte{7: 1}
+
+type header struct {
+	Magic      [4]byte
+	Width      uint32
+	Height     uint32
+	Channels   uint8
+	Colorspace uint8
+}
+
+type decoder struct {
+	header
+	r *bufio.Reader
+}
+
+func Decode(r io.Reader) (image.Image, error) {
+	d := &decoder{r: bufio.NewReader(r)}
+	err := d.decodeHeader()
+	if err != nil {
+		return nil, err
+	}
+	return d.decode()
+}
+
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	d := &decoder{r: bufio.NewReader(r)}
+	err := d.decodeHeader()
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	model := color.NRGBAModel
+	if d.Channels == 3 {
+		model = color.RGBAModel
+	}
+	return image.Config{
+		ColorModel: model,
+		Width:      int(d.Width),
+		Height:     int(d.Height),
+	}, nil
+}
+
+func (d *decoder) decodeHeader() error {
+	err := binary.Read(d.r, binary.BigEndian, &d.header)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("qoi: %v", err)
+	}
+
+	if string(d.Magic[:]) != qoiHeader {
+		return errors.New("qoi: invalid signature")
+	}
+	if d.Width == 0 || d.Height == 0 || uint64(d.Width)*uint64(d.Height) > maxPixels {
+		return fmt.Errorf("qoi: invalid dimension %dx%d", d.Width, d.Height)
+	}
+	if d.Channels != 3 && d.Channels != 4 {
+		return fmt.Errorf("qoi: invalid number of channels %d", d.Channels)
+	}
+	if d.Colorspace > COLORSPACE_LINEAR {
+		return fmt.Errorf("qoi: invalid colorspace %d", d.Colorspace)
+	}
+	return nil
+}
+
+// decode reads the pixels into an rgba buffer, three channel
+// images are always opaque so they are returned as *image.RGBA
+func (d *decoder) decode() (image.Image, error) {
+	var (
+		m     image.Image
+		pix   []byte
+		index [64][4]byte
+	)
+	r := image.Rect(0, 0, int(d.Width), int(d.Height))
+	if d.Channels == 3 {
+		p := image.NewRGBA(r)
+		m, pix = p, p.Pix
+	} else {
+		p := image.NewNRGBA(r)
+		m, pix = p, p.Pix
+	}
+
+	px := [4]byte{0, 0, 0, 0xff}
+	run := 0
+	for i := 0; i < len(pix); i += 4 {
+		if run > 0 {
+			run--
+		} else {
+			b, err := d.r.ReadByte()
+			if err != nil {
+				return nil, fmt.Errorf("qoi: %v", io.ErrUnexpectedEOF)
+			}
+
+			switch {
+			case b == opRGB:
+				_, err = io.ReadFull(d.r, px[:3])
+			case b == opRGBA:
+				_, err = io.ReadFull(d.r, px[:])
+			case b&opMask == opIndex:
+				px = index[b]
+			case b&opMask == opDiff:
+				px[0] += (b>>4)&3 - 2
+				px[1] += (b>>2)&3 - 2
+				px[2] += b&3 - 2
+			case b&opMask == opLuma:
+				var c byte
+				c, err = d.r.ReadByte()
+				dg := b&0x3f - 32
+				px[0] += dg - 8 + (c >> 4)
+				px[1] += dg
+				px[2] += dg - 8 + c&0xf
+			case b&opMask == opRun:
+				run = int(b & 0x3f)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("qoi: %v", io.ErrUnexpectedEOF)
+			}
+			index[hash(px)] = px
+		}
+		copy(pix[i:i+4], px[:])
+	}
+	return m, nil
+}
+
+func hash(p [4]byte) byte {
+	return (p[0]*3 + p[1]*5 + p[2]*7 + p[3]*11) & 63
+}
+
+func init() {
+	image.RegisterFormat("qoi", qoiHeader, Decode, DecodeConfig)
+}
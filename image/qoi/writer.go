@@ -0,0 +1,172 @@
+package qoi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+type Options struct {
+	// Channels is 3 or 4, zero picks 4 if the image
+	// has transparency and 3 otherwise
+	Channels int
+
+	// Colorspace is recorded in the header, the
+	// pixels are written as they are either way
+	Colorspace int
+}
+
+type encoder struct {
+	w     *bufio.Writer
+	index [64][4]byte
+	prev  [4]byte
+	run   int
+	alpha bool
+	out   []byte
+}
+
+// Encode writes the pixels as they are read from the image,
+// the output is streamed without buffering the whole image
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	if o == nil {
+		o = &Options{}
+	}
+
+	r := m.Bounds()
+	if r.Dx() < 1 || r.Dy() < 1 || int64(r.Dx())*int64(r.Dy()) > maxPixels {
+		return fmt.Errorf("qoi: invalid dimension %dx%d", r.Dx(), r.Dy())
+	}
+
+	channels := o.Channels
+	if channels == 0 {
+		channels = 4
+		if p, ok := m.(interface{ Opaque() bool }); ok && p.Opaque() {
+			channels = 3
+		}
+	}
+	if channels != 3 && channels != 4 {
+		return fmt.Errorf("qoi: invalid number of channels %d", channels)
+	}
+	if o.Colorspace != COLORSPACE_SRGB && o.Colorspace != COLORSPACE_LINEAR {
+		return fmt.Errorf("qoi: invalid colorspace %d", o.Colorspace)
+	}
+
+	e := &encoder{
+		w:     bufio.NewWriter(w),
+		prev:  [4]byte{0, 0, 0, 0xff},
+		alpha: channels == 4,
+	}
+	h := header{
+		Width:      uint32(r.Dx()),
+		Height:     uint32(r.Dy()),
+		Channels:   uint8(channels),
+		Colorspace: uint8(o.Colorspace),
+	}
+	copy(h.Magic[:], qoiHeader)
+	binary.Write(e.w, binary.BigEndian, &h)
+
+	switch m := m.(type) {
+	case *image.NRGBA:
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			p := m.Pix[m.PixOffset(r.Min.X, y):m.PixOffset(r.Max.X, y)]
+			for i := 0; i < len(p); i += 4 {
+				e.pixel([4]byte{p[i], p[i+1], p[i+2], p[i+3]})
+			}
+			e.flush()
+		}
+
+	case *image.RGBA:
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			p := m.Pix[m.PixOffset(r.Min.X, y):m.PixOffset(r.Max.X, y)]
+			for i := 0; i < len(p); i += 4 {
+				px := [4]byte{p[i], p[i+1], p[i+2], p[i+3]}
+				if a := uint32(px[3]) * 0x101; a != 0xffff && a != 0 {
+					px[0] = uint8(uint32(px[0]) * 0x101 * 0xffff / a >> 8)
+					px[1] = uint8(uint32(px[1]) * 0x101 * 0xffff / a >> 8)
+					px[2] = uint8(uint32(px[2]) * 0x101 * 0xffff / a >> 8)
+				}
+				e.pixel(px)
+			}
+			e.flush()
+		}
+
+	default:
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+				e.pixel([4]byte{c.R, c.G, c.B, c.A})
+			}
+			e.flush()
+		}
+	}
+	e.flushRun()
+	e.flush()
+	e.w.Write(padding[:])
+
+	err := e.w.Flush()
+	if err != nil {
+		return fmt.Errorf("qoi: %v", err)
+	}
+	return nil
+}
+
+func (e *encoder) pixel(px [4]byte) {
+	if !e.alpha {
+		px[3] = 0xff
+	}
+	if px == e.prev {
+		e.run++
+		if e.run == 62 {
+			e.flushRun()
+		}
+		return
+	}
+	e.flushRun()
+
+	h := hash(px)
+	if e.index[h] == px {
+		e.out = append(e.out, opIndex|h)
+		e.prev = px
+		return
+	}
+	e.index[h] = px
+
+	b := e.out
+	if px[3] != e.prev[3] {
+		b = append(b, opRGBA, px[0], px[1], px[2], px[3])
+	} else {
+		// wrapping differences in the range of the small ops
+		dr := int8(px[0] - e.prev[0])
+		dg := int8(px[1] - e.prev[1])
+		db := int8(px[2] - e.prev[2])
+		dgr := dr - dg
+		dgb := db - dg
+		switch {
+		case -2 <= dr && dr <= 1 && -2 <= dg && dg <= 1 && -2 <= db && db <= 1:
+			b = append(b, opDiff|uint8(dr+2)<<4|uint8(dg+2)<<2|uint8(db+2))
+		case -32 <= dg && dg <= 31 && -8 <= dgr && dgr <= 7 && -8 <= dgb && dgb <= 7:
+			b = append(b, opLuma|uint8(dg+32), uint8(dgr+8)<<4|uint8(dgb+8))
+		default:
+			b = append(b, opRGB, px[0], px[1], px[2])
+		}
+	}
+	e.out = b
+	e.prev = px
+}
+
+func (e *encoder) flushRun() {
+	if e.run > 0 {
+		e.out = append(e.out, opRun|uint8(e.run-1))
+		e.run = 0
+	}
+}
+
+// flush writes the ops encoded so far, it is called once per row
+// to keep the writes large while streaming the image
+func (e *encoder) flush() {
+	e.w.Write(e.out)
+	e.out = e.out[:0]
+}
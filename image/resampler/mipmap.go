@@ -0,0 +1,142 @@
+package resampler
+
+import (
+	"image"
+	"image/draw"
+
+	"github.com/qeedquan/go-media/math/f64"
+	"github.com/qeedquan/go-media/math/mathutil"
+)
+
+type MipmapOptions struct {
+	// Wrap samples past the edges from the opposite side for
+	// tiling textures, otherwise the edges are clamped
+	Wrap bool
+
+	// PowerOfTwo scales the base level up to the next power
+	// of two in each dimension before the chain is built
+	PowerOfTwo bool
+
+	// AlphaTest is the cutoff of cutout textures in [0, 1], the alpha of
+	// every level is scaled so the same fraction of pixels pass the test
+	// as in the base level, zero leaves the filtered alpha as is
+	AlphaTest float64
+
+	// Levels limits the number of levels including the base,
+	// zero builds the chain down to 1x1
+	Levels int
+}
+
+// GenerateMipmaps returns the mipmap chain of the image starting with
+// the base level, each level halves the size of the previous one rounding
+// down and the levels are *image.NRGBA filtered in linear light with the
+// colors weighted by alpha, an unknown filter name uses the box filter
+func GenerateMipmaps(m image.Image, filter string, mo *MipmapOptions) []image.Image {
+	if mo == nil {
+		mo = &MipmapOptions{}
+	}
+	f := GetFilter(filter)
+	if f.Sample == nil {
+		f = GetFilter("box")
+	}
+	o := &Options{
+		BoundaryOp:    BOUNDARY_CLAMP,
+		Filter:        f,
+		SampleRange:   f64.Vec2{0, 1},
+		FilterScale:   f64.Vec2{1, 1},
+		AlphaWeighted: true,
+	}
+	if mo.Wrap {
+		o.BoundaryOp = BOUNDARY_WRAP
+	}
+
+	r := m.Bounds()
+	if r.Empty() {
+		return nil
+	}
+	base, ok := m.(*image.NRGBA)
+	if !ok || r.Min != (image.Point{}) {
+		base = image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+		draw.Draw(base, base.Rect, m, r.Min, draw.Src)
+	}
+	size := base.Rect.Size()
+	if mo.PowerOfTwo && !(mathutil.IsPow2(size.X) && mathutil.IsPow2(size.Y)) {
+		size = image.Pt(mathutil.NextPow2(size.X), mathutil.NextPow2(size.Y))
+		p := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+		ResizeImage(base, p, o)
+		base = p
+	}
+
+	var coverage float64
+	if mo.AlphaTest > 0 {
+		coverage = alphaCoverage(alphaHistogram(base), mo.AlphaTest, 1)
+	}
+
+	levels := []image.Image{base}
+	for prev := base; size.X > 1 || size.Y > 1; {
+		if mo.Levels > 0 && len(levels) >= mo.Levels {
+			break
+		}
+		size = image.Pt(max(size.X/2, 1), max(size.Y/2, 1))
+		p := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+		ResizeImage(prev, p, o)
+		prev = p
+		if mo.AlphaTest > 0 {
+			scaleAlphaCoverage(p, mo.AlphaTest, coverage)
+		}
+		levels = append(levels, p)
+	}
+	return levels
+}
+
+func alphaHistogram(m *image.NRGBA) *[256]int {
+	var h [256]int
+	r := m.Rect
+	for y := 0; y < r.Dy(); y++ {
+		s := m.Pix[y*m.Stride:]
+		for x := 0; x < r.Dx(); x++ {
+			h[s[x*4+3]]++
+		}
+	}
+	return &h
+}
+
+// alphaCoverage returns the fraction of pixels passing the alpha
+// test after the alpha values are multiplied by scale
+func alphaCoverage(h *[256]int, cutoff, scale float64) float64 {
+	n, t := 0, 0
+	for i, c := range h {
+		if float64(i)/255*scale >= cutoff {
+			n += c
+		}
+		t += c
+	}
+	return float64(n) / float64(t)
+}
+
+// scaleAlphaCoverage searches for the alpha scale that
+// gives the coverage of the base level and applies it
+func scaleAlphaCoverage(m *image.NRGBA, cutoff, coverage float64) {
+	h := alphaHistogram(m)
+	lo, hi := 0.0, 4.0
+	for i := 0; i < 16; i++ {
+		mid := (lo + hi) / 2
+		if alphaCoverage(h, cutoff, mid) < coverage {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	var lut [256]uint8
+	for i := range lut {
+		lut[i] = alpha8(float64(i) / 255 * hi)
+	}
+	r := m.Rect
+	for y := 0; y < r.Dy(); y++ {
+		s := m.Pix[y*m.Stride:]
+		for x := 0; x < r.Dx(); x++ {
+			s[x*4+3] = lut[s[x*4+3]]
+		}
+	}
+}
@@ -22,6 +22,10 @@ const (
 	BOUNDARY_WRAP = iota
 	BOUNDARY_REFLECT
 	BOUNDARY_CLAMP
+
+	// BOUNDARY_TRANSPARENT samples outside of the image as transparent
+	// black in Warp, the other resamplers treat it as BOUNDARY_CLAMP
+	BOUNDARY_TRANSPARENT
 )
 
 type contrib struct {
@@ -45,6 +49,14 @@ type Options struct {
 	SampleRange f64.Vec2
 	FilterScale f64.Vec2
 	SourceOff   f64.Vec2
+
+	// AlphaWeighted makes ResizeImage filter the color channels
+	// premultiplied by alpha so transparent pixels do not bleed
+	AlphaWeighted bool
+
+	// Workers is the number of goroutines used by ResizeImage,
+	// zero uses GOMAXPROCS
+	Workers int
 }
 
 type Resampler struct {
@@ -62,15 +74,19 @@ type Resampler struct {
 	sn, sc        image.Point
 }
 
+func defaultOptions() *Options {
+	return &Options{
+		BoundaryOp:  BOUNDARY_CLAMP,
+		Filter:      GetFilter("blackman"),
+		SampleRange: f64.Vec2{0, 1},
+		FilterScale: f64.Vec2{1, 1},
+		SourceOff:   f64.Vec2{0, 0},
+	}
+}
+
 func New(dn, sn image.Point, opt *Options) *Resampler {
 	if opt == nil {
-		opt = &Options{
-			BoundaryOp:  BOUNDARY_CLAMP,
-			Filter:      GetFilter("blackman"),
-			SampleRange: f64.Vec2{0, 1},
-			FilterScale: f64.Vec2{1, 1},
-			SourceOff:   f64.Vec2{0, 0},
-		}
+		opt = defaultOptions()
 	}
 
 	r := &Resampler{
@@ -79,8 +95,8 @@ func New(dn, sn image.Point, opt *Options) *Resampler {
 		sn:      sn,
 		samples: make([]float64, dn.X),
 	}
-	r.pcx = r.makeList(dn.X, sn.X, opt.FilterScale.X, opt.SourceOff.X)
-	r.pcy = r.makeList(dn.Y, sn.Y, opt.FilterScale.Y, opt.SourceOff.Y)
+	r.pcx = makeList(opt, dn.X, sn.X, opt.FilterScale.X, opt.SourceOff.X)
+	r.pcy = makeList(opt, dn.Y, sn.Y, opt.FilterScale.Y, opt.SourceOff.Y)
 
 	r.ycount = make([]int, sn.Y)
 	r.yflag = make([]bool, sn.Y)
@@ -147,7 +163,7 @@ func (r *Resampler) Restart() {
 // reflect ensures that contributing sample
 // is within bounds, if not, clamp/wrap/reflect
 // based on op
-func (r *Resampler) reflect(x, w, op int) int {
+func reflect(x, w, op int) int {
 	var n int
 	switch {
 	case x < 0:
@@ -185,10 +201,10 @@ func (r *Resampler) reflect(x, w, op int) int {
 // makeList generates, for all destination samples,
 // the list of all source samples with non-zero
 // weighted contributions
-func (r *Resampler) makeList(dn, sn int, filterScale float64, sourceOff float64) [][]contrib {
+func makeList(opt *Options, dn, sn int, filterScale float64, sourceOff float64) [][]contrib {
 	const NUDGE = 0.5
 
-	filter := r.opt.Filter
+	filter := opt.Filter
 	contribs := make([][]contrib, dn)
 	contribBounds := make([]contribBound, dn)
 
@@ -243,7 +259,7 @@ func (r *Resampler) makeList(dn, sn int, filterScale float64, sourceOff float64)
 			if weight == 0 {
 				continue
 			}
-			contribs[i][index].Pixel = r.reflect(j, sn, r.opt.BoundaryOp)
+			contribs[i][index].Pixel = reflect(j, sn, opt.BoundaryOp)
 			contribs[i][index].Weight = weight
 
 			// increment the number of source samples which
@@ -6,84 +6,378 @@ import (
 	"image/draw"
 	"math"
 
-	"github.com/qeedquan/go-media/math/f64"
+	"github.com/qeedquan/go-media/image/chroma"
+	"github.com/qeedquan/go-media/image/floatimage"
+	"github.com/qeedquan/go-media/image/internal/parallel"
 )
 
 var (
-	srgb   [256]float64
-	linear [4096]uint8
+	// srgbLinear maps 8 bit sRGB values to linear light and srgbSteps
+	// holds the linear values halfway between consecutive sRGB values
+	// so encoding rounds exactly to the nearest 8 bit value
+	srgbLinear [256]float64
+	srgbSteps  [255]float64
 )
 
 func init() {
-	const gamma = 1.75
-	for i := range srgb {
-		srgb[i] = math.Pow(float64(i)/255, gamma)
+	for i := range srgbLinear {
+		srgbLinear[i] = chroma.SRGB2Linear(float64(i) / 255)
 	}
+	for i := range srgbSteps {
+		srgbSteps[i] = chroma.SRGB2Linear((float64(i) + .5) / 255)
+	}
+}
+
+// srgb8 encodes a linear value to the nearest 8 bit sRGB value
+func srgb8(v float64) uint8 {
+	lo, hi := 0, len(srgbSteps)
+	for lo < hi {
+		m := int(uint(lo+hi) >> 1)
+		if v < srgbSteps[m] {
+			hi = m
+		} else {
+			lo = m + 1
+		}
+	}
+	return uint8(lo)
+}
 
-	for i := range linear {
-		k := 255*math.Pow(float64(i)/float64(len(linear)), 1/gamma) + .5
-		k = f64.Clamp(k, 0, 255)
-		linear[i] = uint8(k)
+func srgb16(v float64) uint16 {
+	return uint16(clamp01(chroma.Linear2SRGB(clamp01(v)))*0xffff + .5)
+}
+
+func alpha8(v float64) uint8 {
+	return uint8(clamp01(v)*255 + .5)
+}
+
+func clamp01(v float64) float64 {
+	if v < 0 || v != v {
+		return 0
+	}
+	if v > 1 {
+		return 1
 	}
+	return v
 }
 
+type resizer struct {
+	opt      *Options
+	src      image.Image
+	dst      draw.Image
+	sr, dr   image.Rectangle
+	nc       int
+	pcx, pcy [][]contrib
+	read     func(l []float64, y int)
+	write    func(l []float64, y int)
+}
+
+// ResizeImage scales m to the bounds of p with the filter of the options,
+// the color channels are filtered in linear light using the sRGB transfer
+// curve and the rows of p are split into bands resampled in parallel,
+// *image.RGBA, *image.NRGBA, *image.Gray, *image.YCbCr and *floatimage.RGBA
+// are read and written directly
 func ResizeImage(m image.Image, p draw.Image, o *Options) {
+	if o == nil {
+		o = defaultOptions()
+	}
+	z := &resizer{
+		opt: o,
+		src: m,
+		dst: p,
+		sr:  m.Bounds(),
+		dr:  p.Bounds(),
+	}
+	if z.sr.Empty() || z.dr.Empty() {
+		return
+	}
+	z.pcx = makeList(o, z.dr.Dx(), z.sr.Dx(), o.FilterScale.X, o.SourceOff.X)
+	z.pcy = makeList(o, z.dr.Dy(), z.sr.Dy(), o.FilterScale.Y, o.SourceOff.Y)
+	z.initReader()
+	z.initWriter()
+
+	parallel.Bands(z.dr.Dy(), o.Workers, z.work)
+}
+
+// work resamples the source rows used by a band horizontally
+// and then convolves them vertically for every row of the band
+func (z *resizer) work(bands <-chan [2]int) {
+	sn, dn := z.sr.Dx(), z.dr.Dx()
+	slot := make([]int, z.sr.Dy())
+	for i := range slot {
+		slot[i] = -1
+	}
+
 	var (
-		resamplers [4]*Resampler
-		samples    [4][]float64
+		rows [][]float64
+		used []int
 	)
-	dr := p.Bounds()
-	sr := m.Bounds()
-	sn := image.Pt(sr.Dx(), sr.Dy())
-	dn := image.Pt(dr.Dx(), dr.Dy())
-	for i := range resamplers {
-		resamplers[i] = New(dn, sn, o)
-		samples[i] = make([]float64, sn.X)
-	}
-
-	dy := 0
-	for y := sr.Min.Y; y < sr.Max.Y; y++ {
-		for x := sr.Min.X; x < sr.Max.X; x++ {
-			c := color.RGBAModel.Convert(m.At(x, y)).(color.RGBA)
-			samples[0][x] = srgb[c.R]
-			samples[1][x] = srgb[c.G]
-			samples[2][x] = srgb[c.B]
-			samples[3][x] = float64(c.A) / 255
-		}
-
-		for i, rp := range resamplers {
-			rp.PutLine(samples[i])
-		}
-
-	loop:
-		for ; ; dy++ {
-			var out [4][]float64
-			for i := range resamplers {
-				out[i] = resamplers[i].GetLine()
-				if out[i] == nil {
-					break loop
+	line := make([]float64, sn*z.nc)
+	out := make([]float64, dn*z.nc)
+	for b := range bands {
+		for y := b[0]; y < b[1]; y++ {
+			for _, c := range z.pcy[y] {
+				if slot[c.Pixel] >= 0 {
+					continue
 				}
+				n := len(used)
+				if n == len(rows) {
+					rows = append(rows, make([]float64, dn*z.nc))
+				}
+				slot[c.Pixel] = n
+				used = append(used, c.Pixel)
+
+				z.read(line, c.Pixel)
+				z.resampleX(rows[n], line)
 			}
+		}
 
-			for dx := 0; dx < dn.X; dx++ {
-				c := color.RGBA{
-					linear2srgb(out[0][dx]),
-					linear2srgb(out[1][dx]),
-					linear2srgb(out[2][dx]),
-					linear2alpha(out[3][dx]),
+		for y := b[0]; y < b[1]; y++ {
+			for i := range out {
+				out[i] = 0
+			}
+			for _, c := range z.pcy[y] {
+				for i, v := range rows[slot[c.Pixel]] {
+					out[i] += v * c.Weight
 				}
-				p.Set(dx, dy, c)
+			}
+			z.finish(out)
+			z.write(out, y)
+		}
+
+		for _, y := range used {
+			slot[y] = -1
+		}
+		used = used[:0]
+	}
+}
+
+func (z *resizer) resampleX(dst, src []float64) {
+	nc := z.nc
+	if nc == 4 {
+		for x, pc := range z.pcx {
+			var r, g, b, a float64
+			for _, c := range pc {
+				s := src[c.Pixel*4 : c.Pixel*4+4 : c.Pixel*4+4]
+				r += s[0] * c.Weight
+				g += s[1] * c.Weight
+				b += s[2] * c.Weight
+				a += s[3] * c.Weight
+			}
+			dst[x*4], dst[x*4+1], dst[x*4+2], dst[x*4+3] = r, g, b, a
+		}
+		return
+	}
+
+	for x, pc := range z.pcx {
+		d := dst[x*nc : x*nc+nc]
+		for i := range d {
+			d[i] = 0
+		}
+		for _, c := range pc {
+			s := src[c.Pixel*nc : c.Pixel*nc+nc]
+			for i := range d {
+				d[i] += s[i] * c.Weight
 			}
 		}
 	}
 }
 
-func linear2srgb(x float64) uint8 {
-	i := float64(len(linear))*x + .5
-	i = f64.Clamp(i, 0, float64(len(linear)-1))
-	return linear[int(i)]
+// finish undoes the alpha weighting and clamps the samples to the
+// sample range, float images keep the colors outside of the range
+func (z *resizer) finish(l []float64) {
+	if z.nc == 4 && z.opt.AlphaWeighted {
+		for i := 0; i < len(l); i += 4 {
+			a := l[i+3]
+			if a <= 0 {
+				l[i], l[i+1], l[i+2] = 0, 0, 0
+				continue
+			}
+			l[i] /= a
+			l[i+1] /= a
+			l[i+2] /= a
+		}
+	}
+
+	lo, hi := z.opt.SampleRange.X, z.opt.SampleRange.Y
+	if lo >= hi {
+		return
+	}
+	_, float := z.dst.(*floatimage.RGBA)
+	for i := range l {
+		if float && (z.nc != 4 || i%4 != 3) {
+			continue
+		}
+		l[i] = math.Max(lo, math.Min(l[i], hi))
+	}
 }
 
-func linear2alpha(x float64) uint8 {
-	return uint8(f64.Clamp(255*x+.5, 0, 255))
+// initReader picks the number of channels from the source, gray
+// images use one channel and opaque color images use three
+func (z *resizer) initReader() {
+	sr := z.sr
+	z.nc = 4
+	switch m := z.src.(type) {
+	case *image.Gray:
+		z.nc = 1
+		z.read = func(l []float64, y int) {
+			p := m.Pix[m.PixOffset(sr.Min.X, sr.Min.Y+y):]
+			for x := range l {
+				l[x] = srgbLinear[p[x]]
+			}
+		}
+
+	case *image.YCbCr:
+		z.nc = 3
+		z.read = func(l []float64, y int) {
+			for x := 0; x < sr.Dx(); x++ {
+				yi := m.YOffset(sr.Min.X+x, sr.Min.Y+y)
+				ci := m.COffset(sr.Min.X+x, sr.Min.Y+y)
+				r, g, b := color.YCbCrToRGB(m.Y[yi], m.Cb[ci], m.Cr[ci])
+				l[x*3] = srgbLinear[r]
+				l[x*3+1] = srgbLinear[g]
+				l[x*3+2] = srgbLinear[b]
+			}
+		}
+
+	case *image.NRGBA:
+		z.read = func(l []float64, y int) {
+			p := m.Pix[m.PixOffset(sr.Min.X, sr.Min.Y+y):]
+			for i := range l {
+				if i&3 == 3 {
+					l[i] = float64(p[i]) / 255
+				} else {
+					l[i] = srgbLinear[p[i]]
+				}
+			}
+		}
+
+	case *image.RGBA:
+		z.read = func(l []float64, y int) {
+			p := m.Pix[m.PixOffset(sr.Min.X, sr.Min.Y+y):]
+			for i := 0; i < len(l); i += 4 {
+				a := p[i+3]
+				switch a {
+				case 0xff:
+					l[i], l[i+1], l[i+2] = srgbLinear[p[i]], srgbLinear[p[i+1]], srgbLinear[p[i+2]]
+				case 0:
+					l[i], l[i+1], l[i+2] = 0, 0, 0
+				default:
+					fa := float64(a)
+					l[i] = chroma.SRGB2Linear(math.Min(float64(p[i])/fa, 1))
+					l[i+1] = chroma.SRGB2Linear(math.Min(float64(p[i+1])/fa, 1))
+					l[i+2] = chroma.SRGB2Linear(math.Min(float64(p[i+2])/fa, 1))
+				}
+				l[i+3] = float64(a) / 255
+			}
+		}
+
+	case *floatimage.RGBA:
+		z.read = func(l []float64, y int) {
+			p := m.Pix[m.PixOffset(sr.Min.X, sr.Min.Y+y):]
+			for i := range l {
+				l[i] = float64(p[i])
+			}
+		}
+
+	default:
+		z.read = func(l []float64, y int) {
+			for x := 0; x < sr.Dx(); x++ {
+				c := color.NRGBAModel.Convert(m.At(sr.Min.X+x, sr.Min.Y+y)).(color.NRGBA)
+				l[x*4] = srgbLinear[c.R]
+				l[x*4+1] = srgbLinear[c.G]
+				l[x*4+2] = srgbLinear[c.B]
+				l[x*4+3] = float64(c.A) / 255
+			}
+		}
+	}
+
+	if z.nc == 4 && z.opt.AlphaWeighted {
+		read := z.read
+		z.read = func(l []float64, y int) {
+			read(l, y)
+			for i := 0; i < len(l); i += 4 {
+				a := l[i+3]
+				l[i] *= a
+				l[i+1] *= a
+				l[i+2] *= a
+			}
+		}
+	}
+}
+
+// at returns the straight linear color of pixel x in a line
+func (z *resizer) at(l []float64, x int) (r, g, b, a float64) {
+	switch z.nc {
+	case 1:
+		return l[x], l[x], l[x], 1
+	case 3:
+		return l[x*3], l[x*3+1], l[x*3+2], 1
+	}
+	return l[x*4], l[x*4+1], l[x*4+2], l[x*4+3]
+}
+
+func (z *resizer) initWriter() {
+	dr := z.dr
+	switch m := z.dst.(type) {
+	case *image.RGBA:
+		z.write = func(l []float64, y int) {
+			p := m.Pix[m.PixOffset(dr.Min.X, dr.Min.Y+y):]
+			for x := 0; x < dr.Dx(); x++ {
+				r, g, b, a := z.at(l, x)
+				a8 := uint32(alpha8(a))
+				s := p[x*4 : x*4+4 : x*4+4]
+				s[0] = uint8((uint32(srgb8(r))*a8 + 127) / 255)
+				s[1] = uint8((uint32(srgb8(g))*a8 + 127) / 255)
+				s[2] = uint8((uint32(srgb8(b))*a8 + 127) / 255)
+				s[3] = uint8(a8)
+			}
+		}
+
+	case *image.NRGBA:
+		z.write = func(l []float64, y int) {
+			p := m.Pix[m.PixOffset(dr.Min.X, dr.Min.Y+y):]
+			for x := 0; x < dr.Dx(); x++ {
+				r, g, b, a := z.at(l, x)
+				s := p[x*4 : x*4+4 : x*4+4]
+				s[0], s[1], s[2], s[3] = srgb8(r), srgb8(g), srgb8(b), alpha8(a)
+			}
+		}
+
+	case *image.Gray:
+		z.write = func(l []float64, y int) {
+			p := m.Pix[m.PixOffset(dr.Min.X, dr.Min.Y+y):]
+			for x := 0; x < dr.Dx(); x++ {
+				if z.nc == 1 {
+					p[x] = srgb8(l[x])
+					continue
+				}
+				// same weights as color.GrayModel on the
+				// premultiplied 16 bit values
+				r, g, b, a := z.at(l, x)
+				a16 := uint32(clamp01(a)*0xffff + .5)
+				r16 := uint32(srgb16(r)) * a16 / 0xffff
+				g16 := uint32(srgb16(g)) * a16 / 0xffff
+				b16 := uint32(srgb16(b)) * a16 / 0xffff
+				p[x] = uint8((19595*r16 + 38470*g16 + 7471*b16 + 1<<15) >> 24)
+			}
+		}
+
+	case *floatimage.RGBA:
+		z.write = func(l []float64, y int) {
+			p := m.Pix[m.PixOffset(dr.Min.X, dr.Min.Y+y):]
+			for x := 0; x < dr.Dx(); x++ {
+				r, g, b, a := z.at(l, x)
+				s := p[x*4 : x*4+4 : x*4+4]
+				s[0], s[1], s[2], s[3] = float32(r), float32(g), float32(b), float32(a)
+			}
+		}
+
+	default:
+		z.write = func(l []float64, y int) {
+			for x := 0; x < dr.Dx(); x++ {
+				r, g, b, a := z.at(l, x)
+				m.Set(dr.Min.X+x, dr.Min.Y+y, color.NRGBA64{srgb16(r), srgb16(g), srgb16(b), uint16(clamp01(a)*0xffff + .5)})
+			}
+		}
+	}
 }
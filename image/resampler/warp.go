@@ -0,0 +1,235 @@
+package resampler
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/qeedquan/go-media/image/internal/parallel"
+	"github.com/qeedquan/go-media/math/f64"
+)
+
+// maximum scale of the footprint of a destination pixel,
+// it bounds the cost of pixels near the horizon of a projection
+const maxWarpScale = 32
+
+// limit of the source coordinates a destination pixel can map to
+const maxWarpCoord = 1 << 30
+
+// Warp transforms src into dst with the filter, m maps source to
+// destination coordinates and can be any affine or projective transform,
+// pixels that map outside of the source are transparent
+func Warp(dst draw.Image, src image.Image, m f64.Mat3, filter Filter) {
+	WarpOptions(dst, src, m, &Options{
+		BoundaryOp:  BOUNDARY_TRANSPARENT,
+		Filter:      filter,
+		SampleRange: f64.Vec2{0, 1},
+	})
+}
+
+// WarpOptions is like Warp with the boundary, the sample range and the
+// number of workers taken from the options, every destination pixel is
+// filtered over the ellipse its footprint covers in the source so
+// minified areas are not aliased, the colors are filtered in linear
+// light weighted by alpha and a filter without a Sample function is
+// replaced by the box filter
+func WarpOptions(dst draw.Image, src image.Image, m f64.Mat3, o *Options) {
+	if o == nil {
+		o = defaultOptions()
+		o.BoundaryOp = BOUNDARY_TRANSPARENT
+	}
+	sr, dr := src.Bounds(), dst.Bounds()
+	if sr.Empty() || dr.Empty() {
+		return
+	}
+
+	// a singular transform has no inverse to map destination pixels back
+	det := m.Det()
+	if det == 0 || math.IsNaN(det) || math.IsInf(det, 0) {
+		return
+	}
+
+	s, ok := src.(*image.NRGBA)
+	if !ok {
+		s = image.NewNRGBA(sr)
+		draw.Draw(s, sr, src, sr.Min, draw.Src)
+	}
+
+	wo := *o
+	wo.AlphaWeighted = true
+	if wo.Filter.Sample == nil {
+		wo.Filter = GetFilter("box")
+	}
+	z := &resizer{
+		opt: &wo,
+		dst: dst,
+		dr:  dr,
+		nc:  4,
+	}
+	z.initWriter()
+
+	inv := m
+	inv.Inverse()
+	w := &warper{
+		src:     s,
+		sr:      sr,
+		inv:     inv,
+		support: wo.Filter.Support,
+		op:      o.BoundaryOp,
+	}
+	w.kernel = make([]float64, int(w.support*kernelRes)+2)
+	for i := range w.kernel {
+		w.kernel[i] = wo.Filter.Sample(float64(i) / kernelRes)
+	}
+	parallel.Bands(dr.Dy(), o.Workers, func(bands <-chan [2]int) {
+		line := make([]float64, dr.Dx()*4)
+		for b := range bands {
+			for y := b[0]; y < b[1]; y++ {
+				for x := 0; x < dr.Dx(); x++ {
+					w.sample(line[x*4:x*4+4], float64(dr.Min.X+x)+.5, float64(dr.Min.Y+y)+.5)
+				}
+				z.finish(line)
+				z.write(line, y)
+			}
+		}
+	})
+}
+
+// samples per unit of the tabulated filter
+const kernelRes = 256
+
+type warper struct {
+	src     *image.NRGBA
+	sr      image.Rectangle
+	inv     f64.Mat3
+	kernel  []float64
+	support float64
+	op      int
+}
+
+// weight interpolates the tabulated filter, the filters are symmetric
+func (w *warper) weight(t float64) float64 {
+	t = math.Abs(t) * kernelRes
+	i := int(t)
+	if i >= len(w.kernel)-1 {
+		return 0
+	}
+	f := t - float64(i)
+	return w.kernel[i] + (w.kernel[i+1]-w.kernel[i])*f
+}
+
+// sample filters the source around the point that the destination point
+// x, y maps to, the footprint is found from the jacobian of the inverse
+// transform and its axes are scaled to at least a pixel for magnification
+func (w *warper) sample(c []float64, x, y float64) {
+	c[0], c[1], c[2], c[3] = 0, 0, 0, 0
+
+	n := &w.inv
+	h := n[2][0]*x + n[2][1]*y + n[2][2]
+	if h <= 0 {
+		return
+	}
+	u := (n[0][0]*x + n[0][1]*y + n[0][2]) / h
+	v := (n[1][0]*x + n[1][1]*y + n[1][2]) / h
+	if math.IsNaN(u) || math.IsInf(u, 0) || math.IsNaN(v) || math.IsInf(v, 0) {
+		return
+	}
+	// keep points near the horizon in the range of an int
+	u = math.Max(-maxWarpCoord, math.Min(u, maxWarpCoord))
+	v = math.Max(-maxWarpCoord, math.Min(v, maxWarpCoord))
+
+	dudx := (n[0][0] - u*n[2][0]) / h
+	dudy := (n[0][1] - u*n[2][1]) / h
+	dvdx := (n[1][0] - v*n[2][0]) / h
+	dvdy := (n[1][1] - v*n[2][1]) / h
+
+	// eigen decomposition of J*J^T gives the axes of the footprint
+	a := dudx*dudx + dudy*dudy
+	b := dudx*dvdx + dudy*dvdy
+	d := dvdx*dvdx + dvdy*dvdy
+	mid := (a + d) / 2
+	dis := math.Sqrt((a-d)*(a-d)/4 + b*b)
+	l1, l2 := mid+dis, mid-dis
+
+	var e1 f64.Vec2
+	switch {
+	case b != 0:
+		e1 = f64.Vec2{l1 - d, b}
+		e1 = e1.Scale(1 / e1.Len())
+	case a >= d:
+		e1 = f64.Vec2{1, 0}
+	default:
+		e1 = f64.Vec2{0, 1}
+	}
+	e2 := f64.Vec2{-e1.Y, e1.X}
+	s1 := math.Min(math.Sqrt(math.Max(l1, 1)), maxWarpScale)
+	s2 := math.Min(math.Sqrt(math.Max(l2, 1)), maxWarpScale)
+
+	// bounding box of the footprint in source pixels
+	support := w.support
+	hx := support * math.Sqrt(s1*s1*e1.X*e1.X+s2*s2*e2.X*e2.X)
+	hy := support * math.Sqrt(s1*s1*e1.Y*e1.Y+s2*s2*e2.Y*e2.Y)
+
+	sr := w.sr
+	x0 := int(math.Ceil(u - .5 - hx))
+	x1 := int(math.Floor(u - .5 + hx))
+	y0 := int(math.Ceil(v - .5 - hy))
+	y1 := int(math.Floor(v - .5 + hy))
+	if w.op == BOUNDARY_TRANSPARENT && (x1 < sr.Min.X || x0 >= sr.Max.X || y1 < sr.Min.Y || y0 >= sr.Max.Y) {
+		return
+	}
+
+	var total float64
+	for sy := y0; sy <= y1; sy++ {
+		dy := float64(sy) + .5 - v
+		py, inY := w.wrap(sy-sr.Min.Y, sr.Dy())
+		for sx := x0; sx <= x1; sx++ {
+			dx := float64(sx) + .5 - u
+			t1 := (dx*e1.X + dy*e1.Y) / s1
+			t2 := (dx*e2.X + dy*e2.Y) / s2
+			wt := w.weight(t1) * w.weight(t2)
+			if wt == 0 {
+				continue
+			}
+			total += wt
+
+			px, inX := w.wrap(sx-sr.Min.X, sr.Dx())
+			if !inX || !inY {
+				continue
+			}
+			p := w.src.Pix[py*w.src.Stride+px*4:]
+			al := float64(p[3]) / 255
+			c[0] += srgbLinear[p[0]] * al * wt
+			c[1] += srgbLinear[p[1]] * al * wt
+			c[2] += srgbLinear[p[2]] * al * wt
+			c[3] += al * wt
+		}
+	}
+
+	if math.Abs(total) < 1e-8 {
+		c[0], c[1], c[2], c[3] = 0, 0, 0, 0
+		return
+	}
+	for i := range c {
+		c[i] /= total
+	}
+}
+
+// wrap maps a coordinate into the source with the boundary
+// and reports if the sample lies inside of the source
+func (w *warper) wrap(x, n int) (int, bool) {
+	if x >= 0 && x < n {
+		return x, true
+	}
+	if w.op == BOUNDARY_TRANSPARENT {
+		return 0, false
+	}
+	if w.op == BOUNDARY_REFLECT {
+		x = posmod(x, 2*n)
+		if x >= n {
+			x = 2*n - 1 - x
+		}
+		return x, true
+	}
+	return reflect(x, n, w.op), true
+}
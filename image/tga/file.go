@@ -0,0 +1,168 @@
+package tga
+
+import (
+	"image"
+	"image/color"
+	"time"
+)
+
+// attribute types stored in the extension area
+// describing what the alpha channel holds
+const (
+	ATTR_NONE = iota
+	ATTR_IGNORE
+	ATTR_RETAIN
+	ATTR_ALPHA
+	ATTR_PREMULTIPLIED
+)
+
+const footerSig = "TRUEVISION-XFILE.\x00"
+
+type footer struct {
+	Extension uint32
+	Developer uint32
+	Sig       [18]byte
+}
+
+type extension struct {
+	Size            uint16
+	Author          [41]byte
+	Comments        [4][81]byte
+	Stamp           [6]uint16
+	JobName         [41]byte
+	JobTime         [3]uint16
+	Software        [41]byte
+	SoftwareVersion uint16
+	SoftwareLetter  uint8
+	KeyColor        [4]uint8
+	PixelAspect     [2]uint16
+	Gamma           [2]uint16
+	ColorCorrection uint32
+	PostageStamp    uint32
+	ScanLine        uint32
+	Attributes      uint8
+}
+
+type devent struct {
+	Tag  uint16
+	Off  uint32
+	Size uint32
+}
+
+// File is a TGA image along with the optional
+// metadata that TGA 2.0 files carry after the pixel data
+type File struct {
+	Image     image.Image
+	ID        []byte
+	Extension *Extension
+	Developer []Tag
+}
+
+type Extension struct {
+	Author          string
+	Comments        [4]string
+	Timestamp       time.Time
+	JobName         string
+	JobTime         time.Duration
+	Software        string
+	SoftwareVersion uint16
+	SoftwareLetter  byte
+	KeyColor        color.NRGBA
+
+	// numerator and denominator pairs, a zero
+	// denominator means the field is unused
+	PixelAspect [2]uint16
+	Gamma       [2]uint16
+
+	// 256 entry color correction table, if any
+	ColorCorrection []color.RGBA64
+
+	// postage stamp image stored in the same format as the image
+	Thumbnail image.Image
+
+	// file offsets of each scan line in file order, when non-nil
+	// on encode the table is recomputed for the written file
+	ScanLines []uint32
+
+	Attributes uint8
+}
+
+// Tag is an entry in the developer area
+type Tag struct {
+	ID   uint16
+	Data []byte
+}
+
+func cstring(b []byte) string {
+	for i := range b {
+		if b[i] == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+func (x *extension) decode() *Extension {
+	e := &Extension{
+		Author:          cstring(x.Author[:]),
+		JobName:         cstring(x.JobName[:]),
+		Software:        cstring(x.Software[:]),
+		SoftwareVersion: x.SoftwareVersion,
+		SoftwareLetter:  x.SoftwareLetter,
+		KeyColor:        color.NRGBA{x.KeyColor[2], x.KeyColor[1], x.KeyColor[0], x.KeyColor[3]},
+		PixelAspect:     x.PixelAspect,
+		Gamma:           x.Gamma,
+		Attributes:      x.Attributes,
+	}
+	for i := range x.Comments {
+		e.Comments[i] = cstring(x.Comments[i][:])
+	}
+
+	s := x.Stamp
+	if s != [6]uint16{} {
+		e.Timestamp = time.Date(int(s[2]), time.Month(s[0]), int(s[1]),
+			int(s[3]), int(s[4]), int(s[5]), 0, time.UTC)
+	}
+
+	j := x.JobTime
+	e.JobTime = time.Duration(j[0])*time.Hour +
+		time.Duration(j[1])*time.Minute +
+		time.Duration(j[2])*time.Second
+
+	return e
+}
+
+func (x *extension) encode(e *Extension) {
+	*x = extension{
+		Size:            495,
+		SoftwareVersion: e.SoftwareVersion,
+		SoftwareLetter:  e.SoftwareLetter,
+		KeyColor:        [4]uint8{e.KeyColor.B, e.KeyColor.G, e.KeyColor.R, e.KeyColor.A},
+		PixelAspect:     e.PixelAspect,
+		Gamma:           e.Gamma,
+		Attributes:      e.Attributes,
+	}
+	copy(x.Author[:40], e.Author)
+	copy(x.JobName[:40], e.JobName)
+	copy(x.Software[:40], e.Software)
+	for i := range x.Comments {
+		copy(x.Comments[i][:80], e.Comments[i])
+	}
+
+	if t := e.Timestamp; !t.IsZero() {
+		x.Stamp = [6]uint16{
+			uint16(t.Month()), uint16(t.Day()), uint16(t.Year()),
+			uint16(t.Hour()), uint16(t.Minute()), uint16(t.Second()),
+		}
+	}
+
+	j := e.JobTime
+	if j > 65535*time.Hour {
+		j = 65535 * time.Hour
+	}
+	x.JobTime = [3]uint16{
+		uint16(j / time.Hour),
+		uint16(j % time.Hour / time.Minute),
+		uint16(j % time.Minute / time.Second),
+	}
+}
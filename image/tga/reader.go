@@ -1,14 +1,24 @@
 package tga
 
 import (
+	"bytes"
 	"encoding/binary"
-	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"io"
 	"io/ioutil"
 )
 
+const (
+	typeColorMapped    = 1
+	typeTrueColor      = 2
+	typeGray           = 3
+	typeRLEColorMapped = 9
+	typeRLETrueColor   = 10
+	typeRLEGray        = 11
+)
+
 type header struct {
 	SizeID   uint8
 	ColorMap uint8
@@ -27,187 +37,640 @@ type header struct {
 	Desc uint8
 }
 
+// A FormatError reports that the input is not a valid TGA.
+type FormatError string
+
+func (e FormatError) Error() string { return "tga: invalid format: " + string(e) }
+
+// An UnsupportedError reports that the input uses a valid but unimplemented TGA feature.
+type UnsupportedError string
+
+func (e UnsupportedError) Error() string { return "tga: unsupported feature: " + string(e) }
+
 type decoder struct {
 	header
 	r        io.Reader
-	img      *image.RGBA
+	img      image.Image
+	id       []byte
 	colormap []byte
+	palette  color.Palette
 	pix      []byte
+
+	// everything after the color map and
+	// the file offset where it starts
+	buf  []byte
+	base int
+
+	ext   *Extension
+	dev   []Tag
+	stamp uint32
 }
 
 func Decode(r io.Reader) (image.Image, error) {
 	d := &decoder{r: r}
 
 	if err := d.checkHeader(); err != nil {
-		return nil, nil
+		return nil, err
+	}
+
+	if err := d.decode(); err != nil {
+		return nil, err
+	}
+
+	return d.img, nil
+}
+
+func DecodeFile(r io.Reader) (*File, error) {
+	d := &decoder{r: r}
+
+	if err := d.checkHeader(); err != nil {
+		return nil, err
+	}
+
+	if err := d.decode(); err != nil {
+		return nil, err
+	}
+
+	return &File{
+		Image:     d.img,
+		ID:        d.id,
+		Extension: d.ext,
+		Developer: d.dev,
+	}, nil
+}
+
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	d := &decoder{r: r}
+
+	if err := d.checkHeader(); err != nil {
+		return image.Config{}, err
+	}
+
+	var model color.Model = color.RGBAModel
+	switch {
+	case d.Type&^8 == typeColorMapped:
+		if err := d.readColorMap(); err != nil {
+			return image.Config{}, err
+		}
+		d.buildPalette()
+		if d.isPaletted() {
+			model = d.palette
+		}
+	case d.hasAlpha():
+		model = color.NRGBAModel
+	}
+
+	return image.Config{
+		ColorModel: model,
+		Width:      int(d.Width),
+		Height:     int(d.Height),
+	}, nil
+}
+
+func (d *decoder) readLength(length int) ([]byte, error) {
+	b := make([]byte, length)
+	_, err := io.ReadFull(d.r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// checkHeader reads the header and validates it, there is
+// no signature in a TGA file so this is the best we can do
+// to reject garbage before we allocate anything
+func (d *decoder) checkHeader() error {
+	err := binary.Read(d.r, binary.LittleEndian, &d.header)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
 	}
 
+	if d.ColorMap > 1 {
+		return FormatError(fmt.Sprintf("color map type %d", d.ColorMap))
+	}
+
+	switch d.Type &^ 8 {
+	case typeColorMapped:
+		if d.Bpp != 8 && d.Bpp != 16 {
+			return UnsupportedError(fmt.Sprintf("color index depth %d", d.Bpp))
+		}
+	case typeTrueColor:
+		switch d.Bpp {
+		case 15, 16, 24, 32:
+		default:
+			return UnsupportedError(fmt.Sprintf("pixel depth %d", d.Bpp))
+		}
+	case typeGray:
+		if d.Bpp != 8 && d.Bpp != 16 {
+			return UnsupportedError(fmt.Sprintf("grayscale depth %d", d.Bpp))
+		}
+	case 0:
+		return UnsupportedError("image with no image data")
+	default:
+		return FormatError(fmt.Sprintf("image type %d", d.Type))
+	}
+	if d.Width == 0 || d.Height == 0 {
+		return FormatError(fmt.Sprintf("dimension %dx%d", d.Width, d.Height))
+	}
+
+	return nil
+}
+
+// checkLength makes sure the body is large enough to hold
+// the pixel data before we allocate the image, compressed
+// data needs at least one packet per 128 pixels
+func (d *decoder) checkLength() error {
+	bpp := (int64(d.Bpp) + 7) / 8
+	n := int64(d.Width) * int64(d.Height)
+	size := n * bpp
+	if d.Type&8 != 0 {
+		size = (n + 127) / 128 * (1 + bpp)
+	}
+	if int64(len(d.buf)) < size {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// readColorMap reads the image id and
+// the raw color map following the header
+func (d *decoder) readColorMap() error {
+	var err error
 	if d.SizeID != 0 {
-		_, err := d.readLength(int(d.SizeID))
+		d.id, err = d.readLength(int(d.SizeID))
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	if d.ColorMap&1 == 1 {
-		var err error
+	if d.ColorMap&1 == 0 {
+		if d.Type&^8 == typeColorMapped {
+			return FormatError("color-mapped image has no color map")
+		}
+		return nil
+	}
 
-		length := int(d.ColorMapEntries) * int(d.ColorMapBpp+1) / 8
-		d.colormap, err = d.readLength(length)
-		if err != nil {
-			return nil, err
+	switch d.ColorMapBpp {
+	case 15, 16, 24, 32:
+	default:
+		return UnsupportedError(fmt.Sprintf("color map depth %d", d.ColorMapBpp))
+	}
+
+	size := (int(d.ColorMapBpp) + 7) / 8
+	d.colormap, err = d.readLength(int(d.ColorMapEntries) * size)
+	return err
+}
+
+// buildPalette converts the color map into a palette,
+// the palette is indexed by the raw pixel value so entries
+// before the color map start are left as opaque black
+func (d *decoder) buildPalette() {
+	if d.colormap == nil {
+		return
+	}
+
+	var dec func(*decoder, []byte) color.RGBA
+	switch d.ColorMapBpp {
+	case 15:
+		dec = decode15
+	case 16:
+		dec = decode16
+	case 24:
+		dec = decode24
+	case 32:
+		dec = decode32
+	}
+
+	size := (int(d.ColorMapBpp) + 7) / 8
+	start := int(d.ColorMapStart)
+	d.palette = make(color.Palette, start+int(d.ColorMapEntries))
+	for i := 0; i < start; i++ {
+		d.palette[i] = color.RGBA{0, 0, 0, 255}
+	}
+	for i := 0; i < int(d.ColorMapEntries); i++ {
+		c := dec(d, d.colormap[i*size:])
+		if d.premultiplied() {
+			d.palette[start+i] = c
+		} else {
+			d.palette[start+i] = color.NRGBA(c)
+		}
+	}
+}
+
+// isPaletted reports whether the color map fits
+// into an image.Paletted, larger maps or 16 bit
+// indices are expanded to RGBA instead
+func (d *decoder) isPaletted() bool {
+	return d.Bpp == 8 && len(d.palette) <= 256
+}
+
+// hasAlpha reports whether the pixels carry an alpha
+// channel that should be kept, the extension area
+// can say the alpha channel holds garbage
+func (d *decoder) hasAlpha() bool {
+	if d.ext != nil {
+		switch d.ext.Attributes {
+		case ATTR_NONE, ATTR_IGNORE, ATTR_RETAIN:
+			return false
 		}
 	}
 
-	dim := image.Rect(0, 0, int(d.Width), int(d.Height))
-	d.img = image.NewRGBA(dim)
+	switch d.Bpp {
+	case 16:
+		return d.Type&^8 == typeGray || d.Desc&0xF != 0
+	case 32:
+		return true
+	}
+	return false
+}
+
+func (d *decoder) premultiplied() bool {
+	return d.ext != nil && d.ext.Attributes == ATTR_PREMULTIPLIED
+}
+
+func (d *decoder) decode() error {
+	if err := d.readColorMap(); err != nil {
+		return err
+	}
 
 	var err error
-	d.pix, err = ioutil.ReadAll(d.r)
+	d.buf, err = ioutil.ReadAll(d.r)
 	if err != nil {
-		return nil, nil
+		return err
 	}
+	d.base = binary.Size(d.header) + len(d.id) + len(d.colormap)
 
-	if d.Type&byte(^3&0xFF) != 0 {
+	if err := d.readFooter(); err != nil {
+		return err
+	}
+	d.buildPalette()
+
+	if err := d.checkLength(); err != nil {
+		return err
+	}
+
+	d.pix = d.buf
+	if d.Type&8 != 0 {
 		d.pix, err = d.rleUncompress(d.pix)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	d.decode()
+	if err := d.decodePixels(); err != nil {
+		return err
+	}
 
-	return d.img, nil
+	if d.ext != nil {
+		return d.readThumbnail()
+	}
+	return nil
 }
 
-func DecodeConfig(r io.Reader) (image.Config, error) {
-	d := &decoder{r: r}
+// at returns the data at a file offset, the offsets
+// stored in the file are relative to the start
+// of the file but we only keep the data after the color map
+func (d *decoder) at(off uint32, n int) ([]byte, error) {
+	i := int64(off) - int64(d.base)
+	if i < 0 || i+int64(n) > int64(len(d.buf)) {
+		return nil, FormatError(fmt.Sprintf("offset %d out of range", off))
+	}
+	return d.buf[i : i+int64(n)], nil
+}
 
-	if err := d.checkHeader(); err != nil {
-		return image.Config{}, err
+// readFooter reads the TGA 2.0 footer if there is one
+// along with the extension and developer areas it points to
+func (d *decoder) readFooter() error {
+	var f footer
+
+	n := binary.Size(f)
+	if len(d.buf) < n {
+		return nil
 	}
 
-	return image.Config{
-		ColorModel: color.RGBAModel,
-		Width:      int(d.Width),
-		Height:     int(d.Height),
-	}, nil
+	b := d.buf[len(d.buf)-n:]
+	if string(b[8:]) != footerSig {
+		return nil
+	}
+	binary.Read(bytes.NewReader(b), binary.LittleEndian, &f)
+
+	if f.Developer != 0 {
+		if err := d.readDeveloper(f.Developer); err != nil {
+			return err
+		}
+	}
+
+	if f.Extension != 0 {
+		if err := d.readExtension(f.Extension); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (d *decoder) readLength(length int) ([]byte, error) {
-	b := make([]byte, length)
-	n, err := d.r.Read(b)
+func (d *decoder) readDeveloper(off uint32) error {
+	b, err := d.at(off, 2)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if n != length {
-		return nil, io.ErrUnexpectedEOF
+
+	n := int(binary.LittleEndian.Uint16(b))
+	b, err = d.at(off+2, n*binary.Size(devent{}))
+	if err != nil {
+		return err
+	}
+
+	ents := make([]devent, n)
+	binary.Read(bytes.NewReader(b), binary.LittleEndian, ents)
+	for _, e := range ents {
+		p, err := d.at(e.Off, int(e.Size))
+		if err != nil {
+			return err
+		}
+		d.dev = append(d.dev, Tag{
+			ID:   e.Tag,
+			Data: append([]byte(nil), p...),
+		})
 	}
 
-	return b, err
+	return nil
 }
 
-func (d *decoder) checkHeader() error {
-	return binary.Read(d.r, binary.LittleEndian, &d.header)
+func (d *decoder) readExtension(off uint32) error {
+	var x extension
+
+	b, err := d.at(off, binary.Size(x))
+	if err != nil {
+		return err
+	}
+	binary.Read(bytes.NewReader(b), binary.LittleEndian, &x)
+	if x.Size < 495 {
+		return FormatError(fmt.Sprintf("extension area size %d", x.Size))
+	}
+	d.ext = x.decode()
+
+	if x.ColorCorrection != 0 {
+		b, err := d.at(x.ColorCorrection, 256*8)
+		if err != nil {
+			return err
+		}
+		cc := make([]color.RGBA64, 256)
+		for i := range cc {
+			p := b[i*8:]
+			cc[i] = color.RGBA64{
+				A: binary.LittleEndian.Uint16(p[0:]),
+				R: binary.LittleEndian.Uint16(p[2:]),
+				G: binary.LittleEndian.Uint16(p[4:]),
+				B: binary.LittleEndian.Uint16(p[6:]),
+			}
+		}
+		d.ext.ColorCorrection = cc
+	}
+
+	if x.ScanLine != 0 {
+		b, err := d.at(x.ScanLine, int(d.Height)*4)
+		if err != nil {
+			return err
+		}
+		d.ext.ScanLines = make([]uint32, d.Height)
+		for i := range d.ext.ScanLines {
+			d.ext.ScanLines[i] = binary.LittleEndian.Uint32(b[i*4:])
+		}
+	}
+
+	// the postage stamp is decoded after the image
+	// since it needs the palette and pixel format
+	d.stamp = x.PostageStamp
+	return nil
 }
 
-func (d *decoder) rleUncompress(p []byte) ([]byte, error) {
-	var b []byte
+// readThumbnail decodes the postage stamp, it is stored
+// uncompressed in the same format as the image
+func (d *decoder) readThumbnail() error {
+	if d.stamp == 0 {
+		return nil
+	}
+
+	b, err := d.at(d.stamp, 2)
+	if err != nil {
+		return err
+	}
+
+	t := *d
+	t.Width = uint16(b[0])
+	t.Height = uint16(b[1])
+	t.Type &^= 8
+	t.pix, err = d.at(d.stamp+2, int(t.Width)*int(t.Height)*((int(t.Bpp)+7)/8))
+	if err != nil {
+		return err
+	}
 
-	if len(p) == 0 {
-		return p, nil
+	if err := t.decodePixels(); err != nil {
+		return err
 	}
+	d.ext.Thumbnail = t.img
+	return nil
+}
 
-	bpp := int(d.Bpp) / 8
-	for i := 0; ; {
-		j := int(p[i] & 0x7F)
-		if i++; i+bpp >= len(p) {
+func (d *decoder) rleUncompress(p []byte) ([]byte, error) {
+	bpp := (int(d.Bpp) + 7) / 8
+	size := int(d.Width) * int(d.Height) * bpp
+
+	// each byte of input expands to at most 128
+	// pixels, so bound the allocation by that
+	// instead of trusting the header
+	n := size
+	if m := len(p) * 128; m < n {
+		n = m
+	}
+	b := make([]byte, 0, n)
+
+	for i := 0; len(b) < size; {
+		if i >= len(p) {
 			return nil, io.ErrUnexpectedEOF
 		}
 
-		pix := p[i : i+bpp]
-		b = append(b, pix...)
-		i += bpp
+		n := int(p[i]&0x7F) + 1
+		rle := p[i]&0x80 != 0
+		i++
 
-		if p[i]&0x80 != 0 {
-			for k := 0; k < j; k++ {
+		if rle {
+			if i+bpp > len(p) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			pix := p[i : i+bpp]
+			for k := 0; k < n; k++ {
 				b = append(b, pix...)
 			}
+			i += bpp
 		} else {
-			for k := 0; k < j; k++ {
-				if i+bpp > len(p) {
-					return nil, io.ErrUnexpectedEOF
-				}
-				b = append(b, pix...)
-				pix = p[i : i+bpp]
-				i += bpp
+			if i+n*bpp > len(p) {
+				return nil, io.ErrUnexpectedEOF
 			}
+			b = append(b, p[i:i+n*bpp]...)
+			i += n * bpp
 		}
 	}
 
-	return b, nil
+	return b[:size], nil
 }
 
-func (d *decoder) decode() error {
-	size := int(d.Width) * int(d.Height) * int(d.Bpp) / 8
-	if len(d.pix) > size {
-		return errors.New("invalid size")
+func (d *decoder) decodePixels() error {
+	bpp := (int(d.Bpp) + 7) / 8
+	size := int(d.Width) * int(d.Height) * bpp
+	if len(d.pix) < size {
+		return io.ErrUnexpectedEOF
 	}
 
-	y, dy, h := int(d.Height-1), -1, -1
+	switch d.Type &^ 8 {
+	case typeColorMapped:
+		return d.decodeIndexed()
+	case typeTrueColor, typeGray:
+		return d.decodeRGBA()
+	}
+	return UnsupportedError(fmt.Sprintf("image type %d", d.Type))
+}
+
+// scan walks the pixel data in file order and
+// calls fn with the image coordinate each pixel
+// maps to based on the origin bits of the descriptor
+func (d *decoder) scan(fn func(x, y int, p []byte)) {
+	y, dy, h := int(d.Height)-1, -1, -1
 	if d.Desc&0x20 != 0 {
 		y, dy, h = 0, 1, int(d.Height)
 	}
 
 	x, dx, w := 0, 1, int(d.Width)
 	if d.Desc&0x10 != 0 {
-		x, dx, w = int(d.Width-1), -1, -1
+		x, dx, w = int(d.Width)-1, -1, -1
 	}
 	rx := x
 
+	i, inc := 0, (int(d.Bpp)+7)/8
+	for y != h {
+		x = rx
+		for x != w {
+			fn(x, y, d.pix[i:])
+			x += dx
+			i += inc
+		}
+		y += dy
+	}
+}
+
+// decodeRGBA decodes true color and grayscale images,
+// images with a straight alpha channel are returned as
+// NRGBA and everything else as RGBA
+func (d *decoder) decodeRGBA() error {
 	var dec func(*decoder, []byte) color.RGBA
-	var i, inc int
 
 	switch d.Bpp {
 	case 8:
 		dec = decodeGray
+	case 15:
+		dec = decode15
 	case 16:
 		dec = decode16
+		if d.Type&^8 == typeGray {
+			dec = decodeGrayAlpha
+		}
 	case 24:
 		dec = decode24
 	case 32:
 		dec = decode32
 	default:
-		panic("unimplemented")
+		return UnsupportedError(fmt.Sprintf("pixel depth %d", d.Bpp))
 	}
 
-	inc = int(d.Bpp / 8)
-	for y != h {
-		x = rx
-		for x != w {
-			d.img.SetRGBA(x, y, dec(d, d.pix[i:]))
-			x += dx
-			i += inc
-		}
-		y += dy
+	var (
+		pix    []uint8
+		stride int
+	)
+	r := image.Rect(0, 0, int(d.Width), int(d.Height))
+	alpha := d.hasAlpha()
+	if alpha && !d.premultiplied() {
+		m := image.NewNRGBA(r)
+		pix, stride, d.img = m.Pix, m.Stride, m
+	} else {
+		m := image.NewRGBA(r)
+		pix, stride, d.img = m.Pix, m.Stride, m
 	}
+
+	d.scan(func(x, y int, p []byte) {
+		c := dec(d, p)
+		if !alpha {
+			c.A = 255
+		}
+		i := y*stride + x*4
+		pix[i], pix[i+1], pix[i+2], pix[i+3] = c.R, c.G, c.B, c.A
+	})
 	return nil
 }
 
-func decodeIndexed(d *decoder, p []byte) color.RGBA {
-	return color.RGBA{}
+func (d *decoder) decodeIndexed() error {
+	if d.Bpp != 8 && d.Bpp != 16 {
+		return UnsupportedError(fmt.Sprintf("color index depth %d", d.Bpp))
+	}
+
+	var err error
+	index := func(p []byte) int {
+		i := int(p[0])
+		if d.Bpp == 16 {
+			i |= int(p[1]) << 8
+		}
+		if i >= len(d.palette) {
+			err = FormatError(fmt.Sprintf("color index %d out of range", i))
+			return 0
+		}
+		return i
+	}
+
+	r := image.Rect(0, 0, int(d.Width), int(d.Height))
+	if d.isPaletted() {
+		m := image.NewPaletted(r, d.palette)
+		d.scan(func(x, y int, p []byte) {
+			m.SetColorIndex(x, y, uint8(index(p)))
+		})
+		d.img = m
+	} else {
+		m := image.NewRGBA(r)
+		d.scan(func(x, y int, p []byte) {
+			m.Set(x, y, d.palette[index(p)])
+		})
+		d.img = m
+	}
+	return err
 }
 
 func decodeGray(_ *decoder, p []byte) color.RGBA {
 	return color.RGBA{p[0], p[0], p[0], 255}
 }
 
-func decode16(_ *decoder, p []byte) color.RGBA {
+func decodeGrayAlpha(_ *decoder, p []byte) color.RGBA {
+	return color.RGBA{p[0], p[0], p[0], p[1]}
+}
+
+func decode15(_ *decoder, p []byte) color.RGBA {
+	c := decode16(nil, p)
+	c.A = 255
+	return c
+}
+
+func decode16(d *decoder, p []byte) color.RGBA {
 	r := (p[1] & 0x7C) << 1
 	g := ((p[1] & 0x3) << 6) | ((p[0] & 0xE0) >> 2)
 	b := (p[0] & 0x1F) << 3
-	a := uint8((uint16(p[1]&0x80) << 1) - 1)
-	return color.RGBA{r, g, b, a}
+
+	// the attribute bit is only treated as alpha
+	// when the descriptor says there is one
+	if d != nil && d.Desc&0xF != 0 && p[1]&0x80 == 0 {
+		return color.RGBA{}
+	}
+	return color.RGBA{r | r>>5, g | g>>5, b | b>>5, 255}
 }
 
 func decode24(_ *decoder, p []byte) color.RGBA {
@@ -217,3 +680,16 @@ func decode24(_ *decoder, p []byte) color.RGBA {
 func decode32(_ *decoder, p []byte) color.RGBA {
 	return color.RGBA{p[2], p[1], p[0], p[3]}
 }
+
+// TGA has no magic number so we match on the color map
+// and image type fields instead, true color and grayscale
+// images without a color map have a zeroed color map spec
+// which helps to avoid matching other formats
+func init() {
+	image.RegisterFormat("tga", "?\x01\x01", Decode, DecodeConfig)
+	image.RegisterFormat("tga", "?\x01\x09", Decode, DecodeConfig)
+	for _, t := range []string{"\x02", "\x03", "\x0a", "\x0b"} {
+		image.RegisterFormat("tga", "?\x00"+t+"\x00\x00", Decode, DecodeConfig)
+		image.RegisterFormat("tga", "?\x01"+t, Decode, DecodeConfig)
+	}
+}
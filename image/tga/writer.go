@@ -3,42 +3,482 @@ package tga
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"image"
+	"image/color"
 	"io"
+	"math"
 )
 
-func Encode(w io.Writer, m image.Image) (err error) {
-	bw := bufio.NewWriter(w)
+type Options struct {
+	// Paletted writes a color-mapped image when
+	// the source image is an *image.Paletted
+	Paletted bool
+
+	// Compress writes the pixel data using RLE packets
+	Compress bool
+
+	// Bpp selects the output depth for non-paletted images,
+	// 8 is grayscale, 16 is 5551, 24 is BGR and 32 is BGRA,
+	// zero defaults to 32
+	Bpp int
+
+	// BottomLeft stores the rows bottom up instead of top down
+	BottomLeft bool
+}
+
+type encoder struct {
+	w      *bufio.Writer
+	cw     countWriter
+	o      Options
+	m      image.Image
+	conv   func([]byte, int)
+	bpp    int
+	row    []byte
+	tmp    []byte
+	lines  []uint32
+	premul bool
+	alpha  bool
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	return EncodeFile(w, &File{Image: m}, o)
+}
+
+func EncodeFile(w io.Writer, f *File, o *Options) (err error) {
+	m := f.Image
+	e := &encoder{m: m}
+	if o != nil {
+		e.o = *o
+	}
+	if e.o.Bpp == 0 {
+		e.o.Bpp = 32
+	}
+
+	r := m.Bounds()
+	if r.Dx() > math.MaxUint16 || r.Dy() > math.MaxUint16 {
+		return fmt.Errorf("tga: image dimension %dx%d is too big", r.Dx(), r.Dy())
+	}
+	if len(f.ID) > math.MaxUint8 {
+		return fmt.Errorf("tga: image id of length %d is too long", len(f.ID))
+	}
+
+	e.cw.w = w
+	e.w = bufio.NewWriter(&e.cw)
 	defer func() {
-		xerr := bw.Flush()
+		xerr := e.w.Flush()
 		if err == nil {
 			err = xerr
 		}
 	}()
 
-	width, height := m.Bounds().Dx(), m.Bounds().Dy()
+	x := f.Extension
+	e.premul = x != nil && x.Attributes == ATTR_PREMULTIPLIED
+	if x != nil && x.ScanLines != nil {
+		e.lines = make([]uint32, 0, r.Dy())
+	}
+
+	p, _ := m.(*image.Paletted)
+	if p != nil && e.o.Paletted {
+		err = e.encodePaletted(p, f.ID)
+	} else {
+		err = e.encode(f.ID)
+	}
+	if err != nil {
+		return err
+	}
+
+	var foot footer
+	copy(foot.Sig[:], footerSig)
+	if len(f.Developer) > 0 {
+		if foot.Developer, err = e.writeDeveloper(f.Developer); err != nil {
+			return err
+		}
+	}
+	if x != nil {
+		if foot.Extension, err = e.writeExtension(x); err != nil {
+			return err
+		}
+	}
+	return binary.Write(e.w, binary.LittleEndian, &foot)
+}
+
+func (e *encoder) encode(id []byte) error {
+	r := e.m.Bounds()
 	head := header{
-		Type:   2,
-		Bpp:    32,
-		Width:  uint16(width),
-		Height: uint16(height),
-		Desc:   0x20,
+		SizeID: uint8(len(id)),
+		Width:  uint16(r.Dx()),
+		Height: uint16(r.Dy()),
+		Bpp:    uint8(e.o.Bpp),
 	}
 
-	if err := binary.Write(bw, binary.LittleEndian, head); err != nil {
+	switch e.o.Bpp {
+	case 8:
+		head.Type = typeGray
+		e.conv = e.grayRow
+	case 16:
+		head.Type = typeTrueColor
+		head.Desc = 1
+		e.conv = e.row16
+	case 24:
+		head.Type = typeTrueColor
+		e.conv = e.row24
+	case 32:
+		head.Type = typeTrueColor
+		head.Desc = 8
+		e.conv = e.row32
+	default:
+		return fmt.Errorf("tga: unsupported output depth %d", e.o.Bpp)
+	}
+
+	if err := e.writeHeader(&head, id); err != nil {
 		return err
 	}
+	return e.writeRows()
+}
 
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			r, g, b, a := m.At(x, y).RGBA()
-			err := binary.Write(bw, binary.LittleEndian,
-				[]byte{byte(b), byte(g), byte(r), byte(a)})
-			if err != nil {
-				return err
+func (e *encoder) encodePaletted(m *image.Paletted, id []byte) error {
+	if len(m.Palette) == 0 || len(m.Palette) > 256 {
+		return errors.New("tga: paletted image must have between 1 and 256 colors")
+	}
+
+	// only store alpha in the color map if we need to
+	bpp := uint8(24)
+	for _, c := range m.Palette {
+		if _, _, _, a := c.RGBA(); a != 0xffff {
+			bpp = 32
+			break
+		}
+	}
+
+	r := m.Bounds()
+	head := header{
+		SizeID:          uint8(len(id)),
+		ColorMap:        1,
+		Type:            typeColorMapped,
+		ColorMapEntries: uint16(len(m.Palette)),
+		ColorMapBpp:     bpp,
+		Width:           uint16(r.Dx()),
+		Height:          uint16(r.Dy()),
+		Bpp:             8,
+	}
+	if bpp == 32 {
+		head.Desc = 8
+	}
+
+	if err := e.writeHeader(&head, id); err != nil {
+		return err
+	}
+
+	for _, c := range m.Palette {
+		n := color.NRGBAModel.Convert(c).(color.NRGBA)
+		p := []byte{n.B, n.G, n.R, n.A}
+		if _, err := e.w.Write(p[:bpp/8]); err != nil {
+			return err
+		}
+	}
+
+	e.conv = e.indexRow
+	return e.writeRows()
+}
+
+// writeHeader fills in the compression and origin
+// bits based on the options and writes it out with the id
+func (e *encoder) writeHeader(h *header, id []byte) error {
+	if e.o.Compress {
+		h.Type |= 8
+	}
+	if !e.o.BottomLeft {
+		h.Desc |= 0x20
+	}
+	e.bpp = (int(h.Bpp) + 7) / 8
+	e.alpha = h.Desc&0xF != 0
+	if err := binary.Write(e.w, binary.LittleEndian, h); err != nil {
+		return err
+	}
+	_, err := e.w.Write(id)
+	return err
+}
+
+// pos returns the current offset into the file
+func (e *encoder) pos() uint32 {
+	return uint32(e.cw.n + int64(e.w.Buffered()))
+}
+
+// writeRows converts each row using the row converter
+// in the order specified by the origin option
+func (e *encoder) writeRows() error {
+	r := e.m.Bounds()
+	e.row = make([]byte, r.Dx()*e.bpp)
+	e.tmp = make([]byte, r.Dx()*4)
+	for i := 0; i < r.Dy(); i++ {
+		y := r.Min.Y + i
+		if e.o.BottomLeft {
+			y = r.Max.Y - 1 - i
+		}
+		if e.lines != nil {
+			e.lines = append(e.lines, e.pos())
+		}
+		e.conv(e.row, y)
+
+		var err error
+		if e.o.Compress {
+			err = e.writeRLE(e.row)
+		} else {
+			_, err = e.w.Write(e.row)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRLE encodes a scanline into run length packets,
+// runs of 2 or more identical pixels are stored as one
+// pixel, everything else is gathered into raw packets;
+// packets never cross scanlines as recommended by the spec
+func (e *encoder) writeRLE(p []byte) error {
+	bpp := e.bpp
+	n := len(p) / bpp
+	same := func(i, j int) bool {
+		for k := 0; k < bpp; k++ {
+			if p[i*bpp+k] != p[j*bpp+k] {
+				return false
 			}
 		}
+		return true
 	}
 
+	for i := 0; i < n; {
+		j := i + 1
+		for j < n && j-i < 128 && same(i, j) {
+			j++
+		}
+
+		if j-i > 1 {
+			e.w.WriteByte(byte(0x80 | (j - i - 1)))
+			e.w.Write(p[i*bpp : i*bpp+bpp])
+			i = j
+			continue
+		}
+
+		for j < n && j-i < 128 && !(j+1 < n && same(j, j+1)) {
+			j++
+		}
+		e.w.WriteByte(byte(j - i - 1))
+		if _, err := e.w.Write(p[i*bpp : j*bpp]); err != nil {
+			return err
+		}
+		i = j
+	}
 	return nil
 }
+
+func (e *encoder) indexRow(b []byte, y int) {
+	m := e.m.(*image.Paletted)
+	r := m.Bounds()
+	i := m.PixOffset(r.Min.X, y)
+	copy(b, m.Pix[i:i+r.Dx()])
+}
+
+func (e *encoder) grayRow(b []byte, y int) {
+	r := e.m.Bounds()
+	if m, _ := e.m.(*image.Gray); m != nil {
+		i := m.PixOffset(r.Min.X, y)
+		copy(b, m.Pix[i:i+r.Dx()])
+		return
+	}
+
+	for x := r.Min.X; x < r.Max.X; x++ {
+		c := color.GrayModel.Convert(e.m.At(x, y)).(color.Gray)
+		b[x-r.Min.X] = c.Y
+	}
+}
+
+func (e *encoder) row16(b []byte, y int) {
+	e.row32(e.tmp, y)
+	n := len(b) / 2
+	for i := 0; i < n; i++ {
+		p := e.tmp[i*4 : i*4+4]
+		v := uint16(p[2]>>3)<<10 | uint16(p[1]>>3)<<5 | uint16(p[0]>>3)
+		if p[3] >= 128 {
+			v |= 0x8000
+		}
+		b[i*2] = uint8(v)
+		b[i*2+1] = uint8(v >> 8)
+	}
+}
+
+func (e *encoder) row24(b []byte, y int) {
+	e.row32(e.tmp, y)
+	n := len(b) / 3
+	for i := 0; i < n; i++ {
+		copy(b[i*3:i*3+3], e.tmp[i*4:i*4+3])
+	}
+}
+
+// row32 converts a row into BGRA with straight alpha unless
+// the extension area says the alpha is premultiplied,
+// the smaller depths are packed down from this
+func (e *encoder) row32(b []byte, y int) {
+	r := e.m.Bounds()
+	if e.premul {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := color.RGBAModel.Convert(e.m.At(x, y)).(color.RGBA)
+			i := (x - r.Min.X) * 4
+			b[i], b[i+1], b[i+2], b[i+3] = c.B, c.G, c.R, c.A
+		}
+		return
+	}
+
+	switch m := e.m.(type) {
+	case *image.NRGBA:
+		s := m.Pix[m.PixOffset(r.Min.X, y):]
+		for i := 0; i < r.Dx()*4; i += 4 {
+			b[i], b[i+1], b[i+2], b[i+3] = s[i+2], s[i+1], s[i], s[i+3]
+		}
+
+	case *image.RGBA:
+		s := m.Pix[m.PixOffset(r.Min.X, y):]
+		for i := 0; i < r.Dx()*4; i += 4 {
+			cr, cg, cb, ca := s[i], s[i+1], s[i+2], s[i+3]
+			if ca != 0 && ca != 255 {
+				cr = uint8(uint32(cr) * 255 / uint32(ca))
+				cg = uint8(uint32(cg) * 255 / uint32(ca))
+				cb = uint8(uint32(cb) * 255 / uint32(ca))
+			}
+			b[i], b[i+1], b[i+2], b[i+3] = cb, cg, cr, ca
+		}
+
+	case *image.Gray:
+		s := m.Pix[m.PixOffset(r.Min.X, y):]
+		for i := 0; i < r.Dx(); i++ {
+			b[i*4], b[i*4+1], b[i*4+2], b[i*4+3] = s[i], s[i], s[i], 255
+		}
+
+	default:
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := color.NRGBAModel.Convert(e.m.At(x, y)).(color.NRGBA)
+			i := (x - r.Min.X) * 4
+			b[i], b[i+1], b[i+2], b[i+3] = c.B, c.G, c.R, c.A
+		}
+	}
+}
+
+func (e *encoder) writeDeveloper(tags []Tag) (uint32, error) {
+	if len(tags) > math.MaxUint16 {
+		return 0, fmt.Errorf("tga: too many developer tags %d", len(tags))
+	}
+
+	ents := make([]devent, len(tags))
+	for i, t := range tags {
+		ents[i] = devent{
+			Tag:  t.ID,
+			Off:  e.pos(),
+			Size: uint32(len(t.Data)),
+		}
+		if _, err := e.w.Write(t.Data); err != nil {
+			return 0, err
+		}
+	}
+
+	off := e.pos()
+	binary.Write(e.w, binary.LittleEndian, uint16(len(ents)))
+	return off, binary.Write(e.w, binary.LittleEndian, ents)
+}
+
+func (e *encoder) writeExtension(x *Extension) (uint32, error) {
+	var ext extension
+	ext.encode(x)
+
+	// readers treat the alpha as garbage when the
+	// attributes are unset so say that it is valid
+	if ext.Attributes == ATTR_NONE && e.alpha {
+		ext.Attributes = ATTR_ALPHA
+	}
+
+	if x.ColorCorrection != nil {
+		if len(x.ColorCorrection) != 256 {
+			return 0, fmt.Errorf("tga: color correction table must have 256 entries, got %d", len(x.ColorCorrection))
+		}
+		ext.ColorCorrection = e.pos()
+		for _, c := range x.ColorCorrection {
+			err := binary.Write(e.w, binary.LittleEndian, [4]uint16{c.A, c.R, c.G, c.B})
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if e.lines != nil {
+		ext.ScanLine = e.pos()
+		if err := binary.Write(e.w, binary.LittleEndian, e.lines); err != nil {
+			return 0, err
+		}
+	}
+
+	if x.Thumbnail != nil {
+		ext.PostageStamp = e.pos()
+		if err := e.writeThumbnail(x.Thumbnail); err != nil {
+			return 0, err
+		}
+	}
+
+	off := e.pos()
+	return off, binary.Write(e.w, binary.LittleEndian, &ext)
+}
+
+// writeThumbnail writes the postage stamp uncompressed
+// using the same pixel format as the image
+func (e *encoder) writeThumbnail(m image.Image) error {
+	r := m.Bounds()
+	if r.Dx() > math.MaxUint8 || r.Dy() > math.MaxUint8 {
+		return fmt.Errorf("tga: thumbnail dimension %dx%d is too big", r.Dx(), r.Dy())
+	}
+
+	if p, ok := e.m.(*image.Paletted); ok && e.o.Paletted {
+		t, ok := m.(*image.Paletted)
+		if !ok {
+			return errors.New("tga: thumbnail of a paletted image must be paletted")
+		}
+		m = remap(t, p.Palette)
+	}
+
+	e.w.Write([]byte{uint8(r.Dx()), uint8(r.Dy())})
+
+	e.m, e.o.Compress, e.lines = m, false, nil
+	return e.writeRows()
+}
+
+// remap returns the paletted image with its indices into
+// the palette, the file only has room for one color map
+func remap(m *image.Paletted, p color.Palette) *image.Paletted {
+	var lut [256]uint8
+	for i := 0; i < len(m.Palette) && i < len(lut); i++ {
+		lut[i] = uint8(p.Index(m.Palette[i]))
+	}
+
+	r := m.Bounds()
+	n := image.NewPaletted(r, p)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		s := m.Pix[m.PixOffset(r.Min.X, y):]
+		d := n.Pix[n.PixOffset(r.Min.X, y):]
+		for x := 0; x < r.Dx(); x++ {
+			d[x] = lut[s[x]]
+		}
+	}
+	return n
+}
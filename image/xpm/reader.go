@@ -0,0 +1,291 @@
+package xpm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/qeedquan/go-media/image/chroma"
+)
+
+const (
+	xpm3Header = "/* XPM */"
+	xpm2Header = "! XPM2"
+)
+
+type decoder struct {
+	lines  []string
+	w, h   int
+	ncolor int
+	cpp    int
+	keys   map[string]int
+	colors []color.NRGBA
+}
+
+// Decode reads an XPM2 or XPM3 image, paletted images are returned
+// for 256 colors or less and *image.NRGBA is returned otherwise
+func Decode(r io.Reader) (image.Image, error) {
+	d := &decoder{}
+	err := d.decodeHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	err = d.decodeColors()
+	if err != nil {
+		return nil, err
+	}
+	return d.decodePixels()
+}
+
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	d := &decoder{}
+	err := d.decodeHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	err = d.decodeColors()
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	var model color.Model = color.NRGBAModel
+	if d.ncolor <= 256 {
+		model = d.palette()
+	}
+	return image.Config{
+		ColorModel: model,
+		Width:      d.w,
+		Height:     d.h,
+	}, nil
+}
+
+func (d *decoder) decodeHeader(r io.Reader) error {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("xpm: %v", err)
+	}
+
+	// XPM2 is the lines of an XPM3 file without the C syntax
+	if bytes.HasPrefix(buf, []byte(xpm2Header)) {
+		s := strings.Replace(string(buf), "\r\n", "\n", -1)
+		d.lines = strings.Split(s, "\n")[1:]
+	} else {
+		d.lines, err = cstrings(buf)
+		if err != nil {
+			return err
+		}
+	}
+	if len(d.lines) == 0 {
+		return errors.New("xpm: missing values")
+	}
+
+	var v [4]int
+	f := strings.Fields(d.lines[0])
+	if len(f) < 4 {
+		return fmt.Errorf("xpm: invalid values %q", d.lines[0])
+	}
+	for i := range v {
+		v[i], err = strconv.Atoi(f[i])
+		if err != nil {
+			return fmt.Errorf("xpm: invalid values %q", d.lines[0])
+		}
+	}
+	d.w, d.h, d.ncolor, d.cpp = v[0], v[1], v[2], v[3]
+	if d.w < 1 || d.h < 1 || d.w > 1<<16 || d.h > 1<<16 {
+		return fmt.Errorf("xpm: invalid dimension %dx%d", d.w, d.h)
+	}
+	if d.cpp < 1 || d.cpp > 8 || d.ncolor < 1 {
+		return fmt.Errorf("xpm: invalid color count %d with %d characters per pixel", d.ncolor, d.cpp)
+	}
+	if len(d.lines) < 1+d.ncolor+d.h {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// cstrings returns the string literals inside the braces of a C array,
+// it skips comments so the images can be read from C source files
+func cstrings(b []byte) ([]string, error) {
+	var (
+		lines []string
+		quote []byte
+	)
+	open := false
+	for i := 0; i < len(b); i++ {
+		switch {
+		case bytes.HasPrefix(b[i:], []byte("/*")):
+			n := bytes.Index(b[i+2:], []byte("*/"))
+			if n < 0 {
+				return nil, errors.New("xpm: unterminated comment")
+			}
+			i += n + 3
+		case bytes.HasPrefix(b[i:], []byte("//")):
+			n := bytes.IndexByte(b[i:], '\n')
+			if n < 0 {
+				n = len(b) - i
+			}
+			i += n
+		case b[i] == '{':
+			open = true
+		case b[i] == '}' && open:
+			return lines, nil
+		case b[i] == '"' && open:
+			quote = quote[:0]
+			for i++; i < len(b) && b[i] != '"'; i++ {
+				if b[i] == '\\' && i+1 < len(b) {
+					i++
+				}
+				quote = append(quote, b[i])
+			}
+			lines = append(lines, string(quote))
+		}
+	}
+	if !open {
+		return nil, errors.New("xpm: invalid format")
+	}
+	return lines, nil
+}
+
+// contexts in order of preference, color then grayscale then mono,
+// the symbolic name is used when there is nothing else
+var contexts = []string{"c", "g", "g4", "m", "s"}
+
+func (d *decoder) decodeColors() error {
+	d.keys = make(map[string]int)
+	for i := 0; i < d.ncolor; i++ {
+		line := d.lines[1+i]
+		if len(line) < d.cpp {
+			return fmt.Errorf("xpm: invalid color %q", line)
+		}
+		key := line[:d.cpp]
+
+		// values may contain spaces so every word up to
+		// the next context keyword belongs to the value
+		values := make(map[string]string)
+		var ctx string
+		for _, f := range strings.Fields(line[d.cpp:]) {
+			if isContext(f) && (ctx == "" || values[ctx] != "") {
+				ctx = f
+				continue
+			}
+			if ctx == "" {
+				return fmt.Errorf("xpm: invalid color %q", line)
+			}
+			if values[ctx] != "" {
+				values[ctx] += " "
+			}
+			values[ctx] += f
+		}
+
+		var value string
+		for _, c := range contexts {
+			if values[c] != "" {
+				value = values[c]
+				break
+			}
+		}
+		c, err := parseColor(value)
+		if err != nil {
+			return err
+		}
+
+		d.keys[key] = len(d.colors)
+		d.colors = append(d.colors, c)
+	}
+	return nil
+}
+
+func isContext(s string) bool {
+	for _, c := range contexts {
+		if s == c {
+			return true
+		}
+	}
+	return false
+}
+
+// parseColor reads hex colors of 1 to 4 digits per channel, anything
+// else is a color name or one of the formats of chroma.ParseRGBA
+func parseColor(s string) (color.NRGBA, error) {
+	if strings.EqualFold(s, "none") {
+		return color.NRGBA{}, nil
+	}
+
+	if len(s) > 1 && s[0] == '#' && (len(s)-1)%3 == 0 && len(s)-1 <= 12 {
+		n := (len(s) - 1) / 3
+		var c [3]uint8
+		for i := range c {
+			v, err := strconv.ParseUint(s[1+i*n:1+(i+1)*n], 16, 16)
+			if err != nil {
+				return color.NRGBA{}, fmt.Errorf("xpm: invalid color %q", s)
+			}
+			// scale to 16 bits then keep the high byte
+			max := uint64(1)<<(4*uint(n)) - 1
+			c[i] = uint8(v * 0xffff / max >> 8)
+		}
+		return color.NRGBA{c[0], c[1], c[2], 0xff}, nil
+	}
+
+	c, err := chroma.ParseRGBA(s)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("xpm: %v", err)
+	}
+	return color.NRGBAModel.Convert(c).(color.NRGBA), nil
+}
+
+func (d *decoder) palette() color.Palette {
+	p := make(color.Palette, len(d.colors))
+	for i, c := range d.colors {
+		p[i] = c
+	}
+	return p
+}
+
+func (d *decoder) decodePixels() (image.Image, error) {
+	r := image.Rect(0, 0, d.w, d.h)
+	var (
+		p *image.Paletted
+		m *image.NRGBA
+	)
+	if d.ncolor <= 256 {
+		p = image.NewPaletted(r, d.palette())
+	} else {
+		m = image.NewNRGBA(r)
+	}
+
+	for y := 0; y < d.h; y++ {
+		line := d.lines[1+d.ncolor+y]
+		if len(line) < d.w*d.cpp {
+			return nil, fmt.Errorf("xpm: line %d is too short", y)
+		}
+		for x := 0; x < d.w; x++ {
+			key := line[x*d.cpp : (x+1)*d.cpp]
+			i, ok := d.keys[key]
+			if !ok {
+				return nil, fmt.Errorf("xpm: unknown color key %q", key)
+			}
+			if p != nil {
+				p.Pix[y*p.Stride+x] = uint8(i)
+			} else {
+				m.SetNRGBA(x, y, d.colors[i])
+			}
+		}
+	}
+
+	if p != nil {
+		return p, nil
+	}
+	return m, nil
+}
+
+func init() {
+	image.RegisterFormat("xpm", xpm3Header, Decode, DecodeConfig)
+	image.RegisterFormat("xpm", xpm2Header, Decode, DecodeConfig)
+	image.RegisterFormat("xbm", "#define ", DecodeXBM, DecodeXBMConfig)
+}
@@ -0,0 +1,127 @@
+package xpm
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// printable characters used for color keys, quotes and
+// backslashes are left out so the keys need no escaping
+const keyChars = " .XoO+@#$%&*=-;:>,<1234567890qwertyuipasdfghjklzxcvbnmMNBVCZASDFGHJKLPIUYTREWQ!~^/()_`'][{}|"
+
+type Options struct {
+	// Name is the name of the C array, zero is "image"
+	Name string
+
+	// XPM2 writes the lines without the C syntax
+	XPM2 bool
+}
+
+// Encode writes the image as XPM, pixels with
+// less than half alpha are written as None
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	if o == nil {
+		o = &Options{}
+	}
+	name := o.Name
+	if name == "" {
+		name = "image"
+	}
+
+	r := m.Bounds()
+	if r.Dx() < 1 || r.Dy() < 1 {
+		return fmt.Errorf("xpm: invalid dimension %dx%d", r.Dx(), r.Dy())
+	}
+
+	// build the color table in order of appearance, paletted
+	// images keep their palette so the indices are preserved
+	var (
+		colors []color.NRGBA
+		pix    []int
+	)
+	lookup := make(map[color.NRGBA]int)
+	add := func(c color.Color) int {
+		n := color.NRGBAModel.Convert(c).(color.NRGBA)
+		if n.A < 0x80 {
+			n = color.NRGBA{}
+		} else {
+			n.A = 0xff
+		}
+		i, ok := lookup[n]
+		if !ok {
+			i = len(colors)
+			lookup[n] = i
+			colors = append(colors, n)
+		}
+		return i
+	}
+
+	p, _ := m.(*image.Paletted)
+	var remap []int
+	if p != nil {
+		for _, c := range p.Palette {
+			remap = append(remap, add(c))
+		}
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if p != nil && int(p.ColorIndexAt(x, y)) < len(remap) {
+				pix = append(pix, remap[p.ColorIndexAt(x, y)])
+			} else {
+				pix = append(pix, add(m.At(x, y)))
+			}
+		}
+	}
+
+	cpp := 1
+	for n := len(keyChars); n < len(colors); n *= len(keyChars) {
+		cpp++
+	}
+	keys := make([]string, len(colors))
+	for i := range keys {
+		b := make([]byte, cpp)
+		for j, v := cpp-1, i; j >= 0; j-- {
+			b[j] = keyChars[v%len(keyChars)]
+			v /= len(keyChars)
+		}
+		keys[i] = string(b)
+	}
+
+	b := bufio.NewWriter(w)
+	begin, end := "\"", "\",\n"
+	if o.XPM2 {
+		begin, end = "", "\n"
+		fmt.Fprintf(b, "%s\n", xpm2Header)
+	} else {
+		fmt.Fprintf(b, "%s\nstatic char *%s[] = {\n", xpm3Header, name)
+	}
+
+	fmt.Fprintf(b, "%s%d %d %d %d%s", begin, r.Dx(), r.Dy(), len(colors), cpp, end)
+	for i, c := range colors {
+		value := "None"
+		if c.A != 0 {
+			value = fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)
+		}
+		fmt.Fprintf(b, "%s%s c %s%s", begin, keys[i], value, end)
+	}
+	for y := 0; y < r.Dy(); y++ {
+		b.WriteString(begin)
+		for _, i := range pix[y*r.Dx() : (y+1)*r.Dx()] {
+			b.WriteString(keys[i])
+		}
+		if y == r.Dy()-1 && !o.XPM2 {
+			b.WriteString("\"\n};\n")
+		} else {
+			b.WriteString(end)
+		}
+	}
+
+	err := b.Flush()
+	if err != nil {
+		return fmt.Errorf("xpm: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package xpm
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// XBMPalette is the palette of decoded bitmaps,
+// set bits are the foreground and use index 1
+var XBMPalette = color.Palette{
+	color.RGBA{0xff, 0xff, 0xff, 0xff},
+	color.RGBA{0x00, 0x00, 0x00, 0xff},
+}
+
+type XBMOptions struct {
+	// Name is the prefix of the C definitions, zero is "image"
+	Name string
+
+	// Hotspot is written if it is not nil
+	Hotspot *image.Point
+}
+
+type xbmDecoder struct {
+	buf     []byte
+	w, h    int
+	hotspot image.Point
+}
+
+// DecodeXBM reads X10 and X11 bitmaps, the definitions are
+// found by their suffix so C source files can be read directly
+func DecodeXBM(r io.Reader) (image.Image, error) {
+	d, err := decodeXBMHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.decode()
+}
+
+func DecodeXBMConfig(r io.Reader) (image.Config, error) {
+	d, err := decodeXBMHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{
+		ColorModel: XBMPalette,
+		Width:      d.w,
+		Height:     d.h,
+	}, nil
+}
+
+// DecodeXBMHotspot returns the hotspot of a bitmap, the
+// point is negative if the bitmap does not have one
+func DecodeXBMHotspot(r io.Reader) (image.Point, error) {
+	d, err := decodeXBMHeader(r)
+	if err != nil {
+		return image.Point{}, err
+	}
+	return d.hotspot, nil
+}
+
+func decodeXBMHeader(r io.Reader) (*xbmDecoder, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("xbm: %v", err)
+	}
+
+	d := &xbmDecoder{buf: buf, hotspot: image.Pt(-1, -1)}
+	s := bufio.NewScanner(bytes.NewReader(buf))
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) != 3 || f[0] != "#define" {
+			continue
+		}
+		v, err := strconv.Atoi(f[2])
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case strings.HasSuffix(f[1], "width"):
+			d.w = v
+		case strings.HasSuffix(f[1], "height"):
+			d.h = v
+		case strings.HasSuffix(f[1], "x_hot"):
+			d.hotspot.X = v
+		case strings.HasSuffix(f[1], "y_hot"):
+			d.hotspot.Y = v
+		}
+	}
+	if d.w < 1 || d.h < 1 || d.w > 1<<16 || d.h > 1<<16 {
+		return nil, fmt.Errorf("xbm: invalid dimension %dx%d", d.w, d.h)
+	}
+	return d, nil
+}
+
+func (d *xbmDecoder) decode() (image.Image, error) {
+	b := d.buf
+	i := bytes.Index(b, []byte("_bits"))
+	if i < 0 {
+		return nil, errors.New("xbm: missing bits")
+	}
+
+	// X10 bitmaps store 16 bit words
+	bits := 8
+	if bytes.Contains(b[:i], []byte("short")) {
+		bits = 16
+	}
+
+	j := bytes.IndexByte(b[i:], '{')
+	k := bytes.IndexByte(b[i:], '}')
+	if j < 0 || k < j {
+		return nil, errors.New("xbm: missing bits")
+	}
+
+	var words []uint16
+	for _, f := range strings.Split(string(b[i+j+1:i+k]), ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(f, 0, bits)
+		if err != nil {
+			return nil, fmt.Errorf("xbm: invalid value %q", f)
+		}
+		words = append(words, uint16(v))
+	}
+
+	// rows are padded to a whole word with the first pixel in the low bit
+	stride := (d.w + bits - 1) / bits
+	if len(words) < stride*d.h {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	m := image.NewPaletted(image.Rect(0, 0, d.w, d.h), XBMPalette)
+	for y := 0; y < d.h; y++ {
+		for x := 0; x < d.w; x++ {
+			w := words[y*stride+x/bits]
+			m.Pix[y*m.Stride+x] = uint8(w >> uint(x%bits) & 1)
+		}
+	}
+	return m, nil
+}
+
+// EncodeXBM writes an X11 bitmap, a bit is set for opaque dark pixels
+// and paletted images with two colors use their indices directly
+func EncodeXBM(w io.Writer, m image.Image, o *XBMOptions) error {
+	if o == nil {
+		o = &XBMOptions{}
+	}
+	name := o.Name
+	if name == "" {
+		name = "image"
+	}
+
+	r := m.Bounds()
+	if r.Dx() < 1 || r.Dy() < 1 {
+		return fmt.Errorf("xbm: invalid dimension %dx%d", r.Dx(), r.Dy())
+	}
+
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "#define %s_width %d\n#define %s_height %d\n", name, r.Dx(), name, r.Dy())
+	if o.Hotspot != nil {
+		fmt.Fprintf(b, "#define %s_x_hot %d\n#define %s_y_hot %d\n", name, o.Hotspot.X, name, o.Hotspot.Y)
+	}
+	fmt.Fprintf(b, "static unsigned char %s_bits[] = {", name)
+
+	p, _ := m.(*image.Paletted)
+	if p != nil && len(p.Palette) != 2 {
+		p = nil
+	}
+	n := 0
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x += 8 {
+			var v uint8
+			for i := 0; i < 8 && x+i < r.Max.X; i++ {
+				var set bool
+				if p != nil {
+					set = p.ColorIndexAt(x+i, y) == 1
+				} else {
+					c := color.NRGBAModel.Convert(m.At(x+i, y)).(color.NRGBA)
+					l := 299*int(c.R) + 587*int(c.G) + 114*int(c.B)
+					set = c.A >= 0x80 && l < 128*1000
+				}
+				if set {
+					v |= 1 << uint(i)
+				}
+			}
+
+			if n > 0 {
+				b.WriteString(",")
+			}
+			if n%12 == 0 {
+				b.WriteString("\n  ")
+			} else {
+				b.WriteString(" ")
+			}
+			fmt.Fprintf(b, "0x%02x", v)
+			n++
+		}
+	}
+	b.WriteString(" };\n")
+
+	err := b.Flush()
+	if err != nil {
+		return fmt.Errorf("xbm: %v", err)
+	}
+	return nil
+}
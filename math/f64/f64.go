@@ -618,6 +618,28 @@ func (m *Mat3) Trace() float64 {
 	return m[0][0] + m[1][1] + m[2][2]
 }
 
+func (m *Mat3) Inverse() *Mat3 {
+	invDet := 1 / m.Det()
+	*m = Mat3{
+		{
+			(m[1][1]*m[2][2] - m[1][2]*m[2][1]) * invDet,
+			(m[0][2]*m[2][1] - m[0][1]*m[2][2]) * invDet,
+			(m[0][1]*m[1][2] - m[0][2]*m[1][1]) * invDet,
+		},
+		{
+			(m[1][2]*m[2][0] - m[1][0]*m[2][2]) * invDet,
+			(m[0][0]*m[2][2] - m[0][2]*m[2][0]) * invDet,
+			(m[0][2]*m[1][0] - m[0][0]*m[1][2]) * invDet,
+		},
+		{
+			(m[1][0]*m[2][1] - m[1][1]*m[2][0]) * invDet,
+			(m[0][1]*m[2][0] - m[0][0]*m[2][1]) * invDet,
+			(m[0][0]*m[1][1] - m[0][1]*m[1][0]) * invDet,
+		},
+	}
+	return m
+}
+
 func (m Mat3) String() string {
 	return fmt.Sprintf(`
 Mat3[% 0.3f, % 0.3f, % 0.3f,
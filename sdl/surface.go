@@ -93,10 +93,17 @@ func (s *Surface) Flags() uint32             { return uint32(s.flags) }
 func (s *Surface) Size() (width, height int) { return int(s.w), int(s.h) }
 func (s *Surface) PixelFormat() *PixelFormat { return &PixelFormat{s.format} }
 func (s *Surface) Pixels() []byte {
-	n := s.w * s.h * C.int(s.format.BytesPerPixel)
+	n := s.pitch * s.h
 	return ((*[1 << 30]uint8)(s.pixels))[:n:n]
 }
 
+// Masks returns the bits per pixel and the channel masks of the
+// surface, pixels are stored in the native byte order
+func (s *Surface) Masks() (bpp int, rmask, gmask, bmask, amask uint32) {
+	f := s.format
+	return int(f.BitsPerPixel), uint32(f.Rmask), uint32(f.Gmask), uint32(f.Bmask), uint32(f.Amask)
+}
+
 func CreateRGBSurface(flags uint32, width, height, depth int, rmask, gmask, bmask, amask uint32) (*Surface, error) {
 	s := (*Surface)(C.SDL_CreateRGBSurface(C.Uint32(flags), C.int(width), C.int(height), C.int(depth),
 		C.Uint32(rmask), C.Uint32(gmask), C.Uint32(bmask), C.Uint32(amask)))